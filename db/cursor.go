@@ -0,0 +1,94 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"library-api/models"
+	"time"
+)
+
+// BookCursor marks a position in the book list ordered by creation time,
+// the key of the last book on a page. Clients see it only as an opaque
+// token, see Encode.
+type BookCursor struct {
+	CreatedAt time.Time `json:"c"`
+	ID        int       `json:"i"`
+}
+
+// ErrInvalidCursor is returned by ParseBookCursor for tokens it didn't issue
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Encode returns the cursor as a URL-safe token
+func (c BookCursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// ParseBookCursor decodes a token returned by Encode
+func ParseBookCursor(token string) (BookCursor, error) {
+	var c BookCursor
+
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(data, &c); err != nil || c.ID <= 0 || c.CreatedAt.IsZero() {
+		return c, ErrInvalidCursor
+	}
+
+	return c, nil
+}
+
+// GetBooksAfter returns up to limit books matching the filter ordered by
+// creation time, ID breaking ties, starting after the cursor; a nil cursor
+// starts at the beginning. next is the cursor of the page's last book when
+// more books follow, otherwise nil.
+//
+// Unlike offset pagination, pages are found by seeking to the cursor's key,
+// so deep pages stay fast and books inserted meanwhile neither shift later
+// pages nor are returned twice.
+func GetBooksAfter(ctx context.Context, db *sql.DB, filter BookFilter, descending bool, after *BookCursor, limit int) (books []models.Book, next *BookCursor, err error) {
+	conds, args := filter.conditions()
+
+	direction, cmp := "ASC", ">"
+	if descending {
+		direction, cmp = "DESC", "<"
+	}
+
+	// Spelled out rather than as a row comparison, which MariaDB can't turn
+	// into an index range
+	if after != nil {
+		conds = append(conds, "(created_at "+cmp+" ? OR (created_at = ? AND id "+cmp+" ?))")
+		args = append(args, after.CreatedAt, after.CreatedAt, after.ID)
+	}
+
+	// One book past the page shows whether another page follows
+	query := `SELECT ` + bookColumns + `
+			  FROM books
+			  ` + whereClause(conds) + `
+			  ORDER BY created_at ` + direction + `, id ` + direction + `
+			  LIMIT ?`
+
+	rows, err := db.QueryContext(ctx, query, append(args, limit+1)...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query books: %w", err)
+	}
+	defer rows.Close()
+
+	books, err = scanBooks(rows)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(books) > limit {
+		books = books[:limit]
+		last := books[limit-1]
+		next = &BookCursor{CreatedAt: last.CreatedAt, ID: last.ID}
+	}
+
+	return books, next, nil
+}
@@ -0,0 +1,104 @@
+package db
+
+import (
+	"database/sql/driver"
+	"encoding/base64"
+	"fmt"
+	"library-api/models"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestParseBookCursor(t *testing.T) {
+	valid := BookCursor{CreatedAt: time.Date(2024, 3, 1, 12, 30, 0, 123456000, time.UTC), ID: 42}
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+
+	tests := []struct {
+		token string
+		want  *BookCursor // nil when the token is invalid
+	}{
+		{valid.Encode(), &valid},
+		{"", nil},
+		{"not base64!", nil},
+		{encode("not json"), nil},
+		{encode(`{"c":"2024-03-01T12:30:00Z"}`), nil},
+		{encode(`{"i":42}`), nil},
+		{encode(`{"c":"2024-03-01T12:30:00Z","i":-1}`), nil},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseBookCursor(tt.token)
+		if tt.want == nil {
+			if err != ErrInvalidCursor {
+				t.Errorf("ParseBookCursor(%q) = %v, want ErrInvalidCursor", tt.token, err)
+			}
+			continue
+		}
+		if err != nil || !got.CreatedAt.Equal(tt.want.CreatedAt) || got.ID != tt.want.ID {
+			t.Errorf("ParseBookCursor(%q) = %+v, %v; want %+v", tt.token, got, err, tt.want)
+		}
+	}
+}
+
+func TestGetBooksAfter(t *testing.T) {
+	created := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+	book := func(id int) models.Book {
+		b := testBook()
+		b.ID, b.CreatedAt = id, created
+		return b
+	}
+	after := BookCursor{CreatedAt: created.Add(time.Hour), ID: 12}
+
+	tests := []struct {
+		name       string
+		descending bool
+		after      *BookCursor
+		query      string
+		args       []driver.Value
+		rows       []models.Book
+		ids        string
+		next       *BookCursor
+	}{
+		{
+			name:       "seeks past the cursor",
+			descending: true,
+			after:      &after,
+			query: regexp.QuoteMeta("WHERE (created_at < ? OR (created_at = ? AND id < ?))") +
+				`\s+` + regexp.QuoteMeta("ORDER BY created_at DESC, id DESC") + `\s+LIMIT \?`,
+			args: []driver.Value{after.CreatedAt, after.CreatedAt, after.ID, 3},
+			rows: []models.Book{book(9), book(8), book(7)},
+			ids:  "[9 8]",
+			next: &BookCursor{CreatedAt: created, ID: 8},
+		},
+		{
+			name:  "first and last page",
+			query: regexp.QuoteMeta("ORDER BY created_at ASC, id ASC"),
+			args:  []driver.Value{3},
+			rows:  []models.Book{book(1)},
+			ids:   "[1]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database, mock := newMock(t)
+			mock.ExpectQuery(tt.query).WithArgs(tt.args...).WillReturnRows(bookRows(tt.rows...))
+
+			books, next, err := GetBooksAfter(ctx, database, BookFilter{}, tt.descending, tt.after, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []int
+			for _, b := range books {
+				ids = append(ids, b.ID)
+			}
+			if fmt.Sprint(ids) != tt.ids {
+				t.Errorf("books %v, want %s", ids, tt.ids)
+			}
+			if fmt.Sprint(next) != fmt.Sprint(tt.next) {
+				t.Errorf("next = %+v, want %+v", next, tt.next)
+			}
+		})
+	}
+}
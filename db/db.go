@@ -1,58 +1,113 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
+	"errors"
 	"fmt"
 	"library-api/models"
+	"math/rand"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
-	_ "github.com/go-sql-driver/mysql"
 	"github.com/sirupsen/logrus"
 )
 
 // InitDB initializes the database connection
 func InitDB() (*sql.DB, error) {
-	dbUser := os.Getenv("DB_USER")
-	if dbUser == "" {
-		dbUser = "user"
+	driverName := os.Getenv("DB_DRIVER")
+	if driverName == "" {
+		driverName = "mysql"
 	}
-
-	dbPassword := os.Getenv("DB_PASSWORD")
-	if dbPassword == "" {
-		dbPassword = "Password"
+	d, ok := dialects[driverName]
+	if !ok {
+		return nil, fmt.Errorf("unsupported DB_DRIVER %q, must be mysql or postgres", driverName)
 	}
 
-	dbHost := os.Getenv("DB_HOST")
-	if dbHost == "" {
-		dbHost = "localhost"
+	cfg := connConfig{
+		user:     os.Getenv("DB_USER"),
+		password: os.Getenv("DB_PASSWORD"),
+		host:     os.Getenv("DB_HOST"),
+		port:     os.Getenv("DB_PORT"),
+		name:     os.Getenv("DB_NAME"),
+		appName:  os.Getenv("DB_APP_NAME"),
 	}
-
-	dbPort := os.Getenv("DB_PORT")
-	if dbPort == "" {
-		dbPort = "3306"
+	if cfg.user == "" {
+		cfg.user = "user"
+	}
+	if cfg.password == "" {
+		cfg.password = "Password"
+	}
+	if cfg.host == "" {
+		cfg.host = "localhost"
+	}
+	if cfg.port == "" {
+		cfg.port = defaultPorts[driverName]
+	}
+	if cfg.name == "" {
+		cfg.name = "db"
+	}
+	if cfg.appName == "" {
+		cfg.appName = "library-api"
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		cfg.instance = hostname
 	}
 
-	dbName := os.Getenv("DB_NAME")
-	if dbName == "" {
-		dbName = "db"
+	connector, err := driverConnector(d.driverName(), d.dsn(cfg))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database connection: %w", err)
 	}
+	// MySQL takes the ? placeholders as written
+	if _, ok := d.(mysqlDialect); !ok {
+		connector = &rebindingConnector{Connector: connector, dialect: d}
+	}
+
+	fullTextSearchEnabled, _ = strconv.ParseBool(os.Getenv("SEARCH_FULLTEXT"))
 
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=Local",
-		dbUser, dbPassword, dbHost, dbPort, dbName)
+	// Time every statement, and optionally log it; logging is never enabled
+	// by default
+	observe := observeQueryDuration
+	if debug, _ := strconv.ParseBool(os.Getenv("DB_DEBUG")); debug {
+		redact := true
+		if v, err := strconv.ParseBool(os.Getenv("DB_DEBUG_REDACT")); err == nil {
+			redact = v
+		}
+		logrus.WithField("redact", redact).Warn("SQL query logging enabled")
+		observe = func(query string, args []driver.NamedValue, duration time.Duration, err error) {
+			observeQueryDuration(query, args, duration, err)
+			logQuery(query, args, redact, duration, err)
+		}
+	}
+	connector = &observingConnector{Connector: connector, observe: observe}
 
-	db, err := sql.Open("mysql", dsn)
+	pool, err := poolConfigFromEnv()
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database connection: %w", err)
+		return nil, err
 	}
 
+	db := sql.OpenDB(connector)
+	activeDialect = d
+
 	// Configure connection pool
-	db.SetMaxOpenConns(25)
-	db.SetMaxIdleConns(5)
-	db.SetConnMaxLifetime(5 * time.Minute)
+	db.SetMaxOpenConns(pool.maxOpenConns)
+	db.SetMaxIdleConns(pool.maxIdleConns)
+	db.SetConnMaxLifetime(pool.connMaxLifetime)
+	logrus.WithFields(logrus.Fields{
+		"max_open_conns":    pool.maxOpenConns,
+		"max_idle_conns":    pool.maxIdleConns,
+		"conn_max_lifetime": pool.connMaxLifetime.String(),
+	}).Info("Database connection pool configured")
 
-	// Test the connection
-	if err := db.Ping(); err != nil {
+	// Test the connection, waiting for a database that is still starting up
+	if err := pingWithRetry(db.Ping, connectRetryFromEnv(), time.Sleep); err != nil {
+		db.Close()
 		return nil, fmt.Errorf("failed to ping database: %w", err)
 	}
 
@@ -62,21 +117,7 @@ func InitDB() (*sql.DB, error) {
 
 // RunMigrations runs database migrations
 func RunMigrations(db *sql.DB) error {
-	migrations := []string{
-		`CREATE TABLE IF NOT EXISTS books (
-			id INT AUTO_INCREMENT PRIMARY KEY,
-			title VARCHAR(255) NOT NULL,
-			author VARCHAR(255) NOT NULL,
-			published_year INT NOT NULL,
-			available BOOLEAN DEFAULT TRUE,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
-			INDEX idx_title (title),
-			INDEX idx_author (author),
-			INDEX idx_published_year (published_year),
-			INDEX idx_available (available)
-		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci`,
-	}
+	migrations := activeDialect.migrations()
 
 	for i, migration := range migrations {
 		if _, err := db.Exec(migration); err != nil {
@@ -88,56 +129,252 @@ func RunMigrations(db *sql.DB) error {
 	return nil
 }
 
-// GetBooks retrieves books with pagination
-func GetBooks(db *sql.DB, page, limit int) ([]models.Book, int, error) {
-	// Get total count
-	var total int
-	err := db.QueryRow("SELECT COUNT(*) FROM books").Scan(&total)
+// bookColumns is the column list selected for a book, in scanBook order
+const bookColumns = "id, title, author, isbn, genre, published_year, available, featured, availability_changed_at, last_accessed_at, created_at, updated_at"
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanBook scans a row selected with bookColumns, followed by any extra
+// selected columns into extra
+func scanBook(row rowScanner, extra ...interface{}) (models.Book, error) {
+	var book models.Book
+	var isbn, genre sql.NullString
+	var availabilityChangedAt, lastAccessedAt sql.NullTime
+
+	dest := []interface{}{&book.ID, &book.Title, &book.Author, &isbn, &genre, &book.PublishedYear, &book.Available,
+		&book.Featured, &availabilityChangedAt, &lastAccessedAt, &book.CreatedAt, &book.UpdatedAt}
+	err := row.Scan(append(dest, extra...)...)
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to get total count: %w", err)
+		return book, err
 	}
 
-	// Calculate offset
-	offset := (page - 1) * limit
+	book.ISBN = isbn.String
+	book.Genre = genre.String
 
-	// Get books with pagination
-	query := `SELECT id, title, author, published_year, available, created_at, updated_at 
-			  FROM books 
-			  ORDER BY created_at DESC 
-			  LIMIT ? OFFSET ?`
+	if availabilityChangedAt.Valid {
+		book.AvailabilityChangedAt = &availabilityChangedAt.Time
+	}
+	if lastAccessedAt.Valid {
+		book.LastAccessedAt = &lastAccessedAt.Time
+	}
 
-	rows, err := db.Query(query, limit, offset)
-	if err != nil {
-		return nil, 0, fmt.Errorf("failed to query books: %w", err)
+	return book, nil
+}
+
+// bookValues returns a book's values in bookColumns order
+func bookValues(book models.Book) []interface{} {
+	var availabilityChangedAt, lastAccessedAt interface{}
+	if book.AvailabilityChangedAt != nil {
+		availabilityChangedAt = *book.AvailabilityChangedAt
 	}
-	defer rows.Close()
+	if book.LastAccessedAt != nil {
+		lastAccessedAt = *book.LastAccessedAt
+	}
+
+	return []interface{}{book.ID, book.Title, book.Author, nullableISBN(book.ISBN), nullableGenre(book.Genre), book.PublishedYear, book.Available,
+		book.Featured, availabilityChangedAt, lastAccessedAt, book.CreatedAt, book.UpdatedAt}
+}
+
+// nullableISBN stores a missing ISBN as NULL, so the unique index only
+// applies to books that have one
+func nullableISBN(isbn string) interface{} {
+	if isbn == "" {
+		return nil
+	}
+	return isbn
+}
 
+// nullableGenre stores a book without a genre as NULL
+func nullableGenre(genre string) interface{} {
+	if genre == "" {
+		return nil
+	}
+	return genre
+}
+
+// scanBooks scans all remaining rows selected with bookColumns
+func scanBooks(rows *sql.Rows) ([]models.Book, error) {
 	var books []models.Book
 	for rows.Next() {
-		var book models.Book
-		err := rows.Scan(&book.ID, &book.Title, &book.Author, &book.PublishedYear,
-			&book.Available, &book.CreatedAt, &book.UpdatedAt)
+		book, err := scanBook(rows)
 		if err != nil {
-			return nil, 0, fmt.Errorf("failed to scan book: %w", err)
+			return nil, fmt.Errorf("failed to scan book: %w", err)
 		}
 		books = append(books, book)
 	}
 
-	if err = rows.Err(); err != nil {
-		return nil, 0, fmt.Errorf("error iterating over rows: %w", err)
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+
+	return books, nil
+}
+
+// completenessScore is how many of a book's optional fields, isbn and genre,
+// are set, so the least complete records sort first in ascending order
+const completenessScore = `((CASE WHEN isbn IS NULL OR isbn = '' THEN 0 ELSE 1 END) + (CASE WHEN genre IS NULL OR genre = '' THEN 0 ELSE 1 END))`
+
+// bookSortColumns lists the columns the book list can be sorted by, each with
+// the expression it orders by
+var bookSortColumns = map[string]string{
+	"id":             "id",
+	"title":          "title",
+	"author":         "author",
+	"published_year": "published_year",
+	"created_at":     "created_at",
+	"updated_at":     "updated_at",
+	"completeness":   completenessScore,
+}
+
+// IsBookSortColumn reports whether the book list can be sorted by column
+func IsBookSortColumn(column string) bool {
+	_, ok := bookSortColumns[column]
+	return ok
+}
+
+// collatedSortColumns lists the text columns a sort collation applies to
+var collatedSortColumns = map[string]bool{
+	"title":  true,
+	"author": true,
+}
+
+// IsSortCollation reports whether the book list can be sorted with collation
+func IsSortCollation(collation string) bool {
+	_, ok := activeDialect.sortCollations()[collation]
+	return ok
+}
+
+// SortCollations returns the collations the book list can be sorted with, in
+// alphabetical order
+func SortCollations() []string {
+	collations := make([]string, 0, len(activeDialect.sortCollations()))
+	for collation := range activeDialect.sortCollations() {
+		collations = append(collations, collation)
+	}
+	sort.Strings(collations)
+	return collations
+}
+
+// listBooksQuery returns the paginated query used by GetBooks. sortBy must be
+// one of bookSortColumns, and collation empty, for the column's own
+// collation, or one of the dialect's sort collations. Only text columns are
+// collated.
+func listBooksQuery(where, sortBy string, descending bool, collation string) string {
+	direction := "ASC"
+	if descending {
+		direction = "DESC"
+	}
+
+	orderBy := bookSortColumns[sortBy]
+	if collation != "" && collatedSortColumns[sortBy] {
+		orderBy += " COLLATE " + activeDialect.sortCollations()[collation]
+	}
+
+	// Break ties by ID so pages are stable
+	orderBy += " " + direction
+	if sortBy != "id" {
+		orderBy += ", id " + direction
+	}
+
+	return `SELECT ` + bookColumns + ` 
+			  FROM books 
+			  ` + where + `
+			  ORDER BY ` + orderBy + `
+			  LIMIT ? OFFSET ?`
+}
+
+// GetBooks retrieves books matching the filter with pagination, ordered by
+// the given column. When countTotal is false the count query is skipped: the
+// total is returned as -1, and one book past the page is fetched if it exists
+// so callers can tell whether another page follows.
+func GetBooks(ctx context.Context, db *sql.DB, filter BookFilter, sortBy string, descending bool, collation string, page, limit int, countTotal bool) ([]models.Book, int, error) {
+	if !IsBookSortColumn(sortBy) {
+		return nil, 0, fmt.Errorf("invalid sort column %q", sortBy)
+	}
+	if collation != "" && !IsSortCollation(collation) {
+		return nil, 0, fmt.Errorf("invalid sort collation %q", collation)
+	}
+
+	conds, args := filter.conditions()
+	where := whereClause(conds)
+
+	// Get total count
+	total := -1
+	fetch := limit + 1
+	if countTotal {
+		var err error
+		if total, err = CountBooks(ctx, db, "", filter); err != nil {
+			return nil, 0, err
+		}
+		fetch = limit
+	}
+
+	// Calculate offset
+	offset := (page - 1) * limit
+
+	// Get books with pagination; the sort column is whitelisted above, so it
+	// is safe to interpolate
+	rows, err := db.QueryContext(ctx, listBooksQuery(where, sortBy, descending, collation), append(args, fetch, offset)...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query books: %w", err)
+	}
+	defer rows.Close()
+
+	books, err := scanBooks(rows)
+	if err != nil {
+		return nil, 0, err
 	}
 
 	return books, total, nil
 }
 
+// CountBooks counts the books matching the filter and, unless query is
+// empty, a title or author search as in SearchBooks
+func CountBooks(ctx context.Context, db *sql.DB, query string, filter BookFilter) (int, error) {
+	total, err := countBooks(ctx, db, query, filter)
+	if retryWithoutFullText(err) {
+		return countBooks(ctx, db, query, filter)
+	}
+	return total, err
+}
+
+func countBooks(ctx context.Context, db *sql.DB, query string, filter BookFilter) (int, error) {
+	conds, args := searchConditions(query, filter)
+
+	var total int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM books "+whereClause(conds), args...).Scan(&total)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get total count: %w", err)
+	}
+	return total, nil
+}
+
+// searchConditions returns the conditions of the filter, preceded by a
+// title or author search as in SearchBooks unless query is empty
+func searchConditions(query string, filter BookFilter) ([]string, []interface{}) {
+	conds, args := filter.conditions()
+	if query != "" {
+		search := newBookSearch(query)
+		conds = append([]string{search.cond}, conds...)
+		args = append(append([]interface{}{}, search.condArgs...), args...)
+	}
+	return conds, args
+}
+
 // GetBookByID retrieves a single book by ID
-func GetBookByID(db *sql.DB, id int) (*models.Book, error) {
-	query := `SELECT id, title, author, published_year, available, created_at, updated_at 
+func GetBookByID(ctx context.Context, db *sql.DB, id int) (*models.Book, error) {
+	return getBookByID(ctx, db, id)
+}
+
+// getBookByID retrieves a single book by ID, or nil if it doesn't exist
+func getBookByID(ctx context.Context, q querier, id int) (*models.Book, error) {
+	query := `SELECT ` + bookColumns + ` 
 			  FROM books WHERE id = ?`
 
-	var book models.Book
-	err := db.QueryRow(query, id).Scan(&book.ID, &book.Title, &book.Author,
-		&book.PublishedYear, &book.Available, &book.CreatedAt, &book.UpdatedAt)
+	book, err := scanBook(q.QueryRowContext(ctx, query, id))
 
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -149,150 +386,1254 @@ func GetBookByID(db *sql.DB, id int) (*models.Book, error) {
 	return &book, nil
 }
 
-// CreateBook creates a new book
-func CreateBook(db *sql.DB, req models.CreateBookRequest) (*models.Book, error) {
-	available := true
-	if req.Available != nil {
-		available = *req.Available
+// GetRandomBook picks a random book matching the filter, or returns nil if
+// none does. Rather than sorting the whole table randomly, it picks a random
+// ID between the smallest and largest matching ones and takes the first
+// matching book from there, which two index lookups can answer. Books
+// following a gap in the IDs are proportionally more likely to be picked.
+func GetRandomBook(ctx context.Context, db *sql.DB, filter BookFilter) (*models.Book, error) {
+	conds, args := filter.conditions()
+
+	var minID, maxID sql.NullInt64
+	err := db.QueryRowContext(ctx, "SELECT MIN(id), MAX(id) FROM books "+whereClause(conds), args...).Scan(&minID, &maxID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get book ID range: %w", err)
+	}
+	if !minID.Valid {
+		return nil, nil
 	}
 
-	query := `INSERT INTO books (title, author, published_year, available) 
-			  VALUES (?, ?, ?, ?)`
+	pick := minID.Int64 + rand.Int63n(maxID.Int64-minID.Int64+1)
+	query := `SELECT ` + bookColumns + ` FROM books ` +
+		whereClause(append(conds, "id >= ?")) + ` ORDER BY id LIMIT 1`
 
-	result, err := db.Exec(query, req.Title, req.Author, req.PublishedYear, available)
+	book, err := scanBook(db.QueryRowContext(ctx, query, append(args, pick)...))
+	if err == sql.ErrNoRows {
+		// The only matching books were removed since the range was read
+		return nil, nil
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to create book: %w", err)
+		return nil, fmt.Errorf("failed to get random book: %w", err)
 	}
 
-	id, err := result.LastInsertId()
+	return &book, nil
+}
+
+// TouchBook records that a book was just accessed. updated_at is left alone,
+// since an access isn't a change to the book.
+func TouchBook(ctx context.Context, db *sql.DB, id int) error {
+	_, err := db.ExecContext(ctx, "UPDATE books SET last_accessed_at = CURRENT_TIMESTAMP, updated_at = updated_at WHERE id = ?", id)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get last insert ID: %w", err)
+		return fmt.Errorf("failed to record book access: %w", err)
 	}
+	return nil
+}
+
+// ErrAuthorLimitReached is returned by CreateBook when the author already has
+// the maximum number of books allowed
+var ErrAuthorLimitReached = errors.New("author book limit reached")
+
+// ErrPreconditionFailed is returned by UpdateBook when the book no longer
+// matches the version the caller expected
+var ErrPreconditionFailed = errors.New("book was modified")
 
-	return GetBookByID(db, int(id))
+// ErrNotFound is returned by UpdateBook and ReplaceBook when no book has
+// the given ID
+var ErrNotFound = errors.New("book not found")
+
+// ErrDuplicate is returned when a write would violate a unique constraint,
+// such as two books sharing an ISBN
+var ErrDuplicate = errors.New("duplicate entry")
+
+// isDuplicateEntry reports whether err is a unique key violation
+func isDuplicateEntry(err error) bool {
+	return activeDialect.isDuplicateEntry(err)
 }
 
-// UpdateBook updates an existing book
-func UpdateBook(db *sql.DB, id int, req models.UpdateBookRequest) (*models.Book, error) {
-	// Check if book exists
-	existing, err := GetBookByID(db, id)
+// CreateBook creates a new book. When maxPerAuthor is positive, creation fails
+// with ErrAuthorLimitReached if the author already has that many books. It
+// fails with ErrDuplicate if it would violate a unique constraint. The insert
+// and the read of the created book share a transaction.
+func CreateBook(ctx context.Context, db *sql.DB, req models.CreateBookRequest, maxPerAuthor int) (*models.Book, error) {
+	available := true
+	if req.Available != nil {
+		available = *req.Available
+	}
+
+	var book *models.Book
+	err := WithTx(ctx, db, func(tx *sql.Tx) error {
+		if err := checkAuthorLimits(ctx, tx, map[string]int{req.Author: 1}, maxPerAuthor); err != nil {
+			return err
+		}
+
+		query := `INSERT INTO books (title, author, isbn, genre, published_year, available) 
+			  VALUES (?, ?, ?, ?, ?, ?)`
+
+		ids, err := activeDialect.insertIDs(ctx, tx, query,
+			[]interface{}{req.Title, req.Author, nullableISBN(req.ISBN), nullableGenre(req.Genre), req.PublishedYear, available}, 1)
+		if isDuplicateEntry(err) {
+			return ErrDuplicate
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create book: %w", err)
+		}
+
+		book, err = getBookByID(ctx, tx, int(ids[0]))
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	if existing == nil {
-		return nil, nil
-	}
 
-	// Build dynamic update query
-	updates := []string{}
-	args := []interface{}{}
+	return book, nil
+}
 
-	if req.Title != nil {
-		updates = append(updates, "title = ?")
-		args = append(args, *req.Title)
+// CreateBooks creates several books with a single multi-row insert inside a
+// transaction, so either all of them are created or none are. The per-author
+// limit applies as in CreateBook, counting the new books too.
+func CreateBooks(ctx context.Context, db *sql.DB, reqs []models.CreateBookRequest, maxPerAuthor int) ([]models.Book, error) {
+	if len(reqs) == 0 {
+		return []models.Book{}, nil
 	}
-	if req.Author != nil {
-		updates = append(updates, "author = ?")
-		args = append(args, *req.Author)
+
+	var books []models.Book
+	err := WithTx(ctx, db, func(tx *sql.Tx) error {
+		newPerAuthor := make(map[string]int)
+		for _, req := range reqs {
+			newPerAuthor[req.Author]++
+		}
+		if err := checkAuthorLimits(ctx, tx, newPerAuthor, maxPerAuthor); err != nil {
+			return err
+		}
+
+		ids, err := insertBooks(ctx, tx, reqs, "")
+		if err != nil {
+			return err
+		}
+
+		idArgs := make([]interface{}, len(ids))
+		for i, id := range ids {
+			idArgs[i] = id
+		}
+		rows, err := tx.QueryContext(ctx, `SELECT `+bookColumns+` FROM books WHERE id IN (`+placeholderList(len(ids))+`) ORDER BY id`,
+			idArgs...)
+		if err != nil {
+			return fmt.Errorf("failed to query created books: %w", err)
+		}
+		defer rows.Close()
+
+		books, err = scanBooks(rows)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	if req.PublishedYear != nil {
-		updates = append(updates, "published_year = ?")
-		args = append(args, *req.PublishedYear)
+
+	return books, nil
+}
+
+// ImportBooks creates many books in one transaction, inserting them in
+// batches of batchSize rows so each statement stays under the database's
+// placeholder limit. Either all of them are created or none are, and the
+// per-author limit applies as in CreateBooks. Every book is tagged with
+// importBatchID, so the import can be listed or deleted later. It returns
+// how many books were created.
+func ImportBooks(ctx context.Context, db *sql.DB, reqs []models.CreateBookRequest, importBatchID string, batchSize, maxPerAuthor int) (int, error) {
+	if len(reqs) == 0 {
+		return 0, nil
 	}
-	if req.Available != nil {
-		updates = append(updates, "available = ?")
-		args = append(args, *req.Available)
+
+	err := WithTx(ctx, db, func(tx *sql.Tx) error {
+		newPerAuthor := make(map[string]int)
+		for _, req := range reqs {
+			newPerAuthor[req.Author]++
+		}
+		if err := checkAuthorLimits(ctx, tx, newPerAuthor, maxPerAuthor); err != nil {
+			return err
+		}
+
+		for start := 0; start < len(reqs); start += batchSize {
+			end := start + batchSize
+			if end > len(reqs) {
+				end = len(reqs)
+			}
+			if _, err := insertBooks(ctx, tx, reqs[start:end], importBatchID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
 
-	if len(updates) == 0 {
-		return existing, nil // No updates needed
+	return len(reqs), nil
+}
+
+// ExistingISBNs returns which of the given ISBNs are already used by a book.
+// They are looked up in batches so each query stays under the database's
+// placeholder limit.
+func ExistingISBNs(ctx context.Context, db *sql.DB, isbns []string) (map[string]bool, error) {
+	const batchSize = 1000
+	existing := make(map[string]bool)
+
+	for start := 0; start < len(isbns); start += batchSize {
+		batch := isbns[start:min(start+batchSize, len(isbns))]
+		args := make([]interface{}, len(batch))
+		for i, isbn := range batch {
+			args[i] = isbn
+		}
+
+		rows, err := db.QueryContext(ctx, "SELECT isbn FROM books WHERE isbn IN ("+placeholderList(len(batch))+")", args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query ISBNs: %w", err)
+		}
+		for rows.Next() {
+			var isbn string
+			if err := rows.Scan(&isbn); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan ISBN: %w", err)
+			}
+			existing[isbn] = true
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error iterating over rows: %w", err)
+		}
 	}
 
-	query := fmt.Sprintf("UPDATE books SET %s, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
-		fmt.Sprintf("%s", updates[0]))
-	for i := 1; i < len(updates); i++ {
-		query = fmt.Sprintf("UPDATE books SET %s, %s, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
-			updates[0], updates[i])
+	return existing, nil
+}
+
+// Import keys identify the stored book an upserted import row replaces
+const (
+	ImportKeyISBN            = "isbn"
+	ImportKeyTitleAuthorYear = "title_author_year"
+)
+
+// IsImportKey reports whether key can identify the books an import upserts
+func IsImportKey(key string) bool {
+	return key == ImportKeyISBN || key == ImportKeyTitleAuthorYear
+}
+
+// MatchBooks returns, for each request, the ID of the stored book with the
+// same key, or 0 if there is none. Requests without an ISBN match nothing by
+// ISBN. Of several books with the same title, author and year, the oldest
+// matches.
+func MatchBooks(ctx context.Context, db *sql.DB, reqs []models.CreateBookRequest, key string) ([]int, error) {
+	ids := make([]int, len(reqs))
+	for i, req := range reqs {
+		var err error
+		switch key {
+		case ImportKeyISBN:
+			if req.ISBN == "" {
+				continue
+			}
+			err = db.QueryRowContext(ctx, "SELECT id FROM books WHERE isbn = ?", req.ISBN).Scan(&ids[i])
+		case ImportKeyTitleAuthorYear:
+			err = db.QueryRowContext(ctx, "SELECT id FROM books WHERE title = ? AND author = ? AND published_year = ? ORDER BY id LIMIT 1",
+				req.Title, req.Author, req.PublishedYear).Scan(&ids[i])
+		default:
+			return nil, fmt.Errorf("invalid import key %q", key)
+		}
+		if err != nil && err != sql.ErrNoRows {
+			return nil, fmt.Errorf("failed to match book: %w", err)
+		}
 	}
+	return ids, nil
+}
 
-	// Rebuild query properly
-	updateClause := ""
-	for i, update := range updates {
-		if i > 0 {
-			updateClause += ", "
+// UpsertBooks imports books in one transaction like ImportBooks, except that
+// a request with a nonzero entry in ids, as returned by MatchBooks, replaces
+// that book's fields instead of creating a new one. The replacements are
+// written with INSERT ... ON DUPLICATE KEY UPDATE keyed on the ID, in batches
+// of batchSize rows. The per-author limit applies only to the books created,
+// and only they are tagged with importBatchID, so deleting the batch leaves
+// the replaced books. It returns how many books were created and how many
+// updated.
+func UpsertBooks(ctx context.Context, db *sql.DB, reqs []models.CreateBookRequest, ids []int, importBatchID string, batchSize, maxPerAuthor int) (created, updated int, err error) {
+	var creates, updates []models.CreateBookRequest
+	var updateIDs []int
+	for i, req := range reqs {
+		if ids[i] == 0 {
+			creates = append(creates, req)
+		} else {
+			updates = append(updates, req)
+			updateIDs = append(updateIDs, ids[i])
 		}
-		updateClause += update
 	}
-	query = fmt.Sprintf("UPDATE books SET %s, updated_at = CURRENT_TIMESTAMP WHERE id = ?", updateClause)
 
-	args = append(args, id)
+	err = WithTx(ctx, db, func(tx *sql.Tx) error {
+		newPerAuthor := make(map[string]int)
+		for _, req := range creates {
+			newPerAuthor[req.Author]++
+		}
+		if err := checkAuthorLimits(ctx, tx, newPerAuthor, maxPerAuthor); err != nil {
+			return err
+		}
 
-	_, err = db.Exec(query, args...)
+		for start := 0; start < len(creates); start += batchSize {
+			if _, err := insertBooks(ctx, tx, creates[start:min(start+batchSize, len(creates))], importBatchID); err != nil {
+				return err
+			}
+		}
+		for start := 0; start < len(updates); start += batchSize {
+			end := min(start+batchSize, len(updates))
+			if err := upsertBooks(ctx, tx, updates[start:end], updateIDs[start:end]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to update book: %w", err)
+		return 0, 0, err
 	}
 
-	return GetBookByID(db, id)
+	return len(creates), len(updates), nil
 }
 
-// DeleteBook deletes a book by ID
-func DeleteBook(db *sql.DB, id int) error {
-	// Check if book exists
-	existing, err := GetBookByID(db, id)
-	if err != nil {
-		return err
-	}
-	if existing == nil {
-		return sql.ErrNoRows
+// upsertBooks writes books under the given IDs with a single multi-row
+// statement, replacing the fields of those that exist. Books without an
+// availability are available.
+func upsertBooks(ctx context.Context, tx *sql.Tx, reqs []models.CreateBookRequest, ids []int) error {
+	placeholders := make([]string, 0, len(reqs))
+	args := make([]interface{}, 0, len(reqs)*7)
+	for i, req := range reqs {
+		available := true
+		if req.Available != nil {
+			available = *req.Available
+		}
+		placeholders = append(placeholders, "(?, ?, ?, ?, ?, ?, ?)")
+		args = append(args, ids[i], req.Title, req.Author, nullableISBN(req.ISBN), nullableGenre(req.Genre), req.PublishedYear, available)
 	}
 
-	query := "DELETE FROM books WHERE id = ?"
-	_, err = db.Exec(query, id)
+	query := `INSERT INTO books (id, title, author, isbn, genre, published_year, available) 
+			  VALUES ` + strings.Join(placeholders, ", ") + activeDialect.upsertByID()
+
+	_, err := tx.ExecContext(ctx, query, args...)
+	if isDuplicateEntry(err) {
+		return ErrDuplicate
+	}
 	if err != nil {
-		return fmt.Errorf("failed to delete book: %w", err)
+		return fmt.Errorf("failed to update books: %w", err)
 	}
-
 	return nil
 }
 
-// SearchBooks searches for books by title or author
-func SearchBooks(db *sql.DB, query string, page, limit int) ([]models.Book, int, error) {
-	searchTerm := "%" + query + "%"
+// CountBooksByAuthor returns how many books each of the given authors has,
+// matching authors as the per-author limit does
+func CountBooksByAuthor(ctx context.Context, db *sql.DB, authors []string) (map[string]int, error) {
+	counts := make(map[string]int, len(authors))
+	for _, author := range authors {
+		var count int
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM books WHERE author = ?", author).Scan(&count); err != nil {
+			return nil, fmt.Errorf("failed to count author books: %w", err)
+		}
+		counts[author] = count
+	}
+	return counts, nil
+}
 
-	// Get total count
-	var total int
-	countQuery := "SELECT COUNT(*) FROM books WHERE title LIKE ? OR author LIKE ?"
-	err := db.QueryRow(countQuery, searchTerm, searchTerm).Scan(&total)
+// insertBooks inserts books with a single multi-row statement and returns
+// their new IDs in order. Books without an availability are available, and
+// all of them are tagged with importBatchID unless it's empty.
+func insertBooks(ctx context.Context, tx *sql.Tx, reqs []models.CreateBookRequest, importBatchID string) ([]int64, error) {
+	var batchID interface{}
+	if importBatchID != "" {
+		batchID = importBatchID
+	}
+
+	placeholders := make([]string, 0, len(reqs))
+	args := make([]interface{}, 0, len(reqs)*7)
+	for _, req := range reqs {
+		available := true
+		if req.Available != nil {
+			available = *req.Available
+		}
+		placeholders = append(placeholders, "(?, ?, ?, ?, ?, ?, ?)")
+		args = append(args, req.Title, req.Author, nullableISBN(req.ISBN), nullableGenre(req.Genre), req.PublishedYear, available, batchID)
+	}
+
+	query := `INSERT INTO books (title, author, isbn, genre, published_year, available, import_batch_id) 
+			  VALUES ` + strings.Join(placeholders, ", ")
+
+	ids, err := activeDialect.insertIDs(ctx, tx, query, args, len(reqs))
+	if isDuplicateEntry(err) {
+		return nil, ErrDuplicate
+	}
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to get total count: %w", err)
+		return nil, fmt.Errorf("failed to create books: %w", err)
 	}
+	return ids, nil
+}
 
-	// Calculate offset
-	offset := (page - 1) * limit
+// checkAuthorLimits fails with ErrAuthorLimitReached if adding the given
+// number of books per author would exceed maxPerAuthor. The authors' rows are
+// locked so concurrent creates can't both pass the check.
+func checkAuthorLimits(ctx context.Context, tx *sql.Tx, newPerAuthor map[string]int, maxPerAuthor int) error {
+	if maxPerAuthor <= 0 {
+		return nil
+	}
 
-	// Get books with search and pagination
-	searchQuery := `SELECT id, title, author, published_year, available, created_at, updated_at 
-					FROM books 
-					WHERE title LIKE ? OR author LIKE ?
-					ORDER BY created_at DESC 
-					LIMIT ? OFFSET ?`
+	for author, added := range newPerAuthor {
+		count, err := countLocked(ctx, tx, "SELECT id FROM books WHERE author = ? FOR UPDATE", author)
+		if err != nil {
+			return fmt.Errorf("failed to count author books: %w", err)
+		}
+		if count+added > maxPerAuthor {
+			return ErrAuthorLimitReached
+		}
+	}
 
-	rows, err := db.Query(searchQuery, searchTerm, searchTerm, limit, offset)
+	return nil
+}
+
+// countLocked counts the rows a locking SELECT returns. PostgreSQL doesn't
+// allow FOR UPDATE with aggregates, so the rows are counted here instead.
+func countLocked(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (int, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, 0, fmt.Errorf("failed to search books: %w", err)
+		return 0, err
 	}
 	defer rows.Close()
 
-	var books []models.Book
+	count := 0
 	for rows.Next() {
-		var book models.Book
-		err := rows.Scan(&book.ID, &book.Title, &book.Author, &book.PublishedYear,
-			&book.Available, &book.CreatedAt, &book.UpdatedAt)
+		count++
+	}
+	return count, rows.Err()
+}
+
+// placeholderList returns n comma-separated placeholders for an IN list
+func placeholderList(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// UpdateBook updates an existing book. Only columns whose value differs from
+// the stored one are written; changed reports whether any were. It fails with
+// ErrNotFound if the book doesn't exist and ErrDuplicate if it would violate
+// a unique constraint. The existing book is locked, updated and read back in
+// one transaction.
+//
+// When matches is non-nil, it is called with the locked book and the update
+// fails with ErrPreconditionFailed unless it returns true. Since the row is
+// locked, no other write can slip in between the check and the update.
+func UpdateBook(ctx context.Context, db *sql.DB, id int, req models.UpdateBookRequest, matches func(*models.Book) bool) (book *models.Book, changed bool, err error) {
+	err = WithTx(ctx, db, func(tx *sql.Tx) error {
+		// Check if book exists
+		existing, err := scanBook(tx.QueryRowContext(ctx, `SELECT `+bookColumns+` FROM books WHERE id = ? FOR UPDATE`, id))
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		}
 		if err != nil {
-			return nil, 0, fmt.Errorf("failed to scan book: %w", err)
+			return fmt.Errorf("failed to get book: %w", err)
 		}
-		books = append(books, book)
-	}
 
-	return books, total, nil
+		if matches != nil && !matches(&existing) {
+			return ErrPreconditionFailed
+		}
+
+		// Build dynamic update query
+		updates := []string{}
+		args := []interface{}{}
+
+		for _, field := range changedFields(&existing, req) {
+			value := field.value
+			switch field.column {
+			case "isbn":
+				value = nullableISBN(value.(string))
+			case "genre":
+				value = nullableGenre(value.(string))
+			}
+			updates = append(updates, field.column+" = ?")
+			args = append(args, value)
+
+			// Record when availability flips
+			if field.column == "available" {
+				updates = append(updates, "availability_changed_at = CURRENT_TIMESTAMP")
+			}
+		}
+
+		if len(updates) == 0 {
+			book = &existing // No updates needed
+			return nil
+		}
+
+		query := fmt.Sprintf("UPDATE books SET %s, updated_at = CURRENT_TIMESTAMP WHERE id = ?", strings.Join(updates, ", "))
+		args = append(args, id)
+
+		_, err = tx.ExecContext(ctx, query, args...)
+		if isDuplicateEntry(err) {
+			return ErrDuplicate
+		}
+		if err != nil {
+			return fmt.Errorf("failed to update book: %w", err)
+		}
+
+		book, err = getBookByID(ctx, tx, id)
+		changed = true
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return book, changed, nil
+}
+
+// ReplaceBook replaces an existing book's title, author, ISBN, genre, year
+// and availability with the ones in req. An empty ISBN or genre clears it.
+// It otherwise behaves like UpdateBook, which it applies with every field
+// set.
+func ReplaceBook(ctx context.Context, db *sql.DB, id int, req models.CreateBookRequest, matches func(*models.Book) bool) (book *models.Book, changed bool, err error) {
+	return UpdateBook(ctx, db, id, models.UpdateBookRequest{
+		Title:         &req.Title,
+		Author:        &req.Author,
+		ISBN:          &req.ISBN,
+		Genre:         &req.Genre,
+		PublishedYear: &req.PublishedYear,
+		Available:     req.Available,
+	}, matches)
+}
+
+// fieldUpdate is a single column assignment requested by an update
+type fieldUpdate struct {
+	column string
+	value  interface{}
+}
+
+// updateFields returns the column assignments for the fields set in req
+func updateFields(req models.UpdateBookRequest) []fieldUpdate {
+	var fields []fieldUpdate
+
+	if req.Title != nil {
+		fields = append(fields, fieldUpdate{"title", *req.Title})
+	}
+	if req.Author != nil {
+		fields = append(fields, fieldUpdate{"author", *req.Author})
+	}
+	if req.ISBN != nil {
+		fields = append(fields, fieldUpdate{"isbn", *req.ISBN})
+	}
+	if req.Genre != nil {
+		fields = append(fields, fieldUpdate{"genre", *req.Genre})
+	}
+	if req.PublishedYear != nil {
+		fields = append(fields, fieldUpdate{"published_year", *req.PublishedYear})
+	}
+	if req.Available != nil {
+		fields = append(fields, fieldUpdate{"available", *req.Available})
+	}
+
+	return fields
+}
+
+// changedFields returns the column assignments in req whose values differ
+// from the book's current ones
+func changedFields(book *models.Book, req models.UpdateBookRequest) []fieldUpdate {
+	var fields []fieldUpdate
+	for _, field := range updateFields(req) {
+		if bookFieldValue(book, field.column) != field.value {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// bookFieldValue returns the current value of the given column for a book
+func bookFieldValue(book *models.Book, column string) interface{} {
+	switch column {
+	case "title":
+		return book.Title
+	case "author":
+		return book.Author
+	case "isbn":
+		return book.ISBN
+	case "genre":
+		return book.Genre
+	case "published_year":
+		return book.PublishedYear
+	case "available":
+		return book.Available
+	}
+	return nil
+}
+
+// PreviewUpdate returns the field changes an update would make to a book
+// without applying them
+func PreviewUpdate(ctx context.Context, db *sql.DB, id int, req models.UpdateBookRequest) (*models.UpdatePreview, error) {
+	existing, err := GetBookByID(ctx, db, id)
+	if err != nil {
+		return nil, err
+	}
+	if existing == nil {
+		return nil, nil
+	}
+
+	preview := &models.UpdatePreview{
+		ID:      id,
+		Changes: []models.FieldChange{},
+	}
+
+	for _, field := range changedFields(existing, req) {
+		preview.Changes = append(preview.Changes, models.FieldChange{
+			Field:  field.column,
+			Before: bookFieldValue(existing, field.column),
+			After:  field.value,
+		})
+	}
+
+	return preview, nil
+}
+
+// DeleteBook deletes a book by ID
+func DeleteBook(ctx context.Context, db *sql.DB, id int) error {
+	// Check if book exists
+	existing, err := GetBookByID(ctx, db, id)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		return sql.ErrNoRows
+	}
+
+	query := "DELETE FROM books WHERE id = ?"
+	_, err = db.ExecContext(ctx, query, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete book: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteImportBatch deletes, in one transaction, every book created by the
+// import with the given batch ID, and returns how many there were. The
+// books are locked first, so the count matches what was deleted even if
+// they are changed concurrently.
+func DeleteImportBatch(ctx context.Context, db *sql.DB, importBatchID string) (int, error) {
+	var deleted int
+	err := WithTx(ctx, db, func(tx *sql.Tx) error {
+		var err error
+		deleted, err = countLocked(ctx, tx, "SELECT id FROM books WHERE import_batch_id = ? FOR UPDATE", importBatchID)
+		if err != nil {
+			return fmt.Errorf("failed to lock import batch: %w", err)
+		}
+		if deleted == 0 {
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM books WHERE import_batch_id = ?", importBatchID); err != nil {
+			return fmt.Errorf("failed to delete import batch: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// searchCondition matches books whose title or author matches a LIKE pattern
+// built with containsPattern, which is bound to both placeholders. Both sides
+// are lower-cased because PostgreSQL's LIKE is case-sensitive; MySQL's
+// case-insensitive collation already ignores case.
+const searchCondition = `(LOWER(title) LIKE LOWER(?) ESCAPE '!' OR LOWER(author) LIKE LOWER(?) ESCAPE '!')`
+
+// likeEscaper escapes the LIKE wildcards and the escape character itself. The
+// escape character is ! rather than backslash, which MySQL and PostgreSQL
+// treat differently inside string literals.
+var likeEscaper = strings.NewReplacer(`!`, `!!`, `%`, `!%`, `_`, `!_`)
+
+// containsPattern returns a LIKE pattern matching values that contain s
+// literally. Queries using it must declare ! as the escape character.
+func containsPattern(s string) string {
+	return "%" + likeEscaper.Replace(s) + "%"
+}
+
+// likeScore is the relevance score of a LIKE search, weighting title
+// matches above author matches. Its placeholders take the same pattern as
+// searchCondition's.
+const likeScore = `(CASE WHEN LOWER(title) LIKE LOWER(?) ESCAPE '!' THEN 2 ELSE 0 END) + (CASE WHEN LOWER(author) LIKE LOWER(?) ESCAPE '!' THEN 1 ELSE 0 END)`
+
+// fullTextMinWordLength is the shortest word the full-text indexes hold,
+// InnoDB's default innodb_ft_min_token_size. Queries without a word this
+// long would match nothing, so they are searched with LIKE instead.
+const fullTextMinWordLength = 3
+
+// fullTextSearchEnabled searches with the full-text index instead of LIKE
+// where the query allows; set from SEARCH_FULLTEXT by InitDB
+var fullTextSearchEnabled bool
+
+// fullTextIndexMissing is set once a full-text search fails because the
+// server has no full-text index, e.g. while a migration adding it is being
+// rolled out. Searches then use LIKE until the service restarts.
+var fullTextIndexMissing atomic.Bool
+
+// retryWithoutFullText reports whether err is a full-text search failing for
+// want of the index, in which case the search should be run again and will
+// use LIKE. It warns the first time.
+func retryWithoutFullText(err error) bool {
+	if err == nil || !activeDialect.isMissingFullTextIndex(err) {
+		return false
+	}
+	if fullTextIndexMissing.CompareAndSwap(false, true) {
+		logrus.WithError(err).Warn("Full-text index not found, searching with LIKE instead")
+	}
+	return true
+}
+
+// bookSearch is the SQL matching and scoring books for a search query
+type bookSearch struct {
+	cond      string
+	condArgs  []interface{}
+	score     string
+	scoreArgs []interface{}
+	// relevance is set for full-text searches, scored by the index's
+	// relevance rather than by which column matched
+	relevance bool
+}
+
+// newBookSearch returns the search for a query: a full-text match ranked by
+// the index's relevance when enabled and the query has a long enough word,
+// otherwise a LIKE substring match on title or author
+func newBookSearch(query string) bookSearch {
+	if fullTextSearchEnabled && !fullTextIndexMissing.Load() && hasFullTextWord(query) {
+		cond, score := activeDialect.fullTextSearch()
+		return bookSearch{
+			cond:      cond,
+			condArgs:  []interface{}{query},
+			score:     score,
+			scoreArgs: []interface{}{query},
+			relevance: true,
+		}
+	}
+
+	pattern := containsPattern(query)
+	return bookSearch{
+		cond:      searchCondition,
+		condArgs:  []interface{}{pattern, pattern},
+		score:     likeScore,
+		scoreArgs: []interface{}{pattern, pattern},
+	}
+}
+
+// hasFullTextWord reports whether query has a word the full-text index can
+// match
+func hasFullTextWord(query string) bool {
+	for _, word := range strings.Fields(query) {
+		if utf8.RuneCountInString(word) >= fullTextMinWordLength {
+			return true
+		}
+	}
+	return false
+}
+
+// searchBooksQuery returns the paginated search query used by SearchBooks,
+// best matches first. Its arguments are those of searchBooksArgs.
+func searchBooksQuery(search bookSearch, extraConds []string) string {
+	conds := append([]string{search.cond}, extraConds...)
+
+	return `SELECT ` + bookColumns + `, 
+					` + search.score + ` AS score 
+					FROM books 
+					` + whereClause(conds) + `
+					ORDER BY score DESC, created_at DESC, id DESC
+					LIMIT ? OFFSET ?`
+}
+
+// searchBooksArgs returns the arguments for searchBooksQuery: the score's,
+// the search condition's, those of the extra conditions, then the limit and
+// offset
+func searchBooksArgs(search bookSearch, extraArgs []interface{}, limit, offset int) []interface{} {
+	args := append([]interface{}{}, search.scoreArgs...)
+	args = append(args, search.condArgs...)
+	args = append(args, extraArgs...)
+	return append(args, limit, offset)
+}
+
+// SearchBooks searches for books matching the filter by title or author, best
+// matches first. Each book's Score is set to its relevance score. When
+// countOnlyAbove is positive and more books match, only the total is returned.
+// When countTotal is false the total isn't counted, as in GetBooks, and
+// countOnlyAbove is ignored. For full-text searches, the counted total comes
+// with the highest relevance score of any matching book, or nil when none
+// match; other searches return a nil maxScore.
+func SearchBooks(ctx context.Context, db *sql.DB, query string, filter BookFilter, page, limit, countOnlyAbove int, countTotal bool) ([]models.Book, int, *float64, error) {
+	books, total, maxScore, err := searchBooks(ctx, db, query, filter, page, limit, countOnlyAbove, countTotal)
+	if retryWithoutFullText(err) {
+		return searchBooks(ctx, db, query, filter, page, limit, countOnlyAbove, countTotal)
+	}
+	return books, total, maxScore, err
+}
+
+func searchBooks(ctx context.Context, db *sql.DB, query string, filter BookFilter, page, limit, countOnlyAbove int, countTotal bool) (books []models.Book, total int, maxScore *float64, err error) {
+	search := newBookSearch(query)
+	conds, args := filter.conditions()
+
+	// Get total count
+	total = -1
+	fetch := limit + 1
+	if countTotal {
+		if search.relevance {
+			total, maxScore, err = countRelevance(ctx, db, search, conds, args)
+		} else {
+			total, err = countBooks(ctx, db, query, filter)
+		}
+		if err != nil {
+			return nil, 0, nil, err
+		}
+
+		if countOnlyAbove > 0 && total > countOnlyAbove {
+			return nil, total, maxScore, nil
+		}
+		fetch = limit
+	}
+
+	// Calculate offset
+	offset := (page - 1) * limit
+
+	// Get books with search and pagination
+	rows, err := db.QueryContext(ctx, searchBooksQuery(search, conds), searchBooksArgs(search, args, fetch, offset)...)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("failed to search books: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var score float64
+		book, err := scanBook(rows, &score)
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("failed to scan book: %w", err)
+		}
+		book.Score = &score
+		books = append(books, book)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, 0, nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+
+	return books, total, maxScore, nil
+}
+
+// countRelevance counts the books a full-text search matches along with the
+// highest relevance score among them, which is nil when none match
+func countRelevance(ctx context.Context, db *sql.DB, search bookSearch, extraConds []string, extraArgs []interface{}) (int, *float64, error) {
+	conds := append([]string{search.cond}, extraConds...)
+	args := append(append([]interface{}{}, search.scoreArgs...), search.condArgs...)
+	args = append(args, extraArgs...)
+
+	var total int
+	var maxScore sql.NullFloat64
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*), MAX("+search.score+") FROM books "+whereClause(conds), args...).
+		Scan(&total, &maxScore)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to get total count: %w", err)
+	}
+	if !maxScore.Valid {
+		return total, nil, nil
+	}
+	return total, &maxScore.Float64, nil
+}
+
+// GetYearCounts counts books per published year, optionally restricted to
+// books matching the filter and a title or author search
+func GetYearCounts(ctx context.Context, db *sql.DB, query string, filter BookFilter) ([]models.YearCount, error) {
+	years, err := getYearCounts(ctx, db, query, filter)
+	if retryWithoutFullText(err) {
+		return getYearCounts(ctx, db, query, filter)
+	}
+	return years, err
+}
+
+func getYearCounts(ctx context.Context, db *sql.DB, query string, filter BookFilter) ([]models.YearCount, error) {
+	conds, args := searchConditions(query, filter)
+	sqlQuery := "SELECT published_year, COUNT(*) FROM books " + whereClause(conds) +
+		" GROUP BY published_year ORDER BY published_year"
+
+	rows, err := db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query year counts: %w", err)
+	}
+	defer rows.Close()
+
+	years := []models.YearCount{}
+	for rows.Next() {
+		var yc models.YearCount
+		if err := rows.Scan(&yc.Year, &yc.Count); err != nil {
+			return nil, fmt.Errorf("failed to scan year count: %w", err)
+		}
+		years = append(years, yc)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+
+	return years, nil
+}
+
+// ErrFeaturedLimitReached is returned by SetFeatured when the maximum number
+// of featured books has been reached
+var ErrFeaturedLimitReached = errors.New("featured book limit reached")
+
+// featuredOrderColumns lists the columns featured books can be ordered by
+var featuredOrderColumns = map[string]bool{
+	"title":          true,
+	"author":         true,
+	"published_year": true,
+	"created_at":     true,
+	"updated_at":     true,
+}
+
+// IsFeaturedOrderColumn reports whether featured books can be ordered by column
+func IsFeaturedOrderColumn(column string) bool {
+	return featuredOrderColumns[column]
+}
+
+// GetFeaturedBooks retrieves all featured books ordered by the given column
+func GetFeaturedBooks(ctx context.Context, db *sql.DB, orderBy string, descending bool) ([]models.Book, error) {
+	if !IsFeaturedOrderColumn(orderBy) {
+		return nil, fmt.Errorf("invalid featured order column %q", orderBy)
+	}
+
+	direction := "ASC"
+	if descending {
+		direction = "DESC"
+	}
+
+	// The order column is whitelisted above, so it is safe to interpolate
+	query := fmt.Sprintf(`SELECT %s 
+			  FROM books 
+			  WHERE featured = TRUE
+			  ORDER BY %s %s, id %s`, bookColumns, orderBy, direction, direction)
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query featured books: %w", err)
+	}
+	defer rows.Close()
+
+	return scanBooks(rows)
+}
+
+// SetFeatured features or unfeatures a book. When featuring and maxFeatured is
+// positive, it fails with ErrFeaturedLimitReached if that many other books are
+// already featured. Returns nil if the book doesn't exist.
+func SetFeatured(ctx context.Context, db *sql.DB, id int, featured bool, maxFeatured int) (*models.Book, error) {
+	var book *models.Book
+	err := WithTx(ctx, db, func(tx *sql.Tx) error {
+		var current bool
+		err := tx.QueryRowContext(ctx, "SELECT featured FROM books WHERE id = ? FOR UPDATE", id).Scan(&current)
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get book: %w", err)
+		}
+
+		if current != featured {
+			if featured && maxFeatured > 0 {
+				// Lock the featured rows so concurrent requests can't exceed the cap
+				count, err := countLocked(ctx, tx, "SELECT id FROM books WHERE featured = TRUE FOR UPDATE")
+				if err != nil {
+					return fmt.Errorf("failed to count featured books: %w", err)
+				}
+				if count >= maxFeatured {
+					return ErrFeaturedLimitReached
+				}
+			}
+
+			if _, err := tx.ExecContext(ctx, "UPDATE books SET featured = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?", featured, id); err != nil {
+				return fmt.Errorf("failed to update featured flag: %w", err)
+			}
+		}
+
+		book, err = getBookByID(ctx, tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return book, nil
+}
+
+// GetEditions retrieves the other books sharing a book's title and author,
+// ignoring case and surrounding whitespace, ordered by published year
+func GetEditions(ctx context.Context, db *sql.DB, book *models.Book) ([]models.Book, error) {
+	query := `SELECT ` + bookColumns + ` 
+			  FROM books 
+			  WHERE LOWER(TRIM(title)) = LOWER(TRIM(?)) 
+			  AND LOWER(TRIM(author)) = LOWER(TRIM(?)) 
+			  AND id <> ?
+			  ORDER BY published_year ASC, id ASC`
+
+	rows, err := db.QueryContext(ctx, query, book.Title, book.Author, book.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query editions: %w", err)
+	}
+	defer rows.Close()
+
+	return scanBooks(rows)
+}
+
+// GetAvailabilityChanges retrieves books whose availability changed after
+// the given time, oldest change first
+func GetAvailabilityChanges(ctx context.Context, db *sql.DB, since time.Time, page, limit int) ([]models.Book, int, error) {
+	// Get total count
+	var total int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM books WHERE availability_changed_at > ?", since).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get total count: %w", err)
+	}
+
+	// Calculate offset
+	offset := (page - 1) * limit
+
+	query := `SELECT ` + bookColumns + ` 
+			  FROM books 
+			  WHERE availability_changed_at > ?
+			  ORDER BY availability_changed_at ASC, id ASC
+			  LIMIT ? OFFSET ?`
+
+	rows, err := db.QueryContext(ctx, query, since, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query availability changes: %w", err)
+	}
+	defer rows.Close()
+
+	books, err := scanBooks(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return books, total, nil
+}
+
+// GetStaleBooks retrieves books not accessed since the given time, including
+// books never accessed at all, least recently accessed first
+func GetStaleBooks(ctx context.Context, db *sql.DB, before time.Time, page, limit int) ([]models.Book, int, error) {
+	// Get total count
+	var total int
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM books WHERE last_accessed_at IS NULL OR last_accessed_at < ?",
+		before).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get total count: %w", err)
+	}
+
+	// Calculate offset
+	offset := (page - 1) * limit
+
+	// Never-accessed books lead the list. The servers disagree on where NULLs
+	// sort, so they are ordered explicitly.
+	query := `SELECT ` + bookColumns + ` 
+			  FROM books 
+			  WHERE last_accessed_at IS NULL OR last_accessed_at < ?
+			  ORDER BY last_accessed_at IS NOT NULL, last_accessed_at ASC, id ASC
+			  LIMIT ? OFFSET ?`
+
+	rows, err := db.QueryContext(ctx, query, before, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query stale books: %w", err)
+	}
+	defer rows.Close()
+
+	books, err := scanBooks(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return books, total, nil
+}
+
+// ForEachBook calls fn for every book matching the filter in ID order,
+// streaming rows rather than loading the whole catalog. Iteration stops at
+// the first error fn returns.
+func ForEachBook(ctx context.Context, db *sql.DB, filter BookFilter, fn func(models.Book) error) error {
+	conds, args := filter.conditions()
+	query := `SELECT ` + bookColumns + ` FROM books`
+	if where := whereClause(conds); where != "" {
+		query += " " + where
+	}
+
+	rows, err := db.QueryContext(ctx, query+" ORDER BY id", args...)
+	if err != nil {
+		return fmt.Errorf("failed to query books: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		book, err := scanBook(rows)
+		if err != nil {
+			return fmt.Errorf("failed to scan book: %w", err)
+		}
+		if err := fn(book); err != nil {
+			return err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("error iterating over rows: %w", err)
+	}
+
+	return nil
+}
+
+// StreamBooks calls fn for each book on the requested page as its row is read,
+// without counting the total. With a search query the books are those
+// SearchBooks would return, with Score set; otherwise those GetBooks would
+// return. Iteration stops at the first error fn returns.
+func StreamBooks(ctx context.Context, db *sql.DB, query string, filter BookFilter, sortBy string, descending bool, collation string, page, limit int, fn func(models.Book) error) error {
+	// A missing index fails the query before any row reaches fn, so it is
+	// safe to run again
+	err := streamBooks(ctx, db, query, filter, sortBy, descending, collation, page, limit, fn)
+	if retryWithoutFullText(err) {
+		return streamBooks(ctx, db, query, filter, sortBy, descending, collation, page, limit, fn)
+	}
+	return err
+}
+
+func streamBooks(ctx context.Context, db *sql.DB, query string, filter BookFilter, sortBy string, descending bool, collation string, page, limit int, fn func(models.Book) error) error {
+	conds, args := filter.conditions()
+	offset := (page - 1) * limit
+
+	var rows *sql.Rows
+	var err error
+	if query != "" {
+		search := newBookSearch(query)
+		rows, err = db.QueryContext(ctx, searchBooksQuery(search, conds), searchBooksArgs(search, args, limit, offset)...)
+	} else {
+		if !IsBookSortColumn(sortBy) {
+			return fmt.Errorf("invalid sort column %q", sortBy)
+		}
+		if collation != "" && !IsSortCollation(collation) {
+			return fmt.Errorf("invalid sort collation %q", collation)
+		}
+		rows, err = db.QueryContext(ctx, listBooksQuery(whereClause(conds), sortBy, descending, collation), append(args, limit, offset)...)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query books: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var book models.Book
+		if query != "" {
+			var score float64
+			book, err = scanBook(rows, &score)
+			book.Score = &score
+		} else {
+			book, err = scanBook(rows)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to scan book: %w", err)
+		}
+		if err := fn(book); err != nil {
+			return err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("error iterating over rows: %w", err)
+	}
+
+	return nil
+}
+
+// GetCatalogHealth computes data-quality counts across the catalog. Books
+// published outside [minYear, maxYear] are counted as out of range, and books
+// with a NULL or empty ISBN as missing one.
+func GetCatalogHealth(ctx context.Context, db *sql.DB, minYear, maxYear int) (*models.CatalogHealthReport, error) {
+	var report models.CatalogHealthReport
+
+	// SUM is NULL over an empty table
+	err := db.QueryRowContext(ctx, "SELECT COUNT(*), COALESCE(SUM(isbn IS NULL OR isbn = ''), 0) FROM books").
+		Scan(&report.TotalBooks, &report.MissingISBN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count books: %w", err)
+	}
+
+	err = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM (
+			SELECT 1 FROM books 
+			GROUP BY LOWER(TRIM(title)), LOWER(TRIM(author)) 
+			HAVING COUNT(*) > 1
+		) duplicates`).Scan(&report.DuplicateTitleAuthorGroups)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count duplicate groups: %w", err)
+	}
+
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM books WHERE published_year < ? OR published_year > ?",
+		minYear, maxYear).Scan(&report.OutOfRangeYears)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count out-of-range years: %w", err)
+	}
+
+	return &report, nil
+}
+
+// matrixDimensions lists the columns books can be grouped by in CountMatrix
+var matrixDimensions = map[string]bool{
+	"author":         true,
+	"genre":          true,
+	"available":      true,
+	"published_year": true,
+}
+
+// IsMatrixDimension reports whether a column can be used as a CountMatrix
+// dimension
+func IsMatrixDimension(column string) bool {
+	return matrixDimensions[column]
+}
+
+// CountMatrix counts books grouped by two columns, keyed by row value then
+// column value
+func CountMatrix(ctx context.Context, db *sql.DB, rowColumn, colColumn string) (map[string]map[string]int, error) {
+	if !IsMatrixDimension(rowColumn) || !IsMatrixDimension(colColumn) {
+		return nil, fmt.Errorf("invalid matrix dimensions %q and %q", rowColumn, colColumn)
+	}
+
+	// Column names are whitelisted above, so they are safe to interpolate
+	query := fmt.Sprintf("SELECT %[1]s, %[2]s, COUNT(*) FROM books GROUP BY %[1]s, %[2]s",
+		rowColumn, colColumn)
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query book matrix: %w", err)
+	}
+	defer rows.Close()
+
+	matrix := make(map[string]map[string]int)
+	for rows.Next() {
+		var rowValue, colValue sql.NullString
+		var count int
+		if err := rows.Scan(&rowValue, &colValue, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan book matrix: %w", err)
+		}
+
+		rowKey := matrixKey(rowColumn, rowValue)
+		if matrix[rowKey] == nil {
+			matrix[rowKey] = make(map[string]int)
+		}
+		matrix[rowKey][matrixKey(colColumn, colValue)] = count
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %w", err)
+	}
+
+	return matrix, nil
+}
+
+// matrixKey formats a grouped column value as a map key
+func matrixKey(column string, value sql.NullString) string {
+	if !value.Valid {
+		return "null"
+	}
+	if column == "available" {
+		// MySQL returns 1 or 0 and PostgreSQL true or false
+		available, _ := strconv.ParseBool(value.String)
+		return strconv.FormatBool(available)
+	}
+	return value.String
 }
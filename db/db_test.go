@@ -0,0 +1,746 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"library-api/models"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+var ctx = context.Background()
+
+func TestMain(m *testing.M) {
+	logrus.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// newMock returns a database whose queries are answered by the returned
+// mock, checking on cleanup that every expected query ran
+func newMock(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
+	t.Helper()
+	database, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		database.Close()
+	})
+	return database, mock
+}
+
+// bookRow returns the values of a book in bookColumns order
+func bookRow(b models.Book) []driver.Value {
+	values := bookValues(b)
+	row := make([]driver.Value, len(values))
+	for i, v := range values {
+		row[i] = v
+	}
+	return row
+}
+
+// bookRows returns mock rows holding books in bookColumns order
+func bookRows(books ...models.Book) *sqlmock.Rows {
+	rows := sqlmock.NewRows(strings.Split(bookColumns, ", "))
+	for _, b := range books {
+		rows.AddRow(bookRow(b)...)
+	}
+	return rows
+}
+
+// scoredRows returns mock rows holding books followed by their search score
+func scoredRows(score float64, books ...models.Book) *sqlmock.Rows {
+	rows := sqlmock.NewRows(append(strings.Split(bookColumns, ", "), "score"))
+	for _, b := range books {
+		rows.AddRow(append(bookRow(b), score)...)
+	}
+	return rows
+}
+
+func TestPagingBooksWithEqualTimestamps(t *testing.T) {
+	// Five books created in the same bulk insert, in the order a query
+	// breaking created_at ties by ID returns them
+	created := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+	var all []models.Book
+	for id := 5; id >= 1; id-- {
+		all = append(all, models.Book{ID: id, Title: "Book", Author: "Author", PublishedYear: 2000, CreatedAt: created, UpdatedAt: created})
+	}
+	const limit = 2
+
+	tests := []struct {
+		name  string
+		args  []driver.Value
+		rows  func(books ...models.Book) *sqlmock.Rows
+		fetch func(database *sql.DB, page int) ([]models.Book, int, error)
+	}{
+		{"list", nil, bookRows, func(database *sql.DB, page int) ([]models.Book, int, error) {
+			return GetBooks(ctx, database, BookFilter{}, "created_at", true, "", page, limit, true)
+		}},
+		{"search", []driver.Value{"%Book%", "%Book%", "%Book%", "%Book%"}, func(books ...models.Book) *sqlmock.Rows {
+			return scoredRows(2, books...)
+		}, func(database *sql.DB, page int) ([]models.Book, int, error) {
+			books, total, _, err := SearchBooks(ctx, database, "Book", BookFilter{}, page, limit, 0, true)
+			return books, total, err
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database, mock := newMock(t)
+			for offset := 0; offset < len(all); offset += limit {
+				mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM books")).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(len(all)))
+				mock.ExpectQuery(regexp.QuoteMeta("created_at DESC, id DESC LIMIT ? OFFSET ?")).
+					WithArgs(append(tt.args, limit, offset)...).
+					WillReturnRows(tt.rows(all[offset:min(offset+limit, len(all))]...))
+			}
+
+			seen := make(map[int]bool)
+			for page := 1; (page-1)*limit < len(all); page++ {
+				books, _, err := tt.fetch(database, page)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, book := range books {
+					if seen[book.ID] {
+						t.Errorf("book %d returned on more than one page", book.ID)
+					}
+					seen[book.ID] = true
+				}
+			}
+			if len(seen) != len(all) {
+				t.Errorf("paged through %d books, want %d", len(seen), len(all))
+			}
+		})
+	}
+}
+
+// testBook is a stored book for the db tests
+func testBook() models.Book {
+	created := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+	return models.Book{ID: 1, Title: "Dune", Author: "Frank Herbert", PublishedYear: 1965, Available: true, CreatedAt: created, UpdatedAt: created}
+}
+
+func TestUpdateBookWritesOnlyChangedColumns(t *testing.T) {
+	title, storedYear, year, available := "Dune", 1965, 1966, false
+	newTitle, newAuthor := "Children of Dune", "F. Herbert"
+
+	tests := []struct {
+		name   string
+		req    models.UpdateBookRequest
+		update string // expected UPDATE, empty when nothing may be written
+		args   []driver.Value
+	}{
+		{
+			name: "no fields",
+		},
+		{
+			name: "stored values",
+			req:  models.UpdateBookRequest{Title: &title, PublishedYear: &storedYear},
+		},
+		{
+			name:   "one value differs",
+			req:    models.UpdateBookRequest{Title: &title, PublishedYear: &year},
+			update: "UPDATE books SET published_year = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+			args:   []driver.Value{1966, 1},
+		},
+		{
+			name:   "two values differ",
+			req:    models.UpdateBookRequest{Title: &newTitle, Author: &newAuthor},
+			update: "UPDATE books SET title = ?, author = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+			args:   []driver.Value{"Children of Dune", "F. Herbert", 1},
+		},
+		{
+			name:   "availability flips",
+			req:    models.UpdateBookRequest{Available: &available},
+			update: "UPDATE books SET available = ?, availability_changed_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+			args:   []driver.Value{false, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database, mock := newMock(t)
+			mock.ExpectBegin()
+			mock.ExpectQuery(regexp.QuoteMeta("FROM books WHERE id = ? FOR UPDATE")).WithArgs(1).WillReturnRows(bookRows(testBook()))
+			if tt.update != "" {
+				mock.ExpectExec("^" + regexp.QuoteMeta(tt.update) + "$").
+					WithArgs(tt.args...).
+					WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectQuery(regexp.QuoteMeta("FROM books WHERE id = ?")).WithArgs(1).WillReturnRows(bookRows(testBook()))
+			}
+			mock.ExpectCommit()
+
+			_, changed, err := UpdateBook(ctx, database, 1, tt.req, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := tt.update != ""; changed != want {
+				t.Errorf("changed = %v, want %v", changed, want)
+			}
+		})
+	}
+}
+
+func TestListBooksQueryOrder(t *testing.T) {
+	tests := []struct {
+		sortBy     string
+		descending bool
+		collation  string
+		want       string
+	}{
+		{"created_at", true, "", "ORDER BY created_at DESC, id DESC"},
+		{"title", false, "", "ORDER BY title ASC, id ASC"},
+		{"published_year", true, "", "ORDER BY published_year DESC, id DESC"},
+		{"id", false, "", "ORDER BY id ASC\n"},
+		{"completeness", false, "", "ORDER BY ((CASE WHEN isbn IS NULL OR isbn = '' THEN 0 ELSE 1 END) + (CASE WHEN genre IS NULL OR genre = '' THEN 0 ELSE 1 END)) ASC, id ASC"},
+		{"title", false, "utf8mb4_da_0900_ai_ci", "ORDER BY title COLLATE utf8mb4_da_0900_ai_ci ASC, id ASC"},
+		{"author", true, "utf8mb4_sv_0900_ai_ci", "ORDER BY author COLLATE utf8mb4_sv_0900_ai_ci DESC, id DESC"},
+		{"published_year", true, "utf8mb4_da_0900_ai_ci", "ORDER BY published_year DESC, id DESC"},
+	}
+
+	for _, tt := range tests {
+		if got := listBooksQuery("", tt.sortBy, tt.descending, tt.collation); !strings.Contains(got, tt.want) {
+			t.Errorf("sort by %s descending %v collation %q: %q doesn't contain %q", tt.sortBy, tt.descending, tt.collation, got, tt.want)
+		}
+	}
+}
+
+func TestGetBooksRejectsUnknownSortColumn(t *testing.T) {
+	// No query is expected, so one reaching the database fails the test
+	database, _ := newMock(t)
+
+	if _, _, err := GetBooks(ctx, database, BookFilter{}, "title; DROP TABLE books", true, "", 1, 10, true); err == nil {
+		t.Error("unknown sort column was accepted")
+	}
+}
+
+// likeMatches reports whether value matches a LIKE pattern escaped with !,
+// the way the search condition evaluates it
+func likeMatches(pattern, value string) bool {
+	var expr strings.Builder
+	expr.WriteString("(?is)^")
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '!':
+			escaped = true
+		case r == '%':
+			expr.WriteString(".*")
+		case r == '_':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String()).MatchString(value)
+}
+
+func TestContainsPatternMatchesLiterally(t *testing.T) {
+	titles := []string{"100% Pure", "1000 Years", "100 Days", "file_name", "filename", `C:\Temp`, "Hello!", "Hello"}
+
+	tests := []struct {
+		query   string
+		pattern string
+		want    []string
+	}{
+		{"100%", `%100!%%`, []string{"100% Pure"}},
+		{"50%", `%50!%%`, nil},
+		{"file_name", `%file!_name%`, []string{"file_name"}},
+		{`C:\`, `%C:\%`, []string{`C:\Temp`}},
+		{"Hello!", `%Hello!!%`, []string{"Hello!"}},
+		{"100", `%100%`, []string{"100% Pure", "1000 Years", "100 Days"}},
+	}
+
+	for _, tt := range tests {
+		pattern := containsPattern(tt.query)
+		if pattern != tt.pattern {
+			t.Errorf("containsPattern(%q) = %q, want %q", tt.query, pattern, tt.pattern)
+		}
+
+		var got []string
+		for _, title := range titles {
+			if likeMatches(pattern, title) {
+				got = append(got, title)
+			}
+		}
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("%q matched %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestCreateBookInsertErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		duplicate bool
+	}{
+		{"duplicate entry", &mysql.MySQLError{Number: 1062, Message: "Duplicate entry '9780306406157' for key 'idx_books_isbn'"}, true},
+		{"data too long", &mysql.MySQLError{Number: 1406, Message: "Data too long for column 'title'"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database, mock := newMock(t)
+			mock.ExpectBegin()
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO books")).WillReturnError(tt.err)
+			mock.ExpectRollback()
+
+			req := models.CreateBookRequest{Title: "Dune", Author: "Frank Herbert", ISBN: "9780306406157", PublishedYear: 1965}
+			_, err := CreateBook(ctx, database, req, 0)
+			if err == nil {
+				t.Fatal("insert error was swallowed")
+			}
+			if duplicate := err == ErrDuplicate; duplicate != tt.duplicate {
+				t.Errorf("err = %v, duplicate %v, want %v", err, duplicate, tt.duplicate)
+			}
+		})
+	}
+}
+
+func TestCreateBooksRollsBack(t *testing.T) {
+	tests := []struct {
+		name      string
+		insertErr error
+		readErr   error
+	}{
+		{name: "insert fails", insertErr: &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}},
+		{name: "read back fails", readErr: sql.ErrConnDone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database, mock := newMock(t)
+			mock.ExpectBegin()
+			insert := mock.ExpectExec(regexp.QuoteMeta("VALUES (?, ?, ?, ?, ?, ?, ?), (?, ?, ?, ?, ?, ?, ?)"))
+			if tt.insertErr != nil {
+				insert.WillReturnError(tt.insertErr)
+			} else {
+				insert.WillReturnResult(sqlmock.NewResult(7, 2))
+				mock.ExpectQuery(regexp.QuoteMeta("FROM books WHERE id IN (?, ?)")).
+					WithArgs(int64(7), int64(8)).
+					WillReturnError(tt.readErr)
+			}
+			mock.ExpectRollback()
+
+			reqs := []models.CreateBookRequest{
+				{Title: "Dune", Author: "Frank Herbert", PublishedYear: 1965},
+				{Title: "Dune Messiah", Author: "Frank Herbert", PublishedYear: 1969},
+			}
+			if _, err := CreateBooks(ctx, database, reqs, 0); err == nil {
+				t.Error("CreateBooks succeeded")
+			}
+		})
+	}
+}
+
+func TestUpsertBooks(t *testing.T) {
+	database, mock := newMock(t)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("(title, author, isbn, genre, published_year, available, import_batch_id) \n\t\t\t  VALUES (?, ?, ?, ?, ?, ?, ?)")).
+		WithArgs("Emma", "Jane Austen", nil, nil, 1815, true, "0b5e5bd6-7f5b-4c5e-9f7a-2f3c1d7c9a10").
+		WillReturnResult(sqlmock.NewResult(9, 1))
+	mock.ExpectExec(regexp.QuoteMeta("(id, title, author, isbn, genre, published_year, available) \n\t\t\t  VALUES (?, ?, ?, ?, ?, ?, ?), (?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE")).
+		WithArgs(3, "Dune", "Frank Herbert", "9780306406157", nil, 1965, true, 5, "Persuasion", "Jane Austen", nil, nil, 1817, false).
+		WillReturnResult(sqlmock.NewResult(0, 4))
+	mock.ExpectCommit()
+
+	unavailable := false
+	reqs := []models.CreateBookRequest{
+		{Title: "Dune", Author: "Frank Herbert", ISBN: "9780306406157", PublishedYear: 1965},
+		{Title: "Emma", Author: "Jane Austen", PublishedYear: 1815},
+		{Title: "Persuasion", Author: "Jane Austen", PublishedYear: 1817, Available: &unavailable},
+	}
+	created, updated, err := UpsertBooks(ctx, database, reqs, []int{3, 0, 5}, "0b5e5bd6-7f5b-4c5e-9f7a-2f3c1d7c9a10", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created != 1 || updated != 2 {
+		t.Errorf("created %d and updated %d, want 1 and 2", created, updated)
+	}
+}
+
+func TestForEachBookFilter(t *testing.T) {
+	yearMin, available := 1960, true
+
+	tests := []struct {
+		name   string
+		filter BookFilter
+		where  string
+		args   []driver.Value
+	}{
+		{name: "whole catalog", where: "FROM books ORDER BY id"},
+		{
+			name:   "filtered",
+			filter: BookFilter{Author: "herbert", YearMin: &yearMin, Available: &available, Genre: "fiction"},
+			where:  "FROM books WHERE genre = ? AND LOWER(author) LIKE LOWER(?) ESCAPE '!' AND available = ? AND published_year >= ? ORDER BY id",
+			args:   []driver.Value{"fiction", "%herbert%", true, 1960},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database, mock := newMock(t)
+			mock.ExpectQuery(regexp.QuoteMeta(tt.where) + "$").
+				WithArgs(tt.args...).
+				WillReturnRows(bookRows(testBook()))
+
+			var ids []int
+			err := ForEachBook(ctx, database, tt.filter, func(book models.Book) error {
+				ids = append(ids, book.ID)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ids) != 1 {
+				t.Errorf("fn saw books %v, want the one returned", ids)
+			}
+		})
+	}
+}
+
+func TestDeleteImportBatch(t *testing.T) {
+	const batchID = "0b5e5bd6-7f5b-4c5e-9f7a-2f3c1d7c9a10"
+
+	tests := []struct {
+		name    string
+		ids     []int // books the batch created
+		deleted bool  // whether the DELETE runs
+	}{
+		{name: "batch", ids: []int{4, 5}, deleted: true},
+		{name: "unknown batch"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database, mock := newMock(t)
+			rows := sqlmock.NewRows([]string{"id"})
+			for _, id := range tt.ids {
+				rows.AddRow(id)
+			}
+			mock.ExpectBegin()
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT id FROM books WHERE import_batch_id = ? FOR UPDATE")).
+				WithArgs(batchID).
+				WillReturnRows(rows)
+			if tt.deleted {
+				mock.ExpectExec(regexp.QuoteMeta("DELETE FROM books WHERE import_batch_id = ?")).
+					WithArgs(batchID).
+					WillReturnResult(sqlmock.NewResult(0, int64(len(tt.ids))))
+			}
+			mock.ExpectCommit()
+
+			deleted, err := DeleteImportBatch(ctx, database, batchID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deleted != len(tt.ids) {
+				t.Errorf("deleted %d books, want %d", deleted, len(tt.ids))
+			}
+		})
+	}
+}
+
+// withFullTextSearch sets whether searches use the full-text index for the
+// rest of the test
+func withFullTextSearch(t *testing.T, enabled bool) {
+	previous := fullTextSearchEnabled
+	fullTextSearchEnabled = enabled
+	t.Cleanup(func() { fullTextSearchEnabled = previous })
+}
+
+func TestNewBookSearch(t *testing.T) {
+	match, _ := activeDialect.fullTextSearch()
+
+	tests := []struct {
+		fullText bool // SEARCH_FULLTEXT
+		query    string
+		cond     string
+		args     string
+	}{
+		{false, "dune messiah", searchCondition, "[%dune messiah% %dune messiah%]"},
+		{true, "dune messiah", match, "[dune messiah]"},
+		{true, "le guin", match, "[le guin]"},
+		{true, "go", searchCondition, "[%go% %go%]"},
+		{true, "a b c", searchCondition, "[%a b c% %a b c%]"},
+	}
+
+	for _, tt := range tests {
+		withFullTextSearch(t, tt.fullText)
+		search := newBookSearch(tt.query)
+		if search.cond != tt.cond || fmt.Sprint(search.condArgs) != tt.args {
+			t.Errorf("full-text %v, %q: %s %v, want %s %s", tt.fullText, tt.query, search.cond, search.condArgs, tt.cond, tt.args)
+		}
+	}
+}
+
+func TestSearchBooksFullText(t *testing.T) {
+	withFullTextSearch(t, true)
+	database, mock := newMock(t)
+
+	exact, partial := testBook(), testBook()
+	partial.ID, partial.Title = 2, "Dune Messiah"
+	rows := sqlmock.NewRows(append(strings.Split(bookColumns, ", "), "score")).
+		AddRow(append(bookRow(exact), 3.5)...).
+		AddRow(append(bookRow(partial), 1.25)...)
+
+	// Relevance orders the results, and the raw query is bound to both the
+	// score and the match
+	mock.ExpectQuery(regexp.QuoteMeta("MATCH(title, author) AGAINST (? IN NATURAL LANGUAGE MODE) AS score")+
+		".*"+regexp.QuoteMeta("ORDER BY score DESC, created_at DESC, id DESC")).
+		WithArgs("dune", "dune", 11, 0).
+		WillReturnRows(rows)
+
+	books, _, _, err := SearchBooks(ctx, database, "dune", BookFilter{}, 1, 10, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, book := range books {
+		got = append(got, fmt.Sprintf("%d:%v", book.ID, *book.Score))
+	}
+	if fmt.Sprint(got) != "[1:3.5 2:1.25]" {
+		t.Errorf("books with scores %v, want [1:3.5 2:1.25]", got)
+	}
+}
+
+func TestSearchBooksRelevanceTotal(t *testing.T) {
+	match, _ := activeDialect.fullTextSearch()
+
+	tests := []struct {
+		name     string
+		fullText bool // SEARCH_FULLTEXT
+		count    string
+		args     []driver.Value
+		total    int
+		maxScore driver.Value // the count query's MAX, or nil without one
+		want     string
+	}{
+		{"relevance", true, "SELECT COUNT(*), MAX(" + match + ") FROM books WHERE " + match, []driver.Value{"dune", "dune"}, 2, 3.5, "2 3.5"},
+		{"relevance, no matches", true, "SELECT COUNT(*), MAX(" + match + ") FROM books WHERE " + match, []driver.Value{"dune", "dune"}, 0, nil, "0 <nil>"},
+		{"substring", false, "SELECT COUNT(*) FROM books WHERE " + searchCondition, []driver.Value{"%dune%", "%dune%"}, 2, nil, "2 <nil>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFullTextSearch(t, tt.fullText)
+			database, mock := newMock(t)
+
+			columns := []string{"COUNT(*)"}
+			values := []driver.Value{tt.total}
+			if tt.fullText {
+				columns, values = append(columns, "MAX(score)"), append(values, tt.maxScore)
+			}
+			mock.ExpectQuery("^" + regexp.QuoteMeta(tt.count) + "$").
+				WithArgs(tt.args...).
+				WillReturnRows(sqlmock.NewRows(columns).AddRow(values...))
+			mock.ExpectQuery(regexp.QuoteMeta("LIMIT ? OFFSET ?")).
+				WillReturnRows(scoredRows(1))
+
+			_, total, maxScore, err := SearchBooks(ctx, database, "dune", BookFilter{}, 1, 10, 0, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := fmt.Sprint(total, " <nil>")
+			if maxScore != nil {
+				got = fmt.Sprint(total, " ", *maxScore)
+			}
+			if got != tt.want {
+				t.Errorf("total and max score = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchWithoutFullTextIndex(t *testing.T) {
+	missingIndex := &mysql.MySQLError{Number: 1191, Message: "Can't find FULLTEXT index matching the column list"}
+	like := regexp.QuoteMeta(searchCondition)
+
+	tests := []struct {
+		name   string
+		result *sqlmock.Rows // of the LIKE query
+		search func(database *sql.DB) error
+	}{
+		{"list", scoredRows(1, testBook()), func(database *sql.DB) error {
+			_, _, _, err := SearchBooks(ctx, database, "dune", BookFilter{}, 1, 10, 0, false)
+			return err
+		}},
+		{"count", sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(1), func(database *sql.DB) error {
+			_, err := CountBooks(ctx, database, "dune", BookFilter{})
+			return err
+		}},
+		{"year counts", sqlmock.NewRows([]string{"published_year", "COUNT(*)"}).AddRow(1965, 1), func(database *sql.DB) error {
+			_, err := GetYearCounts(ctx, database, "dune", BookFilter{})
+			return err
+		}},
+		{"stream", scoredRows(1, testBook()), func(database *sql.DB) error {
+			return StreamBooks(ctx, database, "dune", BookFilter{}, "", false, "", 1, 10, func(models.Book) error { return nil })
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFullTextSearch(t, true)
+			t.Cleanup(func() { fullTextIndexMissing.Store(false) })
+			database, mock := newMock(t)
+
+			// The first search fails for want of the index and is run again
+			// with LIKE, as is every later one
+			mock.ExpectQuery(regexp.QuoteMeta("MATCH(title, author)")).WillReturnError(missingIndex)
+			mock.ExpectQuery(like).WillReturnRows(tt.result)
+			if err := tt.search(database); err != nil {
+				t.Fatal(err)
+			}
+
+			mock.ExpectQuery(like).WillReturnError(sql.ErrConnDone)
+			if err := tt.search(database); !errors.Is(err, sql.ErrConnDone) {
+				t.Errorf("later search: %v, want the LIKE query's error", err)
+			}
+		})
+	}
+}
+
+func TestCountBooks(t *testing.T) {
+	available := true
+	year := 1990
+
+	tests := []struct {
+		name   string
+		query  string
+		filter BookFilter
+		sql    string
+		args   []driver.Value
+	}{
+		{"no filters", "", BookFilter{}, "SELECT COUNT(*) FROM books", nil},
+		{
+			"filters",
+			"",
+			BookFilter{Available: &available, YearMin: &year},
+			"SELECT COUNT(*) FROM books WHERE available = ? AND published_year >= ?",
+			[]driver.Value{true, 1990},
+		},
+		{
+			"search and filters",
+			"dune",
+			BookFilter{Genre: "fiction"},
+			"SELECT COUNT(*) FROM books WHERE " + searchCondition + " AND genre = ?",
+			[]driver.Value{"%dune%", "%dune%", "fiction"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database, mock := newMock(t)
+			expect := mock.ExpectQuery("^" + regexp.QuoteMeta(tt.sql) + "$")
+			if tt.args != nil {
+				expect.WithArgs(tt.args...)
+			} else {
+				expect.WithoutArgs()
+			}
+			expect.WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(42))
+
+			count, err := CountBooks(ctx, database, tt.query, tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != 42 {
+				t.Errorf("count = %d, want 42", count)
+			}
+		})
+	}
+}
+
+// idBetween matches an ID argument within an inclusive range
+type idBetween struct{ min, max int64 }
+
+func (r idBetween) Match(v driver.Value) bool {
+	id, ok := v.(int64)
+	return ok && id >= r.min && id <= r.max
+}
+
+func TestGetRandomBook(t *testing.T) {
+	available := true
+	book := testBook()
+	book.ID = 7
+
+	tests := []struct {
+		name     string
+		min, max driver.Value // the IDs of the matching books
+		want     *models.Book
+	}{
+		{"picks within the ID range", int64(3), int64(9), &book},
+		{"no match", nil, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database, mock := newMock(t)
+			mock.ExpectQuery("^" + regexp.QuoteMeta("SELECT MIN(id), MAX(id) FROM books WHERE available = ?") + "$").
+				WithArgs(true).
+				WillReturnRows(sqlmock.NewRows([]string{"MIN(id)", "MAX(id)"}).AddRow(tt.min, tt.max))
+			if tt.want != nil {
+				mock.ExpectQuery(regexp.QuoteMeta("FROM books WHERE available = ? AND id >= ? ORDER BY id LIMIT 1")).
+					WithArgs(true, idBetween{tt.min.(int64), tt.max.(int64)}).
+					WillReturnRows(bookRows(*tt.want))
+			}
+
+			got, err := GetRandomBook(ctx, database, BookFilter{Available: &available})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == nil) != (tt.want == nil) || (got != nil && got.ID != tt.want.ID) {
+				t.Errorf("book = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetCatalogHealth(t *testing.T) {
+	tests := []struct {
+		name string
+		want models.CatalogHealthReport
+	}{
+		{"empty catalog", models.CatalogHealthReport{}},
+		{"catalog", models.CatalogHealthReport{TotalBooks: 10, MissingISBN: 3, DuplicateTitleAuthorGroups: 1, OutOfRangeYears: 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database, mock := newMock(t)
+			mock.ExpectQuery("^" + regexp.QuoteMeta("SELECT COUNT(*), COALESCE(SUM(isbn IS NULL OR isbn = ''), 0) FROM books") + "$").
+				WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)", "missing"}).AddRow(tt.want.TotalBooks, tt.want.MissingISBN))
+			mock.ExpectQuery(regexp.QuoteMeta("HAVING COUNT(*) > 1")).
+				WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(tt.want.DuplicateTitleAuthorGroups))
+			mock.ExpectQuery(regexp.QuoteMeta("WHERE published_year < ? OR published_year > ?")).
+				WithArgs(1000, 2100).
+				WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(tt.want.OutOfRangeYears))
+
+			report, err := GetCatalogHealth(ctx, database, 1000, 2100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *report != tt.want {
+				t.Errorf("report = %+v, want %+v", *report, tt.want)
+			}
+		})
+	}
+}
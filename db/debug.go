@@ -0,0 +1,187 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// queryObserver is told about each statement a connection executes
+type queryObserver func(query string, args []driver.NamedValue, duration time.Duration, err error)
+
+// observingConnector opens connections that report every statement they
+// execute to observe, for the debug log and query metrics
+type observingConnector struct {
+	driver.Connector
+	observe queryObserver
+}
+
+func (c *observingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &observingConn{Conn: conn, observe: c.observe}, nil
+}
+
+// observingConn forwards to the wrapped connection, observing each statement
+// it executes directly. Statements the driver declines to run directly
+// (driver.ErrSkip) are prepared instead and observed by observingStmt.
+type observingConn struct {
+	driver.Conn
+	observe queryObserver
+}
+
+func (c *observingConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return &observingStmt{Stmt: stmt, query: query, observe: c.observe}, nil
+}
+
+func (c *observingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if pc, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = pc.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &observingStmt{Stmt: stmt, query: query, observe: c.observe}, nil
+}
+
+func (c *observingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if bc, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return bc.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *observingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	qc, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	start := time.Now()
+	rows, err := qc.QueryContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		c.observe(query, args, time.Since(start), err)
+	}
+	return rows, err
+}
+
+func (c *observingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	ec, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	start := time.Now()
+	result, err := ec.ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		c.observe(query, args, time.Since(start), err)
+	}
+	return result, err
+}
+
+func (c *observingConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *observingConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (c *observingConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *observingConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+type observingStmt struct {
+	driver.Stmt
+	query   string
+	observe queryObserver
+}
+
+func (s *observingStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+
+	var result driver.Result
+	var err error
+	if ec, ok := s.Stmt.(driver.StmtExecContext); ok {
+		result, err = ec.ExecContext(ctx, args)
+	} else {
+		result, err = s.Stmt.Exec(namedValuesToValues(args))
+	}
+
+	s.observe(s.query, args, time.Since(start), err)
+	return result, err
+}
+
+func (s *observingStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+
+	var rows driver.Rows
+	var err error
+	if qc, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = qc.QueryContext(ctx, args)
+	} else {
+		rows, err = s.Stmt.Query(namedValuesToValues(args))
+	}
+
+	s.observe(s.query, args, time.Since(start), err)
+	return rows, err
+}
+
+func namedValuesToValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	return values
+}
+
+// logQuery logs a single executed statement at debug level
+func logQuery(query string, args []driver.NamedValue, redact bool, duration time.Duration, err error) {
+	params := make([]string, len(args))
+	for i, arg := range args {
+		if redact {
+			params[i] = "<redacted>"
+		} else {
+			params[i] = fmt.Sprintf("%v", arg.Value)
+		}
+	}
+
+	entry := logrus.WithFields(logrus.Fields{
+		"query":    query,
+		"args":     params,
+		"duration": duration,
+	})
+	if err != nil {
+		entry = entry.WithError(err)
+	}
+	entry.Debug("SQL query")
+}
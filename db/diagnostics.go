@@ -0,0 +1,107 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"library-api/models"
+)
+
+// ExplainSearch returns the query plan for the search query SearchBooks
+// would run with the given parameters
+func ExplainSearch(ctx context.Context, db *sql.DB, query string, page, limit int) ([]map[string]interface{}, error) {
+	search := newBookSearch(query)
+	offset := (page - 1) * limit
+
+	plan, err := explain(ctx, db, searchBooksQuery(search, nil), searchBooksArgs(search, nil, limit, offset)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to explain search query: %w", err)
+	}
+
+	return plan, nil
+}
+
+// DiagnoseQueries explains the standard list, search and count queries with
+// representative parameters and flags any that scan the whole table
+func DiagnoseQueries(ctx context.Context, db *sql.DB) ([]models.QueryDiagnostic, error) {
+	// A word long enough to take the full-text path when it is enabled
+	search := newBookSearch("language")
+
+	queries := []struct {
+		name  string
+		query string
+		args  []interface{}
+	}{
+		{"list", listBooksQuery("", "created_at", true, ""), []interface{}{10, 0}},
+		{"list_count", "SELECT COUNT(*) FROM books", nil},
+		{"search", searchBooksQuery(search, nil), searchBooksArgs(search, nil, 10, 0)},
+		{"search_count", "SELECT COUNT(*) FROM books WHERE " + search.cond, search.condArgs},
+	}
+
+	diagnostics := make([]models.QueryDiagnostic, 0, len(queries))
+	for _, q := range queries {
+		plan, err := explain(ctx, db, q.query, q.args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to explain %s query: %w", q.name, err)
+		}
+
+		diagnostic := models.QueryDiagnostic{
+			Name:  q.name,
+			Query: q.query,
+			Plan:  plan,
+		}
+		for _, row := range plan {
+			if activeDialect.isFullTableScan(row) {
+				diagnostic.FullTableScan = true
+			}
+		}
+
+		diagnostics = append(diagnostics, diagnostic)
+	}
+
+	return diagnostics, nil
+}
+
+// explain runs EXPLAIN on a query and returns the plan rows as column-value
+// maps
+func explain(ctx context.Context, db *sql.DB, query string, args ...interface{}) ([]map[string]interface{}, error) {
+	rows, err := db.QueryContext(ctx, "EXPLAIN "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get plan columns: %w", err)
+	}
+
+	var plan []map[string]interface{}
+	for rows.Next() {
+		values := make([]sql.RawBytes, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("failed to scan plan row: %w", err)
+		}
+
+		row := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			if values[i] == nil {
+				row[column] = nil
+			} else {
+				row[column] = string(values[i])
+			}
+		}
+		plan = append(plan, row)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over plan rows: %w", err)
+	}
+
+	return plan, nil
+}
@@ -0,0 +1,402 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+// dialect captures what differs between the supported database servers.
+// Queries are written once with ? placeholders and portable SQL; a dialect
+// rewrites the placeholders and supplies the parts that can't be shared.
+type dialect interface {
+	// driverName is the database/sql driver the dialect connects with
+	driverName() string
+	dsn(cfg connConfig) string
+	// rebind rewrites a query's ? placeholders into the driver's style
+	rebind(query string) string
+	migrations() []string
+	isDuplicateEntry(err error) bool
+	// isMissingFullTextIndex reports whether a full-text search failed
+	// because the index it needs doesn't exist
+	isMissingFullTextIndex(err error) bool
+	// insertIDs runs an INSERT of the given number of rows and returns the
+	// IDs generated for them, in row order
+	insertIDs(ctx context.Context, tx *sql.Tx, query string, args []interface{}, rows int) ([]int64, error)
+	// isFullTableScan reports whether an EXPLAIN plan row reads the whole table
+	isFullTableScan(row map[string]interface{}) bool
+	// syncBookIDs makes new books get IDs above any inserted explicitly
+	syncBookIDs(ctx context.Context, tx *sql.Tx) error
+	// upsertByID returns the clause making an INSERT of books with explicit
+	// IDs replace the imported fields of the books that already exist
+	upsertByID() string
+	// sortCollations maps the collations text columns can be sorted with to
+	// their names as written in a COLLATE clause
+	sortCollations() map[string]string
+	// fullTextSearch returns a condition matching books against a search
+	// query using the full-text index, and the matching relevance score;
+	// each has a single placeholder for the query
+	fullTextSearch() (cond, score string)
+}
+
+// connConfig holds the connection settings read from the environment
+type connConfig struct {
+	user, password, host, port, name string
+	// appName and instance identify this service's connections to the server
+	appName, instance string
+}
+
+// dialects lists the supported DB_DRIVER values
+var dialects = map[string]dialect{
+	"mysql":    mysqlDialect{},
+	"postgres": postgresDialect{},
+}
+
+// activeDialect is the dialect of the database opened by InitDB. It defaults
+// to MySQL so the package works unchanged when DB_DRIVER is unset.
+var activeDialect dialect = mysqlDialect{}
+
+// defaultPorts holds each driver's standard port, used when DB_PORT is unset
+var defaultPorts = map[string]string{
+	"mysql":    "3306",
+	"postgres": "5432",
+}
+
+type mysqlDialect struct{}
+
+func (mysqlDialect) driverName() string {
+	return "mysql"
+}
+
+func (mysqlDialect) dsn(cfg connConfig) string {
+	// Identify this service's connections to the server. MySQL shows
+	// connection attributes only in performance_schema.session_connect_attrs,
+	// not in SHOW PROCESSLIST, so they are found by joining the two on the
+	// process list ID
+	connAttrs := "program_name:" + cfg.appName
+	if cfg.instance != "" {
+		connAttrs += ",instance:" + cfg.instance
+	}
+
+	return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=Local&connectionAttributes=%s",
+		cfg.user, cfg.password, cfg.host, cfg.port, cfg.name, url.QueryEscape(connAttrs))
+}
+
+func (mysqlDialect) rebind(query string) string {
+	return query
+}
+
+func (mysqlDialect) migrations() []string {
+	return []string{
+		`CREATE TABLE IF NOT EXISTS books (
+			id INT AUTO_INCREMENT PRIMARY KEY,
+			title VARCHAR(255) NOT NULL,
+			author VARCHAR(255) NOT NULL,
+			published_year INT NOT NULL,
+			available BOOLEAN DEFAULT TRUE,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			INDEX idx_title (title),
+			INDEX idx_author (author),
+			INDEX idx_published_year (published_year),
+			INDEX idx_available (available)
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci`,
+		`ALTER TABLE books ADD COLUMN IF NOT EXISTS availability_changed_at TIMESTAMP NULL DEFAULT NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_availability_changed_at ON books (availability_changed_at)`,
+		`ALTER TABLE books ADD COLUMN IF NOT EXISTS featured BOOLEAN NOT NULL DEFAULT FALSE`,
+		`CREATE INDEX IF NOT EXISTS idx_featured ON books (featured)`,
+		`ALTER TABLE books ADD COLUMN IF NOT EXISTS last_accessed_at TIMESTAMP NULL DEFAULT NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_last_accessed_at ON books (last_accessed_at)`,
+		`ALTER TABLE books ADD COLUMN IF NOT EXISTS isbn VARCHAR(13) NULL DEFAULT NULL`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_isbn ON books (isbn)`,
+		`CREATE TABLE IF NOT EXISTS snapshots (
+			name VARCHAR(100) PRIMARY KEY,
+			data LONGTEXT NOT NULL,
+			book_count INT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci`,
+		`CREATE FULLTEXT INDEX IF NOT EXISTS idx_fulltext ON books (title, author)`,
+		`ALTER TABLE books ADD COLUMN IF NOT EXISTS genre VARCHAR(100) NULL DEFAULT NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_genre ON books (genre)`,
+		`CREATE INDEX IF NOT EXISTS idx_updated_at ON books (updated_at)`,
+		`ALTER TABLE books ADD COLUMN IF NOT EXISTS import_batch_id CHAR(36) NULL DEFAULT NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_import_batch_id ON books (import_batch_id)`,
+	}
+}
+
+// mysqlDuplicateEntry is the MySQL error number for a unique key violation
+// (ER_DUP_ENTRY)
+const mysqlDuplicateEntry = 1062
+
+func (mysqlDialect) isDuplicateEntry(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry
+}
+
+// mysqlFullTextIndexNotFound is the MySQL error number for a MATCH with no
+// FULLTEXT index on its columns (ER_FT_MATCHING_KEY_NOT_FOUND)
+const mysqlFullTextIndexNotFound = 1191
+
+func (mysqlDialect) isMissingFullTextIndex(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlFullTextIndexNotFound
+}
+
+func (mysqlDialect) insertIDs(ctx context.Context, tx *sql.Tx, query string, args []interface{}, rows int) ([]int64, error) {
+	result, err := tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// A multi-row insert reports the first generated ID, and the rows of a
+	// single insert get consecutive IDs
+	firstID, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get last insert ID: %w", err)
+	}
+
+	ids := make([]int64, rows)
+	for i := range ids {
+		ids[i] = firstID + int64(i)
+	}
+	return ids, nil
+}
+
+func (mysqlDialect) isFullTableScan(row map[string]interface{}) bool {
+	// An access type of ALL means MySQL reads every row of the table
+	return row["type"] == "ALL"
+}
+
+func (mysqlDialect) syncBookIDs(ctx context.Context, tx *sql.Tx) error {
+	// AUTO_INCREMENT already moves past explicitly inserted IDs
+	return nil
+}
+
+func (mysqlDialect) upsertByID() string {
+	// Assignments see the columns already assigned, so availability is
+	// compared before it changes. updated_at changes with any other column.
+	// VALUES() is used rather than a row alias, which MariaDB lacks.
+	return ` ON DUPLICATE KEY UPDATE
+		availability_changed_at = IF(available <=> VALUES(available), availability_changed_at, CURRENT_TIMESTAMP),
+		title = VALUES(title), author = VALUES(author), isbn = VALUES(isbn), genre = VALUES(genre),
+		published_year = VALUES(published_year), available = VALUES(available)`
+}
+
+// mysqlSortCollations are utf8mb4 collations for the languages whose
+// alphabetical order differs most from the table's utf8mb4_unicode_ci, along
+// with MySQL 8's newer default Unicode collation
+var mysqlSortCollations = map[string]string{
+	"utf8mb4_0900_ai_ci":       "utf8mb4_0900_ai_ci",
+	"utf8mb4_cs_0900_ai_ci":    "utf8mb4_cs_0900_ai_ci",
+	"utf8mb4_da_0900_ai_ci":    "utf8mb4_da_0900_ai_ci",
+	"utf8mb4_de_pb_0900_ai_ci": "utf8mb4_de_pb_0900_ai_ci",
+	"utf8mb4_es_0900_ai_ci":    "utf8mb4_es_0900_ai_ci",
+	"utf8mb4_hu_0900_ai_ci":    "utf8mb4_hu_0900_ai_ci",
+	"utf8mb4_pl_0900_ai_ci":    "utf8mb4_pl_0900_ai_ci",
+	"utf8mb4_sv_0900_ai_ci":    "utf8mb4_sv_0900_ai_ci",
+	"utf8mb4_tr_0900_ai_ci":    "utf8mb4_tr_0900_ai_ci",
+}
+
+func (mysqlDialect) sortCollations() map[string]string {
+	return mysqlSortCollations
+}
+
+func (mysqlDialect) fullTextSearch() (cond, score string) {
+	// In natural language mode a nonzero relevance means a match, so the
+	// expression works as both
+	match := `MATCH(title, author) AGAINST (? IN NATURAL LANGUAGE MODE)`
+	return match, match
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) driverName() string {
+	return "postgres"
+}
+
+func (postgresDialect) dsn(cfg connConfig) string {
+	query := url.Values{}
+	query.Set("sslmode", "disable")
+	// Shown in pg_stat_activity.application_name
+	query.Set("application_name", cfg.appName)
+
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(cfg.user, cfg.password),
+		Host:     cfg.host + ":" + cfg.port,
+		Path:     "/" + cfg.name,
+		RawQuery: query.Encode(),
+	}
+	return u.String()
+}
+
+// rebind numbers the ? placeholders as $1, $2, ..., leaving question marks
+// inside quoted strings and identifiers alone
+func (postgresDialect) rebind(query string) string {
+	var b strings.Builder
+	b.Grow(len(query) + 8)
+
+	n := 0
+	var quote rune
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			// A doubled quote inside a quoted section closes and reopens it,
+			// which leaves the state unchanged overall
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+func (postgresDialect) migrations() []string {
+	// PostgreSQL has no ON UPDATE clause, so every UPDATE sets updated_at
+	// itself
+	return []string{
+		`CREATE TABLE IF NOT EXISTS books (
+			id SERIAL PRIMARY KEY,
+			title VARCHAR(255) NOT NULL,
+			author VARCHAR(255) NOT NULL,
+			isbn VARCHAR(13) NULL DEFAULT NULL,
+			published_year INT NOT NULL,
+			available BOOLEAN DEFAULT TRUE,
+			featured BOOLEAN NOT NULL DEFAULT FALSE,
+			availability_changed_at TIMESTAMPTZ NULL DEFAULT NULL,
+			last_accessed_at TIMESTAMPTZ NULL DEFAULT NULL,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_title ON books (title)`,
+		`CREATE INDEX IF NOT EXISTS idx_author ON books (author)`,
+		`CREATE INDEX IF NOT EXISTS idx_published_year ON books (published_year)`,
+		`CREATE INDEX IF NOT EXISTS idx_available ON books (available)`,
+		`CREATE INDEX IF NOT EXISTS idx_availability_changed_at ON books (availability_changed_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_featured ON books (featured)`,
+		`CREATE INDEX IF NOT EXISTS idx_last_accessed_at ON books (last_accessed_at)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_isbn ON books (isbn)`,
+		`CREATE TABLE IF NOT EXISTS snapshots (
+			name VARCHAR(100) PRIMARY KEY,
+			data TEXT NOT NULL,
+			book_count INT NOT NULL,
+			created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_fulltext ON books USING GIN (` + postgresBookDocument + `)`,
+		// Added after PostgreSQL support, so existing tables need it too
+		`ALTER TABLE books ADD COLUMN IF NOT EXISTS genre VARCHAR(100) NULL DEFAULT NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_genre ON books (genre)`,
+		`CREATE INDEX IF NOT EXISTS idx_updated_at ON books (updated_at)`,
+		`ALTER TABLE books ADD COLUMN IF NOT EXISTS import_batch_id UUID NULL DEFAULT NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_import_batch_id ON books (import_batch_id)`,
+	}
+}
+
+// postgresBookDocument is the text search document of a book. The simple
+// configuration neither stems words nor drops stop words, which keeps
+// matching close to MySQL's; the index must use the identical expression.
+const postgresBookDocument = `to_tsvector('simple', title || ' ' || author)`
+
+// postgresUniqueViolation is the SQLSTATE for a unique key violation
+const postgresUniqueViolation = "23505"
+
+func (postgresDialect) isDuplicateEntry(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == postgresUniqueViolation
+}
+
+func (postgresDialect) isMissingFullTextIndex(err error) bool {
+	// The text search functions work without an index, only slower
+	return false
+}
+
+func (postgresDialect) insertIDs(ctx context.Context, tx *sql.Tx, query string, args []interface{}, rows int) ([]int64, error) {
+	// The driver doesn't support LastInsertId, so the IDs are returned by the
+	// insert itself
+	result, err := tx.QueryContext(ctx, query+" RETURNING id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+
+	ids := make([]int64, 0, rows)
+	for result.Next() {
+		var id int64
+		if err := result.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan inserted ID: %w", err)
+		}
+		ids = append(ids, id)
+	}
+
+	if err := result.Err(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+func (postgresDialect) isFullTableScan(row map[string]interface{}) bool {
+	// PostgreSQL returns the plan as text lines; a sequential scan reads the
+	// whole table
+	line, _ := row["QUERY PLAN"].(string)
+	return strings.Contains(line, "Seq Scan")
+}
+
+func (postgresDialect) syncBookIDs(ctx context.Context, tx *sql.Tx) error {
+	// Explicit IDs bypass the sequence, so move it to the highest one; an
+	// empty table restarts it at 1
+	_, err := tx.ExecContext(ctx, `SELECT setval(pg_get_serial_sequence('books', 'id'),
+		COALESCE(MAX(id), 1), MAX(id) IS NOT NULL) FROM books`)
+	return err
+}
+
+func (postgresDialect) upsertByID() string {
+	// Unchanged books are skipped so their updated_at stays put, as MySQL's
+	// ON UPDATE leaves it
+	return ` ON CONFLICT (id) DO UPDATE SET
+		title = EXCLUDED.title, author = EXCLUDED.author, isbn = EXCLUDED.isbn, genre = EXCLUDED.genre,
+		published_year = EXCLUDED.published_year, available = EXCLUDED.available,
+		availability_changed_at = CASE WHEN books.available IS DISTINCT FROM EXCLUDED.available
+			THEN CURRENT_TIMESTAMP ELSE books.availability_changed_at END,
+		updated_at = CURRENT_TIMESTAMP
+		WHERE (books.title, books.author, books.isbn, books.genre, books.published_year, books.available)
+			IS DISTINCT FROM (EXCLUDED.title, EXCLUDED.author, EXCLUDED.isbn, EXCLUDED.genre, EXCLUDED.published_year, EXCLUDED.available)`
+}
+
+// postgresSortCollations are the ICU collations for the same languages as
+// mysqlSortCollations. Their names contain hyphens, so they are quoted.
+var postgresSortCollations = map[string]string{
+	"und-x-icu": `"und-x-icu"`,
+	"cs-x-icu":  `"cs-x-icu"`,
+	"da-x-icu":  `"da-x-icu"`,
+	"de-x-icu":  `"de-x-icu"`,
+	"es-x-icu":  `"es-x-icu"`,
+	"hu-x-icu":  `"hu-x-icu"`,
+	"pl-x-icu":  `"pl-x-icu"`,
+	"sv-x-icu":  `"sv-x-icu"`,
+	"tr-x-icu":  `"tr-x-icu"`,
+}
+
+func (postgresDialect) sortCollations() map[string]string {
+	return postgresSortCollations
+}
+
+func (postgresDialect) fullTextSearch() (cond, score string) {
+	return postgresBookDocument + ` @@ plainto_tsquery('simple', ?)`,
+		`ts_rank(` + postgresBookDocument + `, plainto_tsquery('simple', ?))`
+}
@@ -0,0 +1,94 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+func TestRebind(t *testing.T) {
+	tests := []struct {
+		d     dialect
+		query string
+		want  string
+	}{
+		{mysqlDialect{}, "SELECT * FROM books WHERE id = ? AND title = ?", "SELECT * FROM books WHERE id = ? AND title = ?"},
+		{postgresDialect{}, "SELECT 1", "SELECT 1"},
+		{postgresDialect{}, "SELECT * FROM books WHERE id = ?", "SELECT * FROM books WHERE id = $1"},
+		{
+			postgresDialect{},
+			"UPDATE books SET title = ?, author = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+			"UPDATE books SET title = $1, author = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $3",
+		},
+		{postgresDialect{}, searchCondition, "(LOWER(title) LIKE LOWER($1) ESCAPE '!' OR LOWER(author) LIKE LOWER($2) ESCAPE '!')"},
+		{postgresDialect{}, `SELECT '?' AS q, "is?" FROM books WHERE id = ?`, `SELECT '?' AS q, "is?" FROM books WHERE id = $1`},
+		{postgresDialect{}, "SELECT 'it''s ?' FROM books WHERE title = ?", "SELECT 'it''s ?' FROM books WHERE title = $1"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.d.rebind(tt.query); got != tt.want {
+			t.Errorf("%T.rebind(%q) = %q, want %q", tt.d, tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestIsDuplicateEntry(t *testing.T) {
+	mysqlDup := &mysql.MySQLError{Number: 1062}
+	pqDup := &pq.Error{Code: "23505"}
+
+	tests := []struct {
+		d    dialect
+		err  error
+		want bool
+	}{
+		{mysqlDialect{}, mysqlDup, true},
+		{mysqlDialect{}, fmt.Errorf("insert: %w", mysqlDup), true},
+		{mysqlDialect{}, &mysql.MySQLError{Number: 1406}, false},
+		{mysqlDialect{}, pqDup, false},
+		{mysqlDialect{}, nil, false},
+		{postgresDialect{}, pqDup, true},
+		{postgresDialect{}, &pq.Error{Code: "23503"}, false},
+		{postgresDialect{}, mysqlDup, false},
+		{postgresDialect{}, errors.New("duplicate"), false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.d.isDuplicateEntry(tt.err); got != tt.want {
+			t.Errorf("%T.isDuplicateEntry(%v) = %v, want %v", tt.d, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestSortCollations(t *testing.T) {
+	tests := []struct {
+		dialect   dialect
+		collation string
+		want      string // the ORDER BY, or empty when the collation isn't allowed
+	}{
+		{mysqlDialect{}, "utf8mb4_da_0900_ai_ci", "ORDER BY title COLLATE utf8mb4_da_0900_ai_ci ASC"},
+		{mysqlDialect{}, "da-x-icu", ""},
+		{mysqlDialect{}, "utf8mb4_da_0900_ai_ci; DROP TABLE books", ""},
+		{postgresDialect{}, "da-x-icu", `ORDER BY title COLLATE "da-x-icu" ASC`},
+		{postgresDialect{}, "utf8mb4_da_0900_ai_ci", ""},
+	}
+
+	previous := activeDialect
+	t.Cleanup(func() { activeDialect = previous })
+	for _, tt := range tests {
+		activeDialect = tt.dialect
+		if allowed := IsSortCollation(tt.collation); allowed != (tt.want != "") {
+			t.Errorf("%s %q: allowed = %v", tt.dialect.driverName(), tt.collation, allowed)
+			continue
+		}
+		if tt.want == "" {
+			continue
+		}
+		if got := listBooksQuery("", "title", false, tt.collation); !strings.Contains(got, tt.want) {
+			t.Errorf("%s %q: %q doesn't contain %q", tt.dialect.driverName(), tt.collation, got, tt.want)
+		}
+	}
+}
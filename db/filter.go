@@ -0,0 +1,415 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// BookFilter holds optional conditions narrowing which books are listed. The
+// zero value matches every book.
+type BookFilter struct {
+	// Expr is a parsed filter expression, see ParseFilter
+	Expr FilterExpr
+	// IDMin and IDMax bound the book ID range, inclusive; zero means unbounded
+	IDMin int
+	IDMax int
+	// Genre restricts books to the given genre when non-empty
+	Genre string
+	// Title and Author restrict books to those whose title or author
+	// contains the given text, ignoring case, when non-empty
+	Title  string
+	Author string
+	// Available restricts books to the given availability when set
+	Available *bool
+	// YearMin and YearMax bound the published year, inclusive, when set
+	YearMin *int
+	YearMax *int
+	// CreatedSince and UpdatedSince restrict books to those created or
+	// last updated at or after the given time, when set
+	CreatedSince *time.Time
+	UpdatedSince *time.Time
+	// ImportBatch restricts books to those created by the import with the
+	// given batch ID when non-empty
+	ImportBatch string
+}
+
+// conditions returns the SQL conditions the filter applies, to be combined
+// with AND, and their arguments
+func (f BookFilter) conditions() ([]string, []interface{}) {
+	var conds []string
+	var args []interface{}
+
+	if f.Expr != nil {
+		cond, exprArgs := f.Expr.sql()
+		conds = append(conds, cond)
+		args = append(args, exprArgs...)
+	}
+
+	switch {
+	case f.IDMin > 0 && f.IDMax > 0:
+		conds = append(conds, "id BETWEEN ? AND ?")
+		args = append(args, f.IDMin, f.IDMax)
+	case f.IDMin > 0:
+		conds = append(conds, "id >= ?")
+		args = append(args, f.IDMin)
+	case f.IDMax > 0:
+		conds = append(conds, "id <= ?")
+		args = append(args, f.IDMax)
+	}
+
+	if f.Genre != "" {
+		conds = append(conds, "genre = ?")
+		args = append(args, f.Genre)
+	}
+	if f.Title != "" {
+		conds = append(conds, "LOWER(title) LIKE LOWER(?) ESCAPE '!'")
+		args = append(args, containsPattern(f.Title))
+	}
+	if f.Author != "" {
+		conds = append(conds, "LOWER(author) LIKE LOWER(?) ESCAPE '!'")
+		args = append(args, containsPattern(f.Author))
+	}
+	if f.Available != nil {
+		conds = append(conds, "available = ?")
+		args = append(args, *f.Available)
+	}
+	if f.YearMin != nil {
+		conds = append(conds, "published_year >= ?")
+		args = append(args, *f.YearMin)
+	}
+	if f.YearMax != nil {
+		conds = append(conds, "published_year <= ?")
+		args = append(args, *f.YearMax)
+	}
+	if f.CreatedSince != nil {
+		conds = append(conds, "created_at >= ?")
+		args = append(args, *f.CreatedSince)
+	}
+	if f.UpdatedSince != nil {
+		conds = append(conds, "updated_at >= ?")
+		args = append(args, *f.UpdatedSince)
+	}
+	if f.ImportBatch != "" {
+		conds = append(conds, "import_batch_id = ?")
+		args = append(args, f.ImportBatch)
+	}
+
+	return conds, args
+}
+
+// whereClause joins conditions into a WHERE clause, or returns an empty
+// string when there are none
+func whereClause(conds []string) string {
+	if len(conds) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(conds, " AND ")
+}
+
+// Limits on filter expressions, so a single request can't build an
+// arbitrarily expensive WHERE clause
+const (
+	maxFilterLength      = 500
+	maxFilterComparisons = 10
+	maxFilterDepth       = 5
+)
+
+// FilterExpr is a parsed filter expression, such as
+// `author:Tolkien AND year>1950`, that renders to a parameterized SQL
+// condition. User input only ever reaches the query as bound arguments.
+type FilterExpr interface {
+	sql() (string, []interface{})
+}
+
+// FilterError describes why a filter expression couldn't be parsed. Pos is
+// the zero-based character offset of the problem, or -1 if it has none.
+type FilterError struct {
+	Pos int
+	Msg string
+}
+
+func (e *FilterError) Error() string {
+	if e.Pos < 0 {
+		return e.Msg
+	}
+	return fmt.Sprintf("%s at position %d", e.Msg, e.Pos+1)
+}
+
+type filterField struct {
+	column string
+	kind   string // "text", "int" or "bool"
+}
+
+// filterFields maps the field names accepted in filter expressions to columns
+var filterFields = map[string]filterField{
+	"title":     {"title", "text"},
+	"author":    {"author", "text"},
+	"genre":     {"genre", "text"},
+	"year":      {"published_year", "int"},
+	"available": {"available", "bool"},
+	"featured":  {"featured", "bool"},
+}
+
+type logicalExpr struct {
+	op          string // "AND" or "OR"
+	left, right FilterExpr
+}
+
+func (e logicalExpr) sql() (string, []interface{}) {
+	leftSQL, leftArgs := e.left.sql()
+	rightSQL, rightArgs := e.right.sql()
+	return "(" + leftSQL + " " + e.op + " " + rightSQL + ")", append(leftArgs, rightArgs...)
+}
+
+type comparisonExpr struct {
+	column string
+	op     string
+	value  interface{}
+}
+
+func (e comparisonExpr) sql() (string, []interface{}) {
+	if e.op == "LIKE" {
+		return "LOWER(" + e.column + ") LIKE LOWER(?) ESCAPE '!'", []interface{}{e.value}
+	}
+	return e.column + " " + e.op + " ?", []interface{}{e.value}
+}
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenString
+	tokenOp
+	tokenLParen
+	tokenRParen
+	tokenEOF
+)
+
+type filterToken struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// tokenizeFilter splits a filter expression into words, quoted strings,
+// comparison operators and parentheses
+func tokenizeFilter(input string) ([]filterToken, error) {
+	var tokens []filterToken
+	runes := []rune(input)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, filterToken{tokenLParen, "(", i})
+			i++
+		case r == ')':
+			tokens = append(tokens, filterToken{tokenRParen, ")", i})
+			i++
+		case r == ':':
+			tokens = append(tokens, filterToken{tokenOp, ":", i})
+			i++
+		case r == '>' || r == '<':
+			op := string(r)
+			if i+1 < len(runes) && runes[i+1] == '=' {
+				op += "="
+			}
+			tokens = append(tokens, filterToken{tokenOp, op, i})
+			i += len(op)
+		case r == '"':
+			start := i
+			var sb strings.Builder
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				sb.WriteRune(runes[i])
+			}
+			if i >= len(runes) {
+				return nil, &FilterError{start, "unterminated quoted string"}
+			}
+			tokens = append(tokens, filterToken{tokenString, sb.String(), start})
+			i++
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune(`():<>"`, runes[i]) {
+				i++
+			}
+			tokens = append(tokens, filterToken{tokenWord, string(runes[start:i]), start})
+		}
+	}
+
+	return append(tokens, filterToken{tokenEOF, "", len(runes)}), nil
+}
+
+// ParseFilter parses a filter expression. Comparisons have the form
+// field:value, or field>value, field<value, field>=value and field<=value
+// for numeric fields, and combine with AND, OR and parentheses. AND binds
+// tighter than OR. Text fields match values as substrings.
+func ParseFilter(input string) (FilterExpr, error) {
+	if len([]rune(input)) > maxFilterLength {
+		return nil, &FilterError{-1, fmt.Sprintf("filter exceeds %d characters", maxFilterLength)}
+	}
+
+	tokens, err := tokenizeFilter(input)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &filterParser{tokens: tokens}
+	expr, err := p.parseOr(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, &FilterError{tok.pos, fmt.Sprintf("unexpected %q", tok.text)}
+	}
+
+	return expr, nil
+}
+
+type filterParser struct {
+	tokens      []filterToken
+	pos         int
+	comparisons int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// isKeyword reports whether the next token is the given logical keyword
+func (p *filterParser) isKeyword(keyword string) bool {
+	tok := p.peek()
+	return tok.kind == tokenWord && strings.EqualFold(tok.text, keyword)
+}
+
+func (p *filterParser) parseOr(depth int) (FilterExpr, error) {
+	left, err := p.parseAnd(depth)
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isKeyword("OR") {
+		p.next()
+		right, err := p.parseAnd(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = logicalExpr{"OR", left, right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseAnd(depth int) (FilterExpr, error) {
+	left, err := p.parseTerm(depth)
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isKeyword("AND") {
+		p.next()
+		right, err := p.parseTerm(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = logicalExpr{"AND", left, right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseTerm(depth int) (FilterExpr, error) {
+	tok := p.peek()
+	if tok.kind != tokenLParen {
+		return p.parseComparison()
+	}
+
+	if depth >= maxFilterDepth {
+		return nil, &FilterError{tok.pos, fmt.Sprintf("filter nests deeper than %d levels", maxFilterDepth)}
+	}
+	p.next()
+
+	expr, err := p.parseOr(depth + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if closing := p.next(); closing.kind != tokenRParen {
+		return nil, &FilterError{closing.pos, "expected \")\""}
+	}
+
+	return expr, nil
+}
+
+func (p *filterParser) parseComparison() (FilterExpr, error) {
+	fieldTok := p.next()
+	if fieldTok.kind != tokenWord {
+		return nil, &FilterError{fieldTok.pos, "expected a field name"}
+	}
+
+	field, ok := filterFields[strings.ToLower(fieldTok.text)]
+	if !ok {
+		return nil, &FilterError{fieldTok.pos, fmt.Sprintf("unknown field %q", fieldTok.text)}
+	}
+
+	opTok := p.next()
+	if opTok.kind != tokenOp {
+		return nil, &FilterError{opTok.pos, fmt.Sprintf("expected an operator after %q", fieldTok.text)}
+	}
+
+	valueTok := p.next()
+	if valueTok.kind != tokenWord && valueTok.kind != tokenString {
+		return nil, &FilterError{valueTok.pos, fmt.Sprintf("expected a value for %q", fieldTok.text)}
+	}
+
+	p.comparisons++
+	if p.comparisons > maxFilterComparisons {
+		return nil, &FilterError{fieldTok.pos, fmt.Sprintf("filter has more than %d comparisons", maxFilterComparisons)}
+	}
+
+	switch field.kind {
+	case "text":
+		if opTok.text != ":" {
+			return nil, &FilterError{opTok.pos, fmt.Sprintf("operator %q is not supported for %q", opTok.text, fieldTok.text)}
+		}
+		return comparisonExpr{field.column, "LIKE", containsPattern(valueTok.text)}, nil
+
+	case "int":
+		value, err := strconv.Atoi(valueTok.text)
+		if err != nil {
+			return nil, &FilterError{valueTok.pos, fmt.Sprintf("%q must be a whole number", fieldTok.text)}
+		}
+		op := opTok.text
+		if op == ":" {
+			op = "="
+		}
+		return comparisonExpr{field.column, op, value}, nil
+
+	default:
+		if opTok.text != ":" {
+			return nil, &FilterError{opTok.pos, fmt.Sprintf("operator %q is not supported for %q", opTok.text, fieldTok.text)}
+		}
+		value, err := strconv.ParseBool(valueTok.text)
+		if err != nil {
+			return nil, &FilterError{valueTok.pos, fmt.Sprintf("%q must be true or false", fieldTok.text)}
+		}
+		return comparisonExpr{field.column, "=", value}, nil
+	}
+}
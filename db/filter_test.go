@@ -0,0 +1,51 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestBookFilterConditions(t *testing.T) {
+	yes, no := true, false
+	year1990, year2000 := 1990, 2000
+
+	tests := []struct {
+		filter    BookFilter
+		wantConds string
+		wantArgs  string
+	}{
+		{BookFilter{}, "", "[]"},
+		{BookFilter{Available: &yes}, "available = ?", "[true]"},
+		{BookFilter{Available: &no}, "available = ?", "[false]"},
+		{BookFilter{YearMin: &year1990}, "published_year >= ?", "[1990]"},
+		{BookFilter{YearMax: &year2000}, "published_year <= ?", "[2000]"},
+		{
+			BookFilter{Available: &yes, YearMin: &year1990, YearMax: &year2000},
+			"available = ? AND published_year >= ? AND published_year <= ?",
+			"[true 1990 2000]",
+		},
+		{
+			BookFilter{IDMin: 5, Available: &no, YearMax: &year2000},
+			"id >= ? AND available = ? AND published_year <= ?",
+			"[5 false 2000]",
+		},
+		{BookFilter{Title: "dune"}, "LOWER(title) LIKE LOWER(?) ESCAPE '!'", "[%dune%]"},
+		{BookFilter{Author: "herbert"}, "LOWER(author) LIKE LOWER(?) ESCAPE '!'", "[%herbert%]"},
+		{
+			BookFilter{Title: "100%", Author: "o_brien"},
+			"LOWER(title) LIKE LOWER(?) ESCAPE '!' AND LOWER(author) LIKE LOWER(?) ESCAPE '!'",
+			"[%100!%% %o!_brien%]",
+		},
+	}
+
+	for _, tt := range tests {
+		conds, args := tt.filter.conditions()
+		if got := strings.Join(conds, " AND "); got != tt.wantConds {
+			t.Errorf("%+v: conditions %q, want %q", tt.filter, got, tt.wantConds)
+		}
+		if got := fmt.Sprint(args); got != tt.wantArgs {
+			t.Errorf("%+v: args %s, want %s", tt.filter, got, tt.wantArgs)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package db
+
+import (
+	"database/sql/driver"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "db_query_duration_seconds",
+	Help:    "Duration of SQL statements, by statement type.",
+	Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+}, []string{"operation"})
+
+// observeQueryDuration records a statement's duration under its leading
+// keyword, which keeps the label set small whatever the query text
+func observeQueryDuration(query string, _ []driver.NamedValue, duration time.Duration, _ error) {
+	queryDuration.WithLabelValues(queryOperation(query)).Observe(duration.Seconds())
+}
+
+// queryOperation returns the statement type of a query, such as "select"
+func queryOperation(query string) string {
+	query = strings.TrimSpace(query)
+	keyword := query
+	if end := strings.IndexFunc(query, func(r rune) bool { return unicode.IsSpace(r) || r == '(' }); end >= 0 {
+		keyword = query[:end]
+	}
+
+	switch keyword = strings.ToLower(keyword); keyword {
+	case "select", "insert", "update", "delete", "explain":
+		return keyword
+	}
+	return "other"
+}
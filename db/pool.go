@@ -0,0 +1,136 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// poolConfig holds the connection pool limits applied by InitDB
+type poolConfig struct {
+	maxOpenConns    int
+	maxIdleConns    int
+	connMaxLifetime time.Duration
+}
+
+// defaultPoolConfig is used for any pool setting left unset
+var defaultPoolConfig = poolConfig{
+	maxOpenConns:    25,
+	maxIdleConns:    5,
+	connMaxLifetime: 5 * time.Minute,
+}
+
+// poolConfigFromEnv reads DB_MAX_OPEN_CONNS, DB_MAX_IDLE_CONNS and
+// DB_CONN_MAX_LIFETIME. A value that doesn't parse is logged and replaced
+// by its default; an idle limit above the open limit is an error, since
+// database/sql would silently lower it.
+func poolConfigFromEnv() (poolConfig, error) {
+	cfg := defaultPoolConfig
+
+	for _, setting := range []struct {
+		name string
+		dest *int
+	}{{"DB_MAX_OPEN_CONNS", &cfg.maxOpenConns}, {"DB_MAX_IDLE_CONNS", &cfg.maxIdleConns}} {
+		v := os.Getenv(setting.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			logrus.WithField(setting.name, v).Warnf("Ignoring invalid %s, must be a positive integer", setting.name)
+			continue
+		}
+		*setting.dest = n
+	}
+
+	if v := os.Getenv("DB_CONN_MAX_LIFETIME"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			logrus.WithField("DB_CONN_MAX_LIFETIME", v).Warn("Ignoring invalid DB_CONN_MAX_LIFETIME, must be a positive duration such as 5m")
+		} else {
+			cfg.connMaxLifetime = d
+		}
+	}
+
+	if cfg.maxIdleConns > cfg.maxOpenConns {
+		return cfg, fmt.Errorf("DB_MAX_IDLE_CONNS (%d) must not exceed DB_MAX_OPEN_CONNS (%d)",
+			cfg.maxIdleConns, cfg.maxOpenConns)
+	}
+
+	return cfg, nil
+}
+
+// connectRetry controls how InitDB waits for a database that isn't
+// accepting connections yet
+type connectRetry struct {
+	attempts  int
+	baseDelay time.Duration
+	maxDelay  time.Duration
+}
+
+// defaultConnectRetry waits about 30 seconds in total, long enough for a
+// database container started alongside the service
+var defaultConnectRetry = connectRetry{
+	attempts:  8,
+	baseDelay: 500 * time.Millisecond,
+	maxDelay:  8 * time.Second,
+}
+
+// connectRetryFromEnv reads DB_CONNECT_ATTEMPTS and DB_CONNECT_BASE_DELAY,
+// falling back to the defaults for values that don't parse
+func connectRetryFromEnv() connectRetry {
+	retry := defaultConnectRetry
+
+	if v := os.Getenv("DB_CONNECT_ATTEMPTS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			retry.attempts = n
+		} else {
+			logrus.WithField("DB_CONNECT_ATTEMPTS", v).Warn("Ignoring invalid DB_CONNECT_ATTEMPTS, must be a positive integer")
+		}
+	}
+
+	if v := os.Getenv("DB_CONNECT_BASE_DELAY"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			retry.baseDelay = d
+		} else {
+			logrus.WithField("DB_CONNECT_BASE_DELAY", v).Warn("Ignoring invalid DB_CONNECT_BASE_DELAY, must be a positive duration such as 500ms")
+		}
+	}
+
+	return retry
+}
+
+// pingWithRetry calls ping until it succeeds or the attempts run out,
+// doubling the wait after each failure up to maxDelay. It returns the last
+// error when every attempt fails.
+func pingWithRetry(ping func() error, retry connectRetry, sleep func(time.Duration)) error {
+	delay := retry.baseDelay
+
+	var err error
+	for attempt := 1; attempt <= retry.attempts; attempt++ {
+		if err = ping(); err == nil {
+			return nil
+		}
+
+		entry := logrus.WithFields(logrus.Fields{
+			"attempt":  attempt,
+			"attempts": retry.attempts,
+		}).WithError(err)
+		if attempt == retry.attempts {
+			entry.Error("Database ping failed, giving up")
+			break
+		}
+		entry.WithField("retry_in", delay.String()).Warn("Database ping failed, retrying")
+
+		sleep(delay)
+		delay *= 2
+		if delay > retry.maxDelay {
+			delay = retry.maxDelay
+		}
+	}
+
+	return err
+}
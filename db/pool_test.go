@@ -0,0 +1,124 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPoolConfigFromEnv(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		want     poolConfig
+		wantsErr bool
+	}{
+		{"defaults", nil, defaultPoolConfig, false},
+		{
+			"all set",
+			map[string]string{"DB_MAX_OPEN_CONNS": "50", "DB_MAX_IDLE_CONNS": "10", "DB_CONN_MAX_LIFETIME": "90s"},
+			poolConfig{maxOpenConns: 50, maxIdleConns: 10, connMaxLifetime: 90 * time.Second},
+			false,
+		},
+		{
+			"invalid values use defaults",
+			map[string]string{"DB_MAX_OPEN_CONNS": "many", "DB_MAX_IDLE_CONNS": "-1", "DB_CONN_MAX_LIFETIME": "5 minutes"},
+			defaultPoolConfig,
+			false,
+		},
+		{
+			"zero lifetime uses default",
+			map[string]string{"DB_CONN_MAX_LIFETIME": "0s"},
+			defaultPoolConfig,
+			false,
+		},
+		{
+			"idle above open",
+			map[string]string{"DB_MAX_OPEN_CONNS": "4", "DB_MAX_IDLE_CONNS": "8"},
+			poolConfig{maxOpenConns: 4, maxIdleConns: 8, connMaxLifetime: defaultPoolConfig.connMaxLifetime},
+			true,
+		},
+		{
+			"idle above default open",
+			map[string]string{"DB_MAX_IDLE_CONNS": "30"},
+			poolConfig{maxOpenConns: 25, maxIdleConns: 30, connMaxLifetime: defaultPoolConfig.connMaxLifetime},
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"DB_MAX_OPEN_CONNS", "DB_MAX_IDLE_CONNS", "DB_CONN_MAX_LIFETIME"} {
+				t.Setenv(name, tt.env[name])
+			}
+
+			got, err := poolConfigFromEnv()
+			if (err != nil) != tt.wantsErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantsErr)
+			}
+			if got != tt.want {
+				t.Errorf("config = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPingWithRetry(t *testing.T) {
+	retry := connectRetry{attempts: 5, baseDelay: 100 * time.Millisecond, maxDelay: 300 * time.Millisecond}
+
+	tests := []struct {
+		failures int // pings failing before one succeeds
+		wantErr  bool
+		calls    int
+		sleeps   []time.Duration
+	}{
+		{0, false, 1, nil},
+		{1, false, 2, []time.Duration{100 * time.Millisecond}},
+		{3, false, 4, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond}},
+		{5, true, 5, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 300 * time.Millisecond}},
+	}
+
+	for _, tt := range tests {
+		calls := 0
+		ping := func() error {
+			calls++
+			if calls <= tt.failures {
+				return errors.New("connection refused")
+			}
+			return nil
+		}
+		var sleeps []time.Duration
+
+		err := pingWithRetry(ping, retry, func(d time.Duration) { sleeps = append(sleeps, d) })
+
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%d failures: err = %v, want error %v", tt.failures, err, tt.wantErr)
+		}
+		if calls != tt.calls {
+			t.Errorf("%d failures: pinged %d times, want %d", tt.failures, calls, tt.calls)
+		}
+		if fmt.Sprint(sleeps) != fmt.Sprint(tt.sleeps) {
+			t.Errorf("%d failures: slept %v, want %v", tt.failures, sleeps, tt.sleeps)
+		}
+	}
+}
+
+func TestConnectRetryFromEnv(t *testing.T) {
+	tests := []struct {
+		attempts, baseDelay string
+		want                connectRetry
+	}{
+		{"", "", defaultConnectRetry},
+		{"3", "2s", connectRetry{attempts: 3, baseDelay: 2 * time.Second, maxDelay: defaultConnectRetry.maxDelay}},
+		{"0", "soon", defaultConnectRetry},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("DB_CONNECT_ATTEMPTS", tt.attempts)
+		t.Setenv("DB_CONNECT_BASE_DELAY", tt.baseDelay)
+		if got := connectRetryFromEnv(); got != tt.want {
+			t.Errorf("%q, %q: retry = %+v, want %+v", tt.attempts, tt.baseDelay, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"library-api/models"
+	"strings"
+)
+
+// ErrSnapshotExists is returned by CreateSnapshot when the name is taken
+var ErrSnapshotExists = errors.New("snapshot already exists")
+
+// restoreBatchSize is the number of books inserted per statement on restore
+const restoreBatchSize = 500
+
+// CreateSnapshot stores the full catalog as JSON under the given name
+func CreateSnapshot(ctx context.Context, db *sql.DB, name string) (*models.Snapshot, error) {
+	books := []models.Book{}
+	err := ForEachBook(ctx, db, BookFilter{}, func(book models.Book) error {
+		books = append(books, book)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(books)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+
+	_, err = db.ExecContext(ctx, "INSERT INTO snapshots (name, data, book_count) VALUES (?, ?, ?)",
+		name, data, len(books))
+	if isDuplicateEntry(err) {
+		return nil, ErrSnapshotExists
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create snapshot: %w", err)
+	}
+
+	var snapshot models.Snapshot
+	err = db.QueryRowContext(ctx, "SELECT name, book_count, created_at FROM snapshots WHERE name = ?", name).
+		Scan(&snapshot.Name, &snapshot.BookCount, &snapshot.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get snapshot: %w", err)
+	}
+
+	return &snapshot, nil
+}
+
+// RestoreSnapshot replaces the whole catalog with the named snapshot inside a
+// transaction and returns the number of books restored. Returns sql.ErrNoRows
+// if the snapshot doesn't exist.
+func RestoreSnapshot(ctx context.Context, db *sql.DB, name string) (int, error) {
+	var data []byte
+	err := db.QueryRowContext(ctx, "SELECT data FROM snapshots WHERE name = ?", name).Scan(&data)
+	if err == sql.ErrNoRows {
+		return 0, sql.ErrNoRows
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get snapshot: %w", err)
+	}
+
+	var books []models.Book
+	if err := json.Unmarshal(data, &books); err != nil {
+		return 0, fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+
+	err = WithTx(ctx, db, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM books"); err != nil {
+			return fmt.Errorf("failed to clear books: %w", err)
+		}
+
+		columnCount := len(strings.Split(bookColumns, ","))
+		rowPlaceholder := "(" + strings.TrimSuffix(strings.Repeat("?, ", columnCount), ", ") + ")"
+
+		for start := 0; start < len(books); start += restoreBatchSize {
+			end := start + restoreBatchSize
+			if end > len(books) {
+				end = len(books)
+			}
+
+			placeholders := make([]string, 0, end-start)
+			args := make([]interface{}, 0, (end-start)*columnCount)
+			for _, book := range books[start:end] {
+				placeholders = append(placeholders, rowPlaceholder)
+				args = append(args, bookValues(book)...)
+			}
+
+			query := "INSERT INTO books (" + bookColumns + ") VALUES " + strings.Join(placeholders, ", ")
+			if _, err := tx.ExecContext(ctx, query, args...); err != nil {
+				return fmt.Errorf("failed to restore books: %w", err)
+			}
+		}
+
+		if err := activeDialect.syncBookIDs(ctx, tx); err != nil {
+			return fmt.Errorf("failed to sync book IDs: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(books), nil
+}
@@ -0,0 +1,120 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"library-api/models"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestWithTx(t *testing.T) {
+	tests := []struct {
+		name   string
+		fn     func(tx *sql.Tx) error
+		commit bool
+		err    error
+		panic  interface{}
+	}{
+		{name: "commits", fn: func(tx *sql.Tx) error { return nil }, commit: true},
+		{name: "rolls back on error", fn: func(tx *sql.Tx) error { return ErrDuplicate }, err: ErrDuplicate},
+		{name: "rolls back on panic", fn: func(tx *sql.Tx) error { panic("boom") }, panic: "boom"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database, mock := newMock(t)
+			mock.ExpectBegin()
+			if tt.commit {
+				mock.ExpectCommit()
+			} else {
+				mock.ExpectRollback()
+			}
+
+			defer func() {
+				if p := recover(); p != tt.panic {
+					t.Errorf("recovered %v, want %v", p, tt.panic)
+				}
+			}()
+			if err := WithTx(ctx, database, tt.fn); !errors.Is(err, tt.err) {
+				t.Errorf("err = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestWritesRollBackWhenReadBackFails(t *testing.T) {
+	title := "Dune Messiah"
+
+	tests := []struct {
+		name   string
+		expect func(mock sqlmock.Sqlmock)
+		write  func(database *sql.DB) error
+	}{
+		{
+			name: "create",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectExec(regexp.QuoteMeta("INSERT INTO books")).WillReturnResult(sqlmock.NewResult(1, 1))
+			},
+			write: func(database *sql.DB) error {
+				_, err := CreateBook(ctx, database, models.CreateBookRequest{Title: "Dune", Author: "Frank Herbert", PublishedYear: 1965}, 0)
+				return err
+			},
+		},
+		{
+			name: "update",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(regexp.QuoteMeta("FROM books WHERE id = ? FOR UPDATE")).WithArgs(1).WillReturnRows(bookRows(testBook()))
+				mock.ExpectExec(regexp.QuoteMeta("UPDATE books SET title = ?")).WillReturnResult(sqlmock.NewResult(0, 1))
+			},
+			write: func(database *sql.DB) error {
+				_, _, err := UpdateBook(ctx, database, 1, models.UpdateBookRequest{Title: &title}, nil)
+				return err
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database, mock := newMock(t)
+			mock.ExpectBegin()
+			tt.expect(mock)
+			mock.ExpectQuery(regexp.QuoteMeta("FROM books WHERE id = ?")).WithArgs(1).WillReturnError(sql.ErrConnDone)
+			mock.ExpectRollback()
+
+			if err := tt.write(database); err == nil {
+				t.Error("the write succeeded without reading the book back")
+			}
+		})
+	}
+}
+
+func TestUpdateBookWithoutWriting(t *testing.T) {
+	// Both are decided on the locked row, and nothing is written
+	tests := []struct {
+		name string
+		rows *sqlmock.Rows
+		want error
+	}{
+		{"not found", bookRows(), ErrNotFound},
+		{"precondition failed", bookRows(testBook()), ErrPreconditionFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database, mock := newMock(t)
+			mock.ExpectBegin()
+			mock.ExpectQuery(regexp.QuoteMeta("FROM books WHERE id = ? FOR UPDATE")).WithArgs(1).WillReturnRows(tt.rows)
+			mock.ExpectRollback()
+
+			title := "Dune Messiah"
+			stale := func(*models.Book) bool { return false }
+			book, _, err := UpdateBook(ctx, database, 1, models.UpdateBookRequest{Title: &title}, stale)
+			if err != tt.want || book != nil {
+				t.Errorf("UpdateBook = %v, %v; want nil, %v", book, err, tt.want)
+			}
+		})
+	}
+}
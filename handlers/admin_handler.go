@@ -0,0 +1,192 @@
+package handlers
+
+import (
+	"database/sql"
+	"library-api/db"
+	"library-api/models"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+type AdminHandler struct {
+	db    *sql.DB
+	pages pageLimits
+
+	// books validates stored books with the same rules, and the same
+	// configuration, as new ones
+	books *BookHandler
+}
+
+func NewAdminHandler(database *sql.DB, books *BookHandler) *AdminHandler {
+	return &AdminHandler{db: database, pages: pageLimitsFromEnv(), books: books}
+}
+
+// ExplainSearch handles GET /api/v1/admin/explain
+func (h *AdminHandler) ExplainSearch(w http.ResponseWriter, r *http.Request) {
+	searchQuery := strings.TrimSpace(r.URL.Query().Get("q"))
+	if searchQuery == "" {
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgSearchRequired))
+		return
+	}
+
+	page, limit := h.pages.parsePagination(r)
+
+	plan, err := db.ExplainSearch(r.Context(), h.db, searchQuery, page, limit)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to explain search query")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgExplainSearchFailed))
+		return
+	}
+
+	response := models.APIResponse{
+		Success: true,
+		Data:    plan,
+	}
+
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// DiagnoseQueries handles GET /api/v1/admin/diagnostics/queries
+func (h *AdminHandler) DiagnoseQueries(w http.ResponseWriter, r *http.Request) {
+	diagnostics, err := db.DiagnoseQueries(r.Context(), h.db)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to diagnose queries")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgDiagnoseQueriesFailed))
+		return
+	}
+
+	response := models.APIResponse{
+		Success: true,
+		Data:    diagnostics,
+	}
+
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// ValidateAll handles GET /api/v1/admin/validate-all, checking every stored
+// book against the rules a new book must pass, including the ISBN checksum
+// and the configured author format and genres
+func (h *AdminHandler) ValidateAll(w http.ResponseWriter, r *http.Request) {
+	report := models.ValidationReport{
+		Invalid: []models.InvalidBookInfo{},
+	}
+	lang := requestLanguage(r)
+
+	err := db.ForEachBook(r.Context(), h.db, db.BookFilter{}, func(book models.Book) error {
+		report.Checked++
+		req := models.CreateBookRequest{
+			Title:         book.Title,
+			Author:        book.Author,
+			ISBN:          book.ISBN,
+			Genre:         book.Genre,
+			PublishedYear: book.PublishedYear,
+			Available:     &book.Available,
+		}
+		if violations := h.books.validateCreate(&req); len(violations) > 0 {
+			info := models.InvalidBookInfo{ID: book.ID}
+			for _, violation := range violations {
+				info.Violations = append(info.Violations, violation.msg.localize(lang))
+			}
+			report.Invalid = append(report.Invalid, info)
+		}
+		return nil
+	})
+	if err != nil {
+		logrus.WithError(err).Error("Failed to validate books")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgValidateBooksFailed))
+		return
+	}
+
+	response := models.APIResponse{
+		Success: true,
+		Data:    report,
+	}
+
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// HealthReport handles GET /api/v1/admin/health-report
+func (h *AdminHandler) HealthReport(w http.ResponseWriter, r *http.Request) {
+	report, err := db.GetCatalogHealth(r.Context(), h.db, minPublishedYear, maxPublishedYear)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to compute catalog health report")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgHealthReportFailed))
+		return
+	}
+
+	response := models.APIResponse{
+		Success: true,
+		Data:    report,
+	}
+
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// snapshotNamePattern restricts snapshot names to characters safe in a URL path
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,100}$`)
+
+// CreateSnapshot handles POST /api/v1/admin/snapshot
+func (h *AdminHandler) CreateSnapshot(w http.ResponseWriter, r *http.Request) {
+	var req models.CreateSnapshotRequest
+
+	if !decodeJSONBody(w, r, &req, false) {
+		return
+	}
+
+	if !snapshotNamePattern.MatchString(req.Name) {
+		sendErrorResponse(w, r, http.StatusUnprocessableEntity, newMessage(msgInvalidSnapshotName))
+		return
+	}
+
+	snapshot, err := db.CreateSnapshot(r.Context(), h.db, req.Name)
+	if err == db.ErrSnapshotExists {
+		sendErrorResponse(w, r, http.StatusConflict, newMessage(msgSnapshotExists))
+		return
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("snapshot", req.Name).Error("Failed to create snapshot")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgCreateSnapshotFailed))
+		return
+	}
+
+	response := models.APIResponse{
+		Success: true,
+		Data:    snapshot,
+		Message: "Snapshot created successfully",
+	}
+
+	sendJSONResponse(w, http.StatusCreated, response)
+}
+
+// RestoreSnapshot handles POST /api/v1/admin/snapshot/{name}/restore
+func (h *AdminHandler) RestoreSnapshot(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	restored, err := db.RestoreSnapshot(r.Context(), h.db, name)
+	if err == sql.ErrNoRows {
+		sendErrorResponse(w, r, http.StatusNotFound, newMessage(msgSnapshotNotFound))
+		return
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("snapshot", name).Error("Failed to restore snapshot")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgRestoreSnapshotFailed))
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"snapshot": name,
+		"books":    restored,
+	}).Info("Catalog restored from snapshot")
+
+	response := models.APIResponse{
+		Success: true,
+		Data:    map[string]int{"restored": restored},
+		Message: "Snapshot restored successfully",
+	}
+
+	sendJSONResponse(w, http.StatusOK, response)
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"fmt"
+	"library-api/models"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestValidateAll(t *testing.T) {
+	t.Setenv("AUTHOR_FORMAT", "last_first")
+	t.Setenv("BOOK_GENRES", "fiction,poetry")
+
+	tests := []struct {
+		name   string
+		change func(*models.Book)
+		want   string // violations in English, or "[]" for a valid book
+	}{
+		{"valid", func(*models.Book) {}, "[]"},
+		{"ISBN checksum", func(b *models.Book) { b.ISBN = "9780306406158" }, "[ISBN must be a valid ISBN-10 or ISBN-13]"},
+		{"author format", func(b *models.Book) { b.Author = "Frank Herbert" }, `[Author must be in "Last, First" format, e.g. "Tolkien, J. R. R."]`},
+		{"genre not allowed", func(b *models.Book) { b.Genre = "cookbook" }, "[Genre must be one of: fiction, poetry]"},
+		{"year out of range", func(b *models.Book) { b.PublishedYear = 999 }, "[Published year must be between 1000 and 2100]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer database.Close()
+
+			book := storedBook()
+			book.Author = "Herbert, Frank"
+			book.ISBN = "9780306406157"
+			book.Genre = "fiction"
+			tt.change(&book)
+			mock.ExpectQuery(regexp.QuoteMeta("FROM books ORDER BY id")).WillReturnRows(bookRows(book))
+
+			h := NewAdminHandler(database, NewBookHandler(newFakeRepository()))
+			rec := serve(h.ValidateAll, "GET", "/api/v1/admin/validate-all", "", nil)
+
+			var report models.ValidationReport
+			decodeData(t, rec, &report)
+			if report.Checked != 1 {
+				t.Errorf("checked = %d, want 1", report.Checked)
+			}
+			got := "[]"
+			if len(report.Invalid) > 0 {
+				got = fmt.Sprint(report.Invalid[0].Violations)
+			}
+			if got != tt.want {
+				t.Errorf("violations = %s, want %s", got, tt.want)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
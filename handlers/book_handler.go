@@ -1,213 +1,1171 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
+	"encoding/csv"
 	"encoding/json"
 	"library-api/db"
 	"library-api/models"
-	"math"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
 )
 
 type BookHandler struct {
-	db *sql.DB
+	books BookRepository
+
+	// reads coalesces identical concurrent reads; nil when disabled
+	reads *singleflight.Group
+
+	maxSearchLength int
+
+	// searchCountOnlyThreshold returns only the match count for searches
+	// matching more books than this, unless forced; 0 disables it
+	searchCountOnlyThreshold int
+
+	// maxBooksPerAuthor caps how many books an author can have; 0 is unlimited
+	maxBooksPerAuthor int
+
+	// maxFeatured caps how many books can be featured at once; 0 is unlimited
+	maxFeatured      int
+	featuredOrderBy  string
+	featuredOrderAsc bool
+
+	// rejectEmptyUpdates returns 400 for updates with no fields instead of
+	// treating them as a no-op
+	rejectEmptyUpdates bool
+
+	// trackAccess records each book's last access time when it is fetched
+	trackAccess bool
+
+	// countTotals counts the matching books for list pagination unless the
+	// request passes count=false; when false, counting is opt-in
+	countTotals bool
+
+	// requireLastFirstAuthors rejects authors not written as "Last, First"
+	requireLastFirstAuthors bool
+
+	// allowedGenres restricts book genres to this set; nil allows any genre
+	allowedGenres map[string]bool
+
+	pages pageLimits
+}
+
+func NewBookHandler(books BookRepository) *BookHandler {
+	h := &BookHandler{
+		books:           books,
+		maxSearchLength: 100,
+		maxFeatured:     10,
+		featuredOrderBy: "updated_at",
+		countTotals:     true,
+		pages:           pageLimitsFromEnv(),
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"default_limit": h.pages.defaultLimit,
+		"max_limit":     h.pages.maxLimit,
+	}).Info("Page limits")
+
+	if v, err := strconv.Atoi(os.Getenv("SEARCH_MAX_LENGTH")); err == nil && v > 0 {
+		h.maxSearchLength = v
+	}
+
+	if v, err := strconv.Atoi(os.Getenv("SEARCH_COUNT_ONLY_THRESHOLD")); err == nil && v > 0 {
+		h.searchCountOnlyThreshold = v
+	}
+
+	if v, err := strconv.Atoi(os.Getenv("MAX_BOOKS_PER_AUTHOR")); err == nil && v > 0 {
+		h.maxBooksPerAuthor = v
+	}
+
+	if v, err := strconv.Atoi(os.Getenv("FEATURED_LIMIT")); err == nil && v >= 0 {
+		h.maxFeatured = v
+	}
+
+	if orderBy := os.Getenv("FEATURED_ORDER_BY"); orderBy != "" {
+		if db.IsFeaturedOrderColumn(orderBy) {
+			h.featuredOrderBy = orderBy
+		} else {
+			logrus.Warnf("Unknown FEATURED_ORDER_BY %q, using %s", orderBy, h.featuredOrderBy)
+		}
+	}
+	h.featuredOrderAsc = strings.EqualFold(os.Getenv("FEATURED_ORDER"), "asc")
+
+	switch mode := os.Getenv("EMPTY_UPDATE_MODE"); mode {
+	case "", "noop":
+	case "reject":
+		h.rejectEmptyUpdates = true
+	default:
+		logrus.Warnf("Unknown EMPTY_UPDATE_MODE %q, using noop", mode)
+	}
+
+	switch format := os.Getenv("AUTHOR_FORMAT"); format {
+	case "", "any":
+	case "last_first":
+		h.requireLastFirstAuthors = true
+	default:
+		logrus.Warnf("Unknown AUTHOR_FORMAT %q, using any", format)
+	}
+
+	if genres := os.Getenv("BOOK_GENRES"); genres != "" {
+		h.allowedGenres = make(map[string]bool)
+		for _, genre := range strings.Split(genres, ",") {
+			if genre = normalizeGenre(genre); genre != "" {
+				h.allowedGenres[genre] = true
+			}
+		}
+	}
+
+	h.trackAccess, _ = strconv.ParseBool(os.Getenv("TRACK_BOOK_ACCESS"))
+
+	if v, err := strconv.ParseBool(os.Getenv("LIST_COUNT_TOTAL")); err == nil {
+		h.countTotals = v
+	}
+
+	if dedupe, _ := strconv.ParseBool(os.Getenv("DEDUPLICATE_READS")); dedupe {
+		h.reads = &singleflight.Group{}
+		logrus.Info("Read request deduplication enabled")
+	}
+
+	return h
 }
 
-func NewBookHandler(database *sql.DB) *BookHandler {
-	return &BookHandler{db: database}
+// exportColumns is the CSV header row of the catalog export. Besides the
+// columns an import reads, it has id and created_at, which imports skip.
+var exportColumns = []string{"id", "title", "author", "published_year", "available", "isbn", "genre", "created_at"}
+
+// bookPage holds the result of a list query so it can be shared between
+// coalesced callers.
+type bookPage struct {
+	books     []models.Book
+	total     int
+	maxScore  *float64
+	countOnly bool
 }
 
 // GetBooks handles GET /api/v1/books
 func (h *BookHandler) GetBooks(w http.ResponseWriter, r *http.Request) {
 	// Parse query parameters
-	pageStr := r.URL.Query().Get("page")
-	limitStr := r.URL.Query().Get("limit")
+	page, limit := h.pages.parsePagination(r)
 	searchQuery := strings.TrimSpace(r.URL.Query().Get("q"))
 
-	// Set defaults
-	page := 1
-	limit := 10
+	if utf8.RuneCountInString(searchQuery) > h.maxSearchLength {
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgSearchTooLong, h.maxSearchLength))
+		return
+	}
 
-	// Parse page
-	if pageStr != "" {
-		if p, err := strconv.Atoi(pageStr); err == nil && p > 0 {
-			page = p
+	filter, msg := parseBookFilter(r)
+	if msg != nil {
+		sendErrorResponse(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	includeScore, _ := strconv.ParseBool(r.URL.Query().Get("include_score"))
+
+	// Unknown sort columns and directions fall back to newest first. Syncs
+	// with updated_since instead default to the oldest change first, so
+	// changes made while paging land on later pages.
+	sortBy := r.URL.Query().Get("sort")
+	descending := !strings.EqualFold(r.URL.Query().Get("order"), "asc")
+	if !db.IsBookSortColumn(sortBy) {
+		sortBy = "created_at"
+		if filter.UpdatedSince != nil {
+			sortBy = "updated_at"
+			descending = strings.EqualFold(r.URL.Query().Get("order"), "desc")
 		}
 	}
 
-	// Parse limit (max 100)
-	if limitStr != "" {
-		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 100 {
-			limit = l
+	// Title and author sorts may use a language's alphabetical order instead
+	// of the table's collation
+	collation := r.URL.Query().Get("collation")
+	if collation != "" && !db.IsSortCollation(collation) {
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgInvalidCollation, strings.Join(db.SortCollations(), ", ")))
+		return
+	}
+
+	// Cursor pagination only walks the creation order, and an empty cursor
+	// starts it
+	if r.URL.Query().Has("cursor") {
+		if searchQuery != "" || (r.URL.Query().Get("sort") != "" && sortBy != "created_at") {
+			sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgCursorUnsupported))
+			return
+		}
+		h.getBooksAfter(w, r, filter, !strings.EqualFold(r.URL.Query().Get("order"), "asc"), limit)
+		return
+	}
+
+	if stream, _ := strconv.ParseBool(r.URL.Query().Get("stream")); stream {
+		h.streamBooks(w, r, searchQuery, filter, sortBy, descending, collation, includeScore, page, limit)
+		return
+	}
+
+	countOnlyAbove := h.searchCountOnlyThreshold
+	if force, _ := strconv.ParseBool(r.URL.Query().Get("force")); force {
+		countOnlyAbove = 0
+	}
+
+	countTotal := h.countTotals
+	if v, err := strconv.ParseBool(r.URL.Query().Get("count")); err == nil {
+		countTotal = v
+	}
+
+	// Search or get all books. Every input comes from the query string, which
+	// Encode sorts into a canonical key.
+	key := "books:" + r.URL.Query().Encode()
+	result, err := h.coalesce(r.Context(), key, func(ctx context.Context) (interface{}, error) {
+		var p bookPage
+		var err error
+		if searchQuery != "" {
+			p.books, p.total, p.maxScore, err = h.books.SearchBooks(ctx, searchQuery, filter, page, limit, countOnlyAbove, countTotal)
+			p.countOnly = countOnlyAbove > 0 && p.total > countOnlyAbove
+			if !includeScore {
+				for i := range p.books {
+					p.books[i].Score = nil
+				}
+			}
+		} else {
+			p.books, p.total, err = h.books.GetBooks(ctx, filter, sortBy, descending, collation, page, limit, countTotal)
+		}
+		return p, err
+	})
+
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get books")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgRetrieveBooksFailed))
+		return
+	}
+
+	books, total := result.(bookPage).books, result.(bookPage).total
+
+	if result.(bookPage).countOnly {
+		lang := requestLanguage(r)
+		w.Header().Set("Content-Language", lang)
+		notice := newMessage(msgSearchTooBroad, countOnlyAbove)
+		response := models.APIResponse{
+			Success: true,
+			Data:    models.SearchCount{Total: total, Threshold: countOnlyAbove},
+			Message: notice.localize(lang),
+			Code:    notice.code,
+		}
+		sendJSONResponse(w, http.StatusOK, response)
+		return
+	}
+
+	// Without a total, the extra book fetched past the page shows whether
+	// another page follows
+	pagination := newPagination(page, limit, total)
+	if total < 0 {
+		pagination.HasNext = len(books) > limit
+		if pagination.HasNext {
+			books = books[:limit]
+		}
+	}
+	pagination.MaxScore = result.(bookPage).maxScore
+
+	response := models.PaginatedResponse{
+		Success:    true,
+		Data:       books,
+		Pagination: pagination,
+	}
+
+	setPaginationLinks(w, r, response.Pagination)
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// getBooksAfter writes the page of books following the request's cursor
+func (h *BookHandler) getBooksAfter(w http.ResponseWriter, r *http.Request, filter db.BookFilter, descending bool, limit int) {
+	var after *db.BookCursor
+	if token := r.URL.Query().Get("cursor"); token != "" {
+		cursor, err := db.ParseBookCursor(token)
+		if err != nil {
+			sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgInvalidCursor))
+			return
+		}
+		after = &cursor
+	}
+
+	books, next, err := h.books.GetBooksAfter(r.Context(), filter, descending, after, limit)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get books")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgRetrieveBooksFailed))
+		return
+	}
+
+	pagination := models.Pagination{
+		Limit:        limit,
+		Total:        -1,
+		TotalPages:   -1,
+		TotalUnknown: true,
+		HasNext:      next != nil,
+	}
+	if next != nil {
+		pagination.NextCursor = next.Encode()
+	}
+
+	response := models.PaginatedResponse{
+		Success:    true,
+		Data:       books,
+		Pagination: pagination,
+	}
+
+	setPaginationLinks(w, r, response.Pagination)
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// streamFlushEvery is how many books streamBooks writes between flushes,
+// after flushing the first one immediately
+const streamFlushEvery = 20
+
+// streamBooks writes a page of books as a bare JSON array, flushing as rows
+// arrive so clients can render early results while later rows are fetched
+func (h *BookHandler) streamBooks(w http.ResponseWriter, r *http.Request, searchQuery string, filter db.BookFilter,
+	sortBy string, descending bool, collation string, includeScore bool, page, limit int) {
+	flusher, _ := w.(http.Flusher)
+	written := 0
+
+	err := h.books.StreamBooks(r.Context(), searchQuery, filter, sortBy, descending, collation, page, limit, func(book models.Book) error {
+		if !includeScore {
+			book.Score = nil
+		}
+		data, err := json.Marshal(book)
+		if err != nil {
+			return err
+		}
+
+		if written == 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("["))
+		} else {
+			w.Write([]byte(","))
+		}
+		w.Write(data)
+		written++
+
+		if flusher != nil && (written == 1 || written%streamFlushEvery == 0) {
+			flusher.Flush()
+		}
+		return nil
+	})
+
+	if err != nil {
+		logrus.WithError(err).Error("Failed to stream books")
+		if written == 0 {
+			sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgRetrieveBooksFailed))
+			return
+		}
+		// The status is already sent; abort the connection so the client
+		// sees a truncated response rather than a short, valid array
+		panic(http.ErrAbortHandler)
+	}
+
+	if written == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("[]"))
+		return
+	}
+	w.Write([]byte("]"))
+}
+
+// CountBooks handles GET /api/v1/books/count, counting the books List Books
+// would return for the same search and filters without fetching them
+func (h *BookHandler) CountBooks(w http.ResponseWriter, r *http.Request) {
+	searchQuery := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	if utf8.RuneCountInString(searchQuery) > h.maxSearchLength {
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgSearchTooLong, h.maxSearchLength))
+		return
+	}
+
+	filter, msg := parseBookFilter(r)
+	if msg != nil {
+		sendErrorResponse(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	count, err := h.books.CountBooks(r.Context(), searchQuery, filter)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to count books")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgCountBooksFailed))
+		return
+	}
+
+	response := models.APIResponse{
+		Success: true,
+		Data:    models.BookCount{Count: count},
+	}
+
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// GetRandomBook handles GET /api/v1/books/random, picking a random book
+// matching the list filters. Only available books are picked unless the
+// request sets available itself.
+func (h *BookHandler) GetRandomBook(w http.ResponseWriter, r *http.Request) {
+	filter, msg := parseBookFilter(r)
+	if msg != nil {
+		sendErrorResponse(w, r, http.StatusBadRequest, msg)
+		return
+	}
+	if filter.Available == nil {
+		available := true
+		filter.Available = &available
+	}
+
+	book, err := h.books.GetRandomBook(r.Context(), filter)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get random book")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgRetrieveBookFailed))
+		return
+	}
+
+	// Each request should get a new pick
+	w.Header().Set("Cache-Control", "no-store")
+
+	if book == nil {
+		sendErrorResponse(w, r, http.StatusNotFound, newMessage(msgNoMatchingBooks))
+		return
+	}
+
+	response := models.APIResponse{
+		Success: true,
+		Data:    book,
+	}
+
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// GetYearCounts handles GET /api/v1/books/years
+func (h *BookHandler) GetYearCounts(w http.ResponseWriter, r *http.Request) {
+	searchQuery := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	if utf8.RuneCountInString(searchQuery) > h.maxSearchLength {
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgSearchTooLong, h.maxSearchLength))
+		return
+	}
+
+	filter, msg := parseBookFilter(r)
+	if msg != nil {
+		sendErrorResponse(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	years, err := h.books.GetYearCounts(r.Context(), searchQuery, filter)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get year counts")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgRetrieveYearCountsFailed))
+		return
+	}
+
+	response := models.APIResponse{
+		Success: true,
+		Data:    years,
+	}
+
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// GetAvailabilityChanges handles GET /api/v1/books/availability-changes
+func (h *BookHandler) GetAvailabilityChanges(w http.ResponseWriter, r *http.Request) {
+	sinceStr := r.URL.Query().Get("since")
+	if sinceStr == "" {
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgParamRequired, "since"))
+		return
+	}
+
+	since, err := time.Parse(time.RFC3339, sinceStr)
+	if err != nil {
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgInvalidTimestamp, "since"))
+		return
+	}
+
+	page, limit := h.pages.parsePagination(r)
+
+	books, total, err := h.books.GetAvailabilityChanges(r.Context(), since, page, limit)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get availability changes")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgRetrieveChangesFailed))
+		return
+	}
+
+	response := models.PaginatedResponse{
+		Success:    true,
+		Data:       books,
+		Pagination: newPagination(page, limit, total),
+	}
+
+	setPaginationLinks(w, r, response.Pagination)
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// GetStaleBooks handles GET /api/v1/books/stale
+func (h *BookHandler) GetStaleBooks(w http.ResponseWriter, r *http.Request) {
+	beforeStr := r.URL.Query().Get("before")
+	if beforeStr == "" {
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgParamRequired, "before"))
+		return
+	}
+
+	before, err := time.Parse(time.RFC3339, beforeStr)
+	if err != nil {
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgInvalidTimestamp, "before"))
+		return
+	}
+
+	page, limit := h.pages.parsePagination(r)
+
+	books, total, err := h.books.GetStaleBooks(r.Context(), before, page, limit)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get stale books")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgRetrieveStaleBooksFailed))
+		return
+	}
+
+	response := models.PaginatedResponse{
+		Success:    true,
+		Data:       books,
+		Pagination: newPagination(page, limit, total),
+	}
+
+	setPaginationLinks(w, r, response.Pagination)
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// GetBookMatrix handles GET /api/v1/books/matrix
+func (h *BookHandler) GetBookMatrix(w http.ResponseWriter, r *http.Request) {
+	rowColumn := r.URL.Query().Get("rows")
+	colColumn := r.URL.Query().Get("cols")
+
+	if !db.IsMatrixDimension(rowColumn) || !db.IsMatrixDimension(colColumn) {
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgInvalidMatrixDimension))
+		return
+	}
+	if rowColumn == colColumn {
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgSameMatrixDimension))
+		return
+	}
+
+	matrix, err := h.books.CountMatrix(r.Context(), rowColumn, colColumn)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get book matrix")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgRetrieveMatrixFailed))
+		return
+	}
+
+	response := models.APIResponse{
+		Success: true,
+		Data:    matrix,
+	}
+
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// GetFeaturedBooks handles GET /api/v1/books/featured
+func (h *BookHandler) GetFeaturedBooks(w http.ResponseWriter, r *http.Request) {
+	books, err := h.books.GetFeaturedBooks(r.Context(), h.featuredOrderBy, !h.featuredOrderAsc)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get featured books")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgRetrieveFeaturedFailed))
+		return
+	}
+
+	if books == nil {
+		books = []models.Book{}
+	}
+
+	response := models.APIResponse{
+		Success: true,
+		Data:    books,
+	}
+
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// FeatureBook handles POST /api/v1/books/{id}/feature
+func (h *BookHandler) FeatureBook(w http.ResponseWriter, r *http.Request) {
+	h.setFeatured(w, r, true)
+}
+
+// UnfeatureBook handles POST /api/v1/books/{id}/unfeature
+func (h *BookHandler) UnfeatureBook(w http.ResponseWriter, r *http.Request) {
+	h.setFeatured(w, r, false)
+}
+
+func (h *BookHandler) setFeatured(w http.ResponseWriter, r *http.Request, featured bool) {
+	vars := mux.Vars(r)
+	idStr := vars["id"]
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgInvalidBookID))
+		return
+	}
+
+	book, err := h.books.SetFeatured(r.Context(), id, featured, h.maxFeatured)
+	if err == db.ErrFeaturedLimitReached {
+		sendErrorResponse(w, r, http.StatusConflict, newMessage(msgFeaturedLimitReached, h.maxFeatured))
+		return
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("book_id", id).Error("Failed to update featured flag")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgUpdateBookFailed))
+		return
+	}
+
+	if book == nil {
+		sendErrorResponse(w, r, http.StatusNotFound, newMessage(msgBookNotFound))
+		return
+	}
+
+	message := "Book featured successfully"
+	if !featured {
+		message = "Book unfeatured successfully"
+	}
+
+	response := models.APIResponse{
+		Success: true,
+		Data:    book,
+		Message: message,
+	}
+
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// GetImportTemplate handles GET /api/v1/books/import-template.csv. Its
+// header row lists every column ImportBooks accepts.
+func (h *BookHandler) GetImportTemplate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="books-import-template.csv"`)
+	w.WriteHeader(http.StatusOK)
+
+	writer := csv.NewWriter(w)
+	writer.Write(importCSVColumns)
+	writer.Flush()
+
+	if err := writer.Error(); err != nil {
+		logrus.WithError(err).Error("Failed to write import template")
+	}
+}
+
+// ExportBooks handles GET /api/v1/books/export, sending the whole catalog
+// in ID order as CSV (the default) or, with format=json, as a JSON array.
+// Rows are written as they are read so memory use doesn't grow with the
+// catalog.
+func (h *BookHandler) ExportBooks(w http.ResponseWriter, r *http.Request) {
+	h.exportBooks(w, r, r.URL.Query().Get("format"), db.BookFilter{})
+}
+
+// ExportMatchingBooks handles POST /api/v1/books/export. It exports like
+// ExportBooks, but only the books matching the filter in the JSON body, so
+// the download holds the subset a client searched for. The body also
+// selects the format; an empty one exports the whole catalog as CSV.
+func (h *BookHandler) ExportMatchingBooks(w http.ResponseWriter, r *http.Request) {
+	var req models.ExportBooksRequest
+	if !decodeJSONBody(w, r, &req, true) {
+		return
+	}
+
+	filter, msg := exportFilter(req.Filter)
+	if msg != nil {
+		sendErrorResponse(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	h.exportBooks(w, r, req.Format, filter)
+}
+
+// exportFilter converts an export request's filter to a BookFilter,
+// returning an error message for the first invalid field. The fields mean
+// what the List Books parameters of the same names do.
+func exportFilter(req models.ExportFilter) (db.BookFilter, *message) {
+	filter := db.BookFilter{
+		Genre:     normalizeGenre(req.Genre),
+		Author:    strings.TrimSpace(req.Author),
+		Available: req.Available,
+		YearMin:   req.YearMin,
+		YearMax:   req.YearMax,
+	}
+
+	if utf8.RuneCountInString(filter.Author) > maxTextLength {
+		return filter, newMessage(msgParamTooLong, "author", maxTextLength)
+	}
+	if filter.YearMin != nil && filter.YearMax != nil && *filter.YearMin > *filter.YearMax {
+		return filter, newMessage(msgYearRangeInverted)
+	}
+
+	return filter, nil
+}
+
+// exportBooks streams the books matching filter in ID order as CSV (the
+// default) or JSON
+func (h *BookHandler) exportBooks(w http.ResponseWriter, r *http.Request, format string, filter db.BookFilter) {
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "json" {
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgInvalidExportFormat))
+		return
+	}
+
+	// A large catalog can take longer to send than the server's write
+	// timeout allows
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		logrus.WithError(err).Debug("Export keeps the server write timeout")
+	}
+
+	// Headers are only sent with the first book, so a query that fails
+	// straight away still gets an error response
+	started := false
+	start := func() {
+		started = true
+		if format == "csv" {
+			w.Header().Set("Content-Type", "text/csv")
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.Header().Set("Content-Disposition", `attachment; filename="books.`+format+`"`)
+		w.WriteHeader(http.StatusOK)
+	}
+
+	var err error
+	if format == "csv" {
+		writer := csv.NewWriter(w)
+		err = h.books.ForEachBook(r.Context(), filter, func(book models.Book) error {
+			if !started {
+				start()
+				writer.Write(exportColumns)
+			}
+			writer.Write([]string{
+				strconv.Itoa(book.ID),
+				book.Title,
+				book.Author,
+				strconv.Itoa(book.PublishedYear),
+				strconv.FormatBool(book.Available),
+				book.ISBN,
+				book.Genre,
+				book.CreatedAt.UTC().Format(time.RFC3339),
+			})
+			return writer.Error()
+		})
+		if err == nil {
+			if !started {
+				start()
+				writer.Write(exportColumns)
+			}
+			writer.Flush()
+			err = writer.Error()
+		}
+	} else {
+		err = h.books.ForEachBook(r.Context(), filter, func(book models.Book) error {
+			data, err := json.Marshal(book)
+			if err != nil {
+				return err
+			}
+			if !started {
+				start()
+				w.Write([]byte("["))
+			} else {
+				w.Write([]byte(","))
+			}
+			_, err = w.Write(data)
+			return err
+		})
+		if err == nil {
+			if !started {
+				start()
+				w.Write([]byte("[]"))
+			} else {
+				w.Write([]byte("]"))
+			}
+		}
+	}
+
+	if err != nil {
+		logrus.WithError(err).Error("Failed to export books")
+		if !started {
+			sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgExportBooksFailed))
+			return
+		}
+		// As in streamBooks, abort so the client sees a truncated download
+		// rather than a short, valid file
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// GetBook handles GET /api/v1/books/{id}
+func (h *BookHandler) GetBook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	idStr := vars["id"]
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgInvalidBookID))
+		return
+	}
+
+	result, err := h.coalesce(r.Context(), "book:"+strconv.Itoa(id), func(ctx context.Context) (interface{}, error) {
+		return h.books.GetBookByID(ctx, id)
+	})
+	if err != nil {
+		logrus.WithError(err).WithField("book_id", id).Error("Failed to get book")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgRetrieveBookFailed))
+		return
+	}
+
+	book := result.(*models.Book)
+	if book == nil {
+		sendErrorResponse(w, r, http.StatusNotFound, newMessage(msgBookNotFound))
+		return
+	}
+
+	// A failure to record the access shouldn't fail the read
+	if h.trackAccess {
+		if err := h.books.TouchBook(r.Context(), id); err != nil {
+			logrus.WithError(err).WithField("book_id", id).Warn("Failed to record book access")
 		}
 	}
 
-	var books []models.Book
-	var total int
-	var err error
-
-	// Search or get all books
-	if searchQuery != "" {
-		books, total, err = db.SearchBooks(h.db, searchQuery, page, limit)
-	} else {
-		books, total, err = db.GetBooks(h.db, page, limit)
+	// Let clients that already have this version skip the body
+	etag := bookETag(book)
+	if etag != "" {
+		w.Header().Set("ETag", etag)
 	}
-
-	if err != nil {
-		logrus.WithError(err).Error("Failed to get books")
-		h.sendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve books")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
-	// Calculate pagination
-	totalPages := int(math.Ceil(float64(total) / float64(limit)))
-
-	response := models.PaginatedResponse{
+	response := models.APIResponse{
 		Success: true,
-		Data:    books,
-		Pagination: models.Pagination{
-			Page:       page,
-			Limit:      limit,
-			Total:      total,
-			TotalPages: totalPages,
-		},
+		Data:    book,
 	}
 
-	h.sendJSONResponse(w, http.StatusOK, response)
+	sendJSONResponse(w, http.StatusOK, response)
 }
 
-// GetBook handles GET /api/v1/books/{id}
-func (h *BookHandler) GetBook(w http.ResponseWriter, r *http.Request) {
+// GetBookEditions handles GET /api/v1/books/{id}/editions
+func (h *BookHandler) GetBookEditions(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	idStr := vars["id"]
 
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		h.sendErrorResponse(w, http.StatusBadRequest, "Invalid book ID")
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgInvalidBookID))
 		return
 	}
 
-	book, err := db.GetBookByID(h.db, id)
+	book, err := h.books.GetBookByID(r.Context(), id)
 	if err != nil {
 		logrus.WithError(err).WithField("book_id", id).Error("Failed to get book")
-		h.sendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve book")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgRetrieveBookFailed))
 		return
 	}
 
 	if book == nil {
-		h.sendErrorResponse(w, http.StatusNotFound, "Book not found")
+		sendErrorResponse(w, r, http.StatusNotFound, newMessage(msgBookNotFound))
+		return
+	}
+
+	editions, err := h.books.GetEditions(r.Context(), book)
+	if err != nil {
+		logrus.WithError(err).WithField("book_id", id).Error("Failed to get editions")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgRetrieveEditionsFailed))
 		return
 	}
 
+	if editions == nil {
+		editions = []models.Book{}
+	}
+
 	response := models.APIResponse{
 		Success: true,
-		Data:    book,
+		Data: models.BookEditions{
+			Book:     book,
+			Editions: editions,
+		},
 	}
 
-	h.sendJSONResponse(w, http.StatusOK, response)
+	sendJSONResponse(w, http.StatusOK, response)
 }
 
-// CreateBook handles POST /api/v1/books
+// CreateBook handles POST /api/v1/books. The body is either a single book or
+// an array of books, which are created together.
 func (h *BookHandler) CreateBook(w http.ResponseWriter, r *http.Request) {
+	body, ok := readRequestBody(w, r)
+	if !ok {
+		return
+	}
+
+	if trimmed := bytes.TrimLeft(body, " \t\r\n"); len(trimmed) > 0 && trimmed[0] == '[' {
+		h.createBooks(w, r, body)
+		return
+	}
+
 	var req models.CreateBookRequest
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.sendErrorResponse(w, http.StatusBadRequest, "Invalid JSON payload")
+	if err := decodeJSON(body, &req); err != nil {
+		sendErrorResponse(w, r, http.StatusBadRequest, decodeErrorMessage(err))
 		return
 	}
 
 	// Basic validation
-	if strings.TrimSpace(req.Title) == "" {
-		h.sendErrorResponse(w, http.StatusBadRequest, "Title is required")
+	if violations := h.validateCreate(&req); len(violations) > 0 {
+		sendValidationError(w, r, violations[0].msg, violations)
+		return
+	}
+
+	book, err := h.books.CreateBook(r.Context(), req, h.maxBooksPerAuthor)
+	if err == db.ErrAuthorLimitReached {
+		h.sendAuthorLimitResponse(w, r)
+		return
+	}
+	if err == db.ErrDuplicate {
+		sendDuplicateResponse(w, r)
+		return
+	}
+	if err != nil {
+		logrus.WithError(err).Error("Failed to create book")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgCreateBookFailed))
+		return
+	}
+
+	setAvailabilityDefaulted(w, req)
+	sendCreatedBook(w, r, book, "Book created successfully")
+}
+
+// CreateBooksBulk handles POST /api/v1/books/bulk. The body must be an array
+// of books, which are created together.
+func (h *BookHandler) CreateBooksBulk(w http.ResponseWriter, r *http.Request) {
+	body, ok := readRequestBody(w, r)
+	if !ok {
+		return
+	}
+
+	h.createBooks(w, r, body)
+}
+
+// maxBatchCreate caps how many books a single request can create, keeping
+// the multi-row insert well under MySQL's placeholder limit
+const maxBatchCreate = 1000
+
+// createBooks creates every book in a JSON array body, or none of them if
+// any is invalid
+func (h *BookHandler) createBooks(w http.ResponseWriter, r *http.Request, body []byte) {
+	var reqs []models.CreateBookRequest
+
+	if err := decodeJSON(body, &reqs); err != nil {
+		sendErrorResponse(w, r, http.StatusBadRequest, decodeErrorMessage(err))
 		return
 	}
-	if strings.TrimSpace(req.Author) == "" {
-		h.sendErrorResponse(w, http.StatusBadRequest, "Author is required")
+
+	if len(reqs) == 0 {
+		sendErrorResponse(w, r, http.StatusUnprocessableEntity, newMessage(msgEmptyBatch))
 		return
 	}
-	if req.PublishedYear < 1000 || req.PublishedYear > 2100 {
-		h.sendErrorResponse(w, http.StatusBadRequest, "Published year must be between 1000 and 2100")
+	if len(reqs) > maxBatchCreate {
+		sendErrorResponse(w, r, http.StatusUnprocessableEntity, newMessage(msgBatchTooLarge, maxBatchCreate))
 		return
 	}
 
-	// Trim whitespace
-	req.Title = strings.TrimSpace(req.Title)
-	req.Author = strings.TrimSpace(req.Author)
+	for i := range reqs {
+		if violations := h.validateCreate(&reqs[i]); len(violations) > 0 {
+			sendValidationError(w, r, newMessage(msgBatchItemInvalid, i, violations[0].msg), violations)
+			return
+		}
+	}
 
-	book, err := db.CreateBook(h.db, req)
+	books, err := h.books.CreateBooks(r.Context(), reqs, h.maxBooksPerAuthor)
+	if err == db.ErrAuthorLimitReached {
+		h.sendAuthorLimitResponse(w, r)
+		return
+	}
+	if err == db.ErrDuplicate {
+		sendDuplicateResponse(w, r)
+		return
+	}
 	if err != nil {
-		logrus.WithError(err).Error("Failed to create book")
-		h.sendErrorResponse(w, http.StatusInternalServerError, "Failed to create book")
+		logrus.WithError(err).Error("Failed to create books")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgCreateBooksFailed))
+		return
+	}
+
+	if prefersMinimal(r) {
+		ids := make([]models.ResourceID, len(books))
+		for i, book := range books {
+			ids[i] = models.ResourceID{ID: book.ID}
+		}
+		w.Header().Set("Preference-Applied", "return=minimal")
+		sendJSONResponse(w, http.StatusCreated, models.APIResponse{
+			Success: true,
+			Data:    ids,
+		})
 		return
 	}
 
 	response := models.APIResponse{
 		Success: true,
-		Data:    book,
-		Message: "Book created successfully",
+		Data:    books,
+		Message: "Books created successfully",
 	}
 
-	h.sendJSONResponse(w, http.StatusCreated, response)
+	sendJSONResponse(w, http.StatusCreated, response)
 }
 
-// UpdateBook handles PUT /api/v1/books/{id}
+// UpdateBook handles PATCH /api/v1/books/{id}, changing only the fields
+// the request sets
 func (h *BookHandler) UpdateBook(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	idStr := vars["id"]
 
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		h.sendErrorResponse(w, http.StatusBadRequest, "Invalid book ID")
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgInvalidBookID))
 		return
 	}
 
 	var req models.UpdateBookRequest
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.sendErrorResponse(w, http.StatusBadRequest, "Invalid JSON payload")
+	if !decodeJSONBody(w, r, &req, false) {
 		return
 	}
 
 	// Basic validation
-	if req.Title != nil {
-		trimmed := strings.TrimSpace(*req.Title)
-		if trimmed == "" {
-			h.sendErrorResponse(w, http.StatusBadRequest, "Title cannot be empty")
-			return
-		}
-		req.Title = &trimmed
+	if violations := h.validateUpdate(&req); len(violations) > 0 {
+		sendValidationError(w, r, violations[0].msg, violations)
+		return
 	}
 
-	if req.Author != nil {
-		trimmed := strings.TrimSpace(*req.Author)
-		if trimmed == "" {
-			h.sendErrorResponse(w, http.StatusBadRequest, "Author cannot be empty")
-			return
-		}
-		req.Author = &trimmed
+	if h.rejectEmptyUpdates && isEmptyUpdate(req) {
+		sendErrorResponse(w, r, http.StatusUnprocessableEntity, newMessage(msgNoFieldsToUpdate))
+		return
 	}
 
-	if req.PublishedYear != nil {
-		if *req.PublishedYear < 1000 || *req.PublishedYear > 2100 {
-			h.sendErrorResponse(w, http.StatusBadRequest, "Published year must be between 1000 and 2100")
-			return
+	h.writeBook(w, r, id, func(matches func(*models.Book) bool) (*models.Book, bool, error) {
+		return h.books.UpdateBook(r.Context(), id, req, matches)
+	})
+}
+
+// ReplaceBook handles PUT /api/v1/books/{id}, replacing the whole book.
+// title, author, published_year and available must all be sent; an
+// omitted isbn or genre is cleared.
+func (h *BookHandler) ReplaceBook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	idStr := vars["id"]
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgInvalidBookID))
+		return
+	}
+
+	// Decoded with pointers so omitted fields can be told apart from
+	// empty ones
+	var req models.UpdateBookRequest
+
+	if !decodeJSONBody(w, r, &req, false) {
+		return
+	}
+
+	if missing := missingReplaceFields(req); len(missing) > 0 {
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgReplaceFieldsMissing, strings.Join(missing, ", ")))
+		return
+	}
+
+	empty := ""
+	if req.ISBN == nil {
+		req.ISBN = &empty
+	}
+	if req.Genre == nil {
+		req.Genre = &empty
+	}
+
+	// Basic validation
+	if violations := h.validateUpdate(&req); len(violations) > 0 {
+		sendValidationError(w, r, violations[0].msg, violations)
+		return
+	}
+
+	replacement := models.CreateBookRequest{
+		Title:         *req.Title,
+		Author:        *req.Author,
+		ISBN:          *req.ISBN,
+		Genre:         *req.Genre,
+		PublishedYear: *req.PublishedYear,
+		Available:     req.Available,
+	}
+
+	h.writeBook(w, r, id, func(matches func(*models.Book) bool) (*models.Book, bool, error) {
+		return h.books.ReplaceBook(r.Context(), id, replacement, matches)
+	})
+}
+
+// missingReplaceFields returns the JSON names of the fields a replacement
+// must send but req doesn't
+func missingReplaceFields(req models.UpdateBookRequest) []string {
+	var missing []string
+	if req.Title == nil {
+		missing = append(missing, "title")
+	}
+	if req.Author == nil {
+		missing = append(missing, "author")
+	}
+	if req.PublishedYear == nil {
+		missing = append(missing, "published_year")
+	}
+	if req.Available == nil {
+		missing = append(missing, "available")
+	}
+	return missing
+}
+
+// writeBook applies an update or replacement of a book and sends the
+// result. With If-Match, write is only allowed to change the version of the
+// book the client has, identified by the ETag it was sent.
+func (h *BookHandler) writeBook(w http.ResponseWriter, r *http.Request, id int, write func(matches func(*models.Book) bool) (*models.Book, bool, error)) {
+	var matches func(*models.Book) bool
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		matches = func(current *models.Book) bool {
+			return etagMatchesStrong(ifMatch, bookETag(current))
 		}
 	}
 
-	book, err := db.UpdateBook(h.db, id, req)
+	book, changed, err := write(matches)
+	if err == db.ErrNotFound {
+		sendErrorResponse(w, r, http.StatusNotFound, newMessage(msgBookNotFound))
+		return
+	}
+	if err == db.ErrDuplicate {
+		sendDuplicateResponse(w, r)
+		return
+	}
+	if err == db.ErrPreconditionFailed {
+		sendErrorResponse(w, r, http.StatusPreconditionFailed, newMessage(msgBookModified))
+		return
+	}
 	if err != nil {
 		logrus.WithError(err).WithField("book_id", id).Error("Failed to update book")
-		h.sendErrorResponse(w, http.StatusInternalServerError, "Failed to update book")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgUpdateBookFailed))
 		return
 	}
 
-	if book == nil {
-		h.sendErrorResponse(w, http.StatusNotFound, "Book not found")
+	// The new version's tag, for the client's next conditional request
+	if etag := bookETag(book); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+
+	if prefersMinimal(r) {
+		w.Header().Set("Preference-Applied", "return=minimal")
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
@@ -216,8 +1174,11 @@ func (h *BookHandler) UpdateBook(w http.ResponseWriter, r *http.Request) {
 		Data:    book,
 		Message: "Book updated successfully",
 	}
+	if !changed {
+		response.Message = "No changes"
+	}
 
-	h.sendJSONResponse(w, http.StatusOK, response)
+	sendJSONResponse(w, http.StatusOK, response)
 }
 
 // DeleteBook handles DELETE /api/v1/books/{id}
@@ -227,18 +1188,18 @@ func (h *BookHandler) DeleteBook(w http.ResponseWriter, r *http.Request) {
 
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		h.sendErrorResponse(w, http.StatusBadRequest, "Invalid book ID")
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgInvalidBookID))
 		return
 	}
 
-	err = db.DeleteBook(h.db, id)
+	err = h.books.DeleteBook(r.Context(), id)
 	if err == sql.ErrNoRows {
-		h.sendErrorResponse(w, http.StatusNotFound, "Book not found")
+		sendErrorResponse(w, r, http.StatusNotFound, newMessage(msgBookNotFound))
 		return
 	}
 	if err != nil {
 		logrus.WithError(err).WithField("book_id", id).Error("Failed to delete book")
-		h.sendErrorResponse(w, http.StatusInternalServerError, "Failed to delete book")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgDeleteBookFailed))
 		return
 	}
 
@@ -247,24 +1208,338 @@ func (h *BookHandler) DeleteBook(w http.ResponseWriter, r *http.Request) {
 		Message: "Book deleted successfully",
 	}
 
-	h.sendJSONResponse(w, http.StatusOK, response)
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// PreviewUpdate handles POST /api/v1/books/{id}/preview-update
+func (h *BookHandler) PreviewUpdate(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	idStr := vars["id"]
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgInvalidBookID))
+		return
+	}
+
+	var req models.UpdateBookRequest
+
+	if !decodeJSONBody(w, r, &req, false) {
+		return
+	}
+
+	// Basic validation
+	if violations := h.validateUpdate(&req); len(violations) > 0 {
+		sendValidationError(w, r, violations[0].msg, violations)
+		return
+	}
+
+	preview, err := h.books.PreviewUpdate(r.Context(), id, req)
+	if err != nil {
+		logrus.WithError(err).WithField("book_id", id).Error("Failed to preview book update")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgPreviewUpdateFailed))
+		return
+	}
+
+	if preview == nil {
+		sendErrorResponse(w, r, http.StatusNotFound, newMessage(msgBookNotFound))
+		return
+	}
+
+	response := models.APIResponse{
+		Success: true,
+		Data:    preview,
+	}
+
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// CloneBook handles POST /api/v1/books/{id}/clone
+func (h *BookHandler) CloneBook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	idStr := vars["id"]
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgInvalidBookID))
+		return
+	}
+
+	// The body is optional; any fields present override the source book
+	var overrides models.UpdateBookRequest
+	if !decodeJSONBody(w, r, &overrides, true) {
+		return
+	}
+
+	source, err := h.books.GetBookByID(r.Context(), id)
+	if err != nil {
+		logrus.WithError(err).WithField("book_id", id).Error("Failed to get book")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgRetrieveBookFailed))
+		return
+	}
+
+	if source == nil {
+		sendErrorResponse(w, r, http.StatusNotFound, newMessage(msgBookNotFound))
+		return
+	}
+
+	// Availability is reset to the create default unless overridden, and the
+	// ISBN identifies the source edition, so it is only set if overridden
+	req := models.CreateBookRequest{
+		Title:         source.Title,
+		Author:        source.Author,
+		Genre:         source.Genre,
+		PublishedYear: source.PublishedYear,
+		Available:     overrides.Available,
+	}
+	if overrides.Title != nil {
+		req.Title = *overrides.Title
+	}
+	if overrides.Author != nil {
+		req.Author = *overrides.Author
+	}
+	if overrides.ISBN != nil {
+		req.ISBN = *overrides.ISBN
+	}
+	if overrides.Genre != nil {
+		req.Genre = *overrides.Genre
+	}
+	if overrides.PublishedYear != nil {
+		req.PublishedYear = *overrides.PublishedYear
+	}
+
+	// The clone must pass the rules a new book does, which a source stored
+	// before a rule was added may not
+	if violations := h.validateCreate(&req); len(violations) > 0 {
+		sendValidationError(w, r, violations[0].msg, violations)
+		return
+	}
+
+	book, err := h.books.CreateBook(r.Context(), req, h.maxBooksPerAuthor)
+	if err == db.ErrAuthorLimitReached {
+		h.sendAuthorLimitResponse(w, r)
+		return
+	}
+	if err == db.ErrDuplicate {
+		sendDuplicateResponse(w, r)
+		return
+	}
+	if err != nil {
+		logrus.WithError(err).WithField("book_id", id).Error("Failed to clone book")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgCloneBookFailed))
+		return
+	}
+
+	setAvailabilityDefaulted(w, req)
+	sendCreatedBook(w, r, book, "Book cloned successfully")
+}
+
+// Methods supported by the book collection and by a single book, advertised
+// in the Allow header of OPTIONS responses
+var (
+	bookCollectionMethods = []string{"GET", "POST", "OPTIONS"}
+	bookItemMethods       = []string{"GET", "PUT", "PATCH", "DELETE", "OPTIONS"}
+)
+
+// bookContentTypes lists the representations books are sent and accepted in
+var bookContentTypes = []string{"application/json"}
+
+// BooksOptions handles OPTIONS /api/v1/books
+func (h *BookHandler) BooksOptions(w http.ResponseWriter, r *http.Request) {
+	sendOptionsResponse(w, bookCollectionMethods, bookContentTypes)
+}
+
+// BookOptions handles OPTIONS /api/v1/books/{id}
+func (h *BookHandler) BookOptions(w http.ResponseWriter, r *http.Request) {
+	sendOptionsResponse(w, bookItemMethods, bookContentTypes)
 }
 
 // Helper methods
-func (h *BookHandler) sendJSONResponse(w http.ResponseWriter, statusCode int, data interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(statusCode)
 
-	if err := json.NewEncoder(w).Encode(data); err != nil {
-		logrus.WithError(err).Error("Failed to encode JSON response")
+func (h *BookHandler) sendAuthorLimitResponse(w http.ResponseWriter, r *http.Request) {
+	sendErrorResponse(w, r, http.StatusConflict, newMessage(msgAuthorLimitReached, h.maxBooksPerAuthor))
+}
+
+// setAvailabilityDefaulted tells the client whether a created book's
+// availability was defaulted because the request didn't set it
+func setAvailabilityDefaulted(w http.ResponseWriter, req models.CreateBookRequest) {
+	w.Header().Set("X-Availability-Defaulted", strconv.FormatBool(req.Available == nil))
+}
+
+func sendDuplicateResponse(w http.ResponseWriter, r *http.Request) {
+	sendErrorResponse(w, r, http.StatusConflict, newMessage(msgDuplicate))
+}
+
+// coalesce runs fn, sharing its result with any concurrent caller using the
+// same key when read deduplication is enabled. A shared query runs detached
+// from the request's cancellation, since other callers may still be waiting
+// on it.
+func (h *BookHandler) coalesce(ctx context.Context, key string, fn func(context.Context) (interface{}, error)) (interface{}, error) {
+	if h.reads == nil {
+		return fn(ctx)
 	}
+
+	v, err, _ := h.reads.Do(key, func() (interface{}, error) {
+		return fn(context.WithoutCancel(ctx))
+	})
+	return v, err
 }
 
-func (h *BookHandler) sendErrorResponse(w http.ResponseWriter, statusCode int, message string) {
-	response := models.APIResponse{
-		Success: false,
-		Error:   message,
+// parseBookFilter reads the list filter query parameters, returning an error
+// message for the first invalid one
+func parseBookFilter(r *http.Request) (db.BookFilter, *message) {
+	var filter db.BookFilter
+	query := r.URL.Query()
+
+	filter.Genre = normalizeGenre(query.Get("genre"))
+
+	for _, param := range []struct {
+		name string
+		dest *string
+	}{{"title", &filter.Title}, {"author", &filter.Author}} {
+		value := strings.TrimSpace(query.Get(param.name))
+		if utf8.RuneCountInString(value) > maxTextLength {
+			return filter, newMessage(msgParamTooLong, param.name, maxTextLength)
+		}
+		*param.dest = value
+	}
+
+	if filterStr := strings.TrimSpace(query.Get("filter")); filterStr != "" {
+		expr, err := db.ParseFilter(filterStr)
+		if err != nil {
+			return filter, newMessage(msgInvalidFilter, err.Error())
+		}
+		filter.Expr = expr
+	}
+
+	for _, param := range []struct {
+		name string
+		dest *int
+	}{{"id_min", &filter.IDMin}, {"id_max", &filter.IDMax}} {
+		value := query.Get(param.name)
+		if value == "" {
+			continue
+		}
+		id, err := strconv.Atoi(value)
+		if err != nil || id < 1 {
+			return filter, newMessage(msgNotPositiveInteger, param.name)
+		}
+		*param.dest = id
+	}
+	if filter.IDMin > 0 && filter.IDMax > 0 && filter.IDMin > filter.IDMax {
+		return filter, newMessage(msgIDRangeInverted)
+	}
+
+	if value := query.Get("available"); value != "" {
+		available, err := strconv.ParseBool(value)
+		if err != nil {
+			return filter, newMessage(msgNotBoolean, "available")
+		}
+		filter.Available = &available
+	}
+
+	for _, param := range []struct {
+		name string
+		dest **int
+	}{{"year_min", &filter.YearMin}, {"year_max", &filter.YearMax}} {
+		value := query.Get(param.name)
+		if value == "" {
+			continue
+		}
+		year, err := strconv.Atoi(value)
+		if err != nil {
+			return filter, newMessage(msgNotWholeNumber, param.name)
+		}
+		*param.dest = &year
+	}
+	if filter.YearMin != nil && filter.YearMax != nil && *filter.YearMin > *filter.YearMax {
+		return filter, newMessage(msgYearRangeInverted)
+	}
+
+	for _, param := range []struct {
+		name string
+		dest **time.Time
+	}{{"created_since", &filter.CreatedSince}, {"updated_since", &filter.UpdatedSince}} {
+		value := query.Get(param.name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, newMessage(msgInvalidTimestamp, param.name)
+		}
+		*param.dest = &t
+	}
+
+	if value := strings.ToLower(query.Get("import_batch")); value != "" {
+		if !isImportBatchID(value) {
+			return filter, newMessage(msgInvalidImportBatch, "import_batch")
+		}
+		filter.ImportBatch = value
+	}
+
+	return filter, nil
+}
+
+// pageLimits are the page sizes list endpoints use when the request
+// doesn't give a limit, and at most
+type pageLimits struct {
+	defaultLimit int
+	maxLimit     int
+}
+
+// pageLimitsFromEnv reads DEFAULT_PAGE_LIMIT and MAX_PAGE_LIMIT, falling
+// back to 10 and 100
+func pageLimitsFromEnv() pageLimits {
+	limits := pageLimits{defaultLimit: 10, maxLimit: 100}
+
+	if v := os.Getenv("MAX_PAGE_LIMIT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			limits.maxLimit = n
+		} else {
+			logrus.Warnf("Invalid MAX_PAGE_LIMIT %q, using %d", v, limits.maxLimit)
+		}
+	}
+
+	if v := os.Getenv("DEFAULT_PAGE_LIMIT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			limits.defaultLimit = n
+		} else {
+			logrus.Warnf("Invalid DEFAULT_PAGE_LIMIT %q, using %d", v, limits.defaultLimit)
+		}
+	}
+	if limits.defaultLimit > limits.maxLimit {
+		logrus.Warnf("DEFAULT_PAGE_LIMIT %d exceeds MAX_PAGE_LIMIT, using %d", limits.defaultLimit, limits.maxLimit)
+		limits.defaultLimit = limits.maxLimit
+	}
+
+	return limits
+}
+
+// parsePagination reads the page and limit query parameters. A missing or
+// invalid page is 1 and a missing or invalid limit the default; a limit
+// above the maximum is lowered to it.
+func (l pageLimits) parsePagination(r *http.Request) (page, limit int) {
+	pageStr := r.URL.Query().Get("page")
+	limitStr := r.URL.Query().Get("limit")
+
+	// Set defaults
+	page = 1
+	limit = l.defaultLimit
+
+	// Parse page
+	if pageStr != "" {
+		if p, err := strconv.Atoi(pageStr); err == nil && p > 0 {
+			page = p
+		}
+	}
+
+	// Parse limit
+	if limitStr != "" {
+		if n, err := strconv.Atoi(limitStr); err == nil && n > 0 {
+			limit = min(n, l.maxLimit)
+		}
 	}
 
-	h.sendJSONResponse(w, statusCode, response)
+	return page, limit
 }
@@ -0,0 +1,1627 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"library-api/models"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	logrus.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// newMockHandler returns a handler whose queries are answered by the
+// returned mock, checking on cleanup that every expected query ran.
+// Environment settings have to be made before calling it.
+func newMockHandler(t *testing.T) (*BookHandler, sqlmock.Sqlmock) {
+	t.Helper()
+	database, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		database.Close()
+	})
+	return NewBookHandler(NewSQLRepository(database)), mock
+}
+
+// storedBook is a book as the mock database holds it, last updated at a
+// fixed time
+func storedBook() models.Book {
+	updated := time.Date(2024, 1, 15, 10, 0, 0, 0, time.UTC)
+	return models.Book{
+		ID:            1,
+		Title:         "Dune",
+		Author:        "Frank Herbert",
+		PublishedYear: 1965,
+		Available:     true,
+		CreatedAt:     updated,
+		UpdatedAt:     updated,
+	}
+}
+
+// bookRows returns mock rows holding books in the order the book queries
+// select their columns
+func bookRows(books ...models.Book) *sqlmock.Rows {
+	rows := sqlmock.NewRows([]string{"id", "title", "author", "isbn", "genre", "published_year", "available", "featured", "availability_changed_at", "last_accessed_at", "created_at", "updated_at"})
+	for _, b := range books {
+		var isbn, genre, changed, accessed driver.Value
+		if b.ISBN != "" {
+			isbn = b.ISBN
+		}
+		if b.Genre != "" {
+			genre = b.Genre
+		}
+		if b.AvailabilityChangedAt != nil {
+			changed = *b.AvailabilityChangedAt
+		}
+		if b.LastAccessedAt != nil {
+			accessed = *b.LastAccessedAt
+		}
+		rows.AddRow(b.ID, b.Title, b.Author, isbn, genre, b.PublishedYear, b.Available, b.Featured, changed, accessed, b.CreatedAt, b.UpdatedAt)
+	}
+	return rows
+}
+
+// expectBook expects the book to be read by ID
+func expectBook(mock sqlmock.Sqlmock, book models.Book) {
+	mock.ExpectQuery(regexp.QuoteMeta("FROM books WHERE id = ?")).
+		WithArgs(book.ID).
+		WillReturnRows(bookRows(book))
+}
+
+// serve runs a handler on a request with the given path variables and an
+// optional body
+func serve(handler http.HandlerFunc, method, target, body string, vars map[string]string) *httptest.ResponseRecorder {
+	return serveWithHeaders(handler, method, target, body, vars, nil)
+}
+
+// serveWithHeaders is serve for a request that also carries headers
+func serveWithHeaders(handler http.HandlerFunc, method, target, body string, vars, headers map[string]string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	if vars != nil {
+		req = mux.SetURLVars(req, vars)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+// decodeResponse decodes the standard response envelope
+func decodeResponse(t *testing.T, rec *httptest.ResponseRecorder) models.APIResponse {
+	t.Helper()
+	var resp models.APIResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("response is not JSON: %v: %s", err, rec.Body.String())
+	}
+	return resp
+}
+
+// decodeData decodes the data of a successful response into v
+func decodeData(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	resp := decodeResponse(t, rec)
+	if !resp.Success {
+		t.Fatalf("response failed: %s", rec.Body.String())
+	}
+	data, err := json.Marshal(resp.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("unexpected data: %v: %s", err, data)
+	}
+}
+
+func TestUpdateBookEmpty(t *testing.T) {
+	tests := []struct {
+		mode    string
+		status  int
+		message string
+		error   string
+	}{
+		{mode: "", status: http.StatusOK, message: "No changes"},
+		{mode: "noop", status: http.StatusOK, message: "No changes"},
+		{mode: "reject", status: http.StatusUnprocessableEntity, error: "No fields to update"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			t.Setenv("EMPTY_UPDATE_MODE", tt.mode)
+			h, mock := newMockHandler(t)
+			if tt.status == http.StatusOK {
+				// The book is read back, but no UPDATE may run
+				mock.ExpectBegin()
+				expectBook(mock, storedBook())
+				mock.ExpectCommit()
+			}
+
+			rec := serve(h.UpdateBook, "PATCH", "/api/v1/books/1", "{}", map[string]string{"id": "1"})
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			resp := decodeResponse(t, rec)
+			if resp.Message != tt.message || resp.Error != tt.error {
+				t.Errorf("message %q, error %q, want %q, %q", resp.Message, resp.Error, tt.message, tt.error)
+			}
+		})
+	}
+}
+
+func TestUpdateBookMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		message string
+	}{
+		{"empty", `{}`, "No changes"},
+		{"stored values", `{"title": "Dune", "published_year": 1965}`, "No changes"},
+		{"new title", `{"title": "Dune Messiah"}`, "Book updated successfully"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mock := newMockHandler(t)
+			// The book is locked and compared inside a transaction
+			mock.ExpectBegin()
+			expectBook(mock, storedBook())
+			if tt.message != "No changes" {
+				mock.ExpectExec(regexp.QuoteMeta("UPDATE books SET title = ?")).WillReturnResult(sqlmock.NewResult(0, 1))
+				expectBook(mock, storedBook())
+			}
+			mock.ExpectCommit()
+
+			rec := serve(h.UpdateBook, "PATCH", "/api/v1/books/1", tt.body, map[string]string{"id": "1"})
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+			}
+			if resp := decodeResponse(t, rec); resp.Message != tt.message {
+				t.Errorf("message = %q, want %q", resp.Message, tt.message)
+			}
+		})
+	}
+}
+
+func TestCreateBookInvalid(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		error  string
+	}{
+		{"malformed", `{"title": "Dune"`, http.StatusBadRequest, "Request body ends before the JSON value is complete"},
+		{
+			"wrong type",
+			`{"title": "Dune", "author": "Frank Herbert", "published_year": "1965"}`,
+			http.StatusBadRequest,
+			"Invalid value for field 'published_year' at position 69: expected int",
+		},
+		{
+			"title too long",
+			`{"title": "` + strings.Repeat("a", maxTextLength+1) + `", "author": "Frank Herbert", "published_year": 1965}`,
+			http.StatusUnprocessableEntity,
+			"Title must be at most 255 characters",
+		},
+		{"year out of range", `{"title": "Dune", "author": "Frank Herbert", "published_year": 999}`, http.StatusUnprocessableEntity, "Published year must be between 1000 and 2100"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// No query is expected, so reaching the database fails the test
+			h, _ := newMockHandler(t)
+
+			rec := serve(h.CreateBook, "POST", "/api/v1/books", tt.body, nil)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if resp := decodeResponse(t, rec); resp.Error != tt.error {
+				t.Errorf("error = %q, want %q", resp.Error, tt.error)
+			}
+		})
+	}
+}
+
+func TestGetBooksSort(t *testing.T) {
+	tests := []struct {
+		query string
+		order string // empty when the request is rejected
+	}{
+		{"", "created_at DESC, id DESC"},
+		{"sort=title&order=asc", "title ASC, id ASC"},
+		{"sort=published_year&order=desc", "published_year DESC, id DESC"},
+		{"sort=title", "title DESC, id DESC"},
+		{"sort=title&order=sideways", "title DESC, id DESC"},
+		{"sort=isbn", "created_at DESC, id DESC"},
+		{"sort=title;DROP%20TABLE%20books", "created_at DESC, id DESC"},
+		{"sort=isbn&order=asc", "created_at ASC, id ASC"},
+		{"sort=completeness&order=asc", "((CASE WHEN isbn IS NULL OR isbn = '' THEN 0 ELSE 1 END) + (CASE WHEN genre IS NULL OR genre = '' THEN 0 ELSE 1 END)) ASC, id ASC"},
+		{"sort=title&order=asc&collation=utf8mb4_da_0900_ai_ci", "title COLLATE utf8mb4_da_0900_ai_ci ASC, id ASC"},
+		{"sort=published_year&collation=utf8mb4_da_0900_ai_ci", "published_year DESC, id DESC"},
+		{"sort=title&collation=latin1_swedish_ci", ""},
+		{"sort=title&collation=utf8mb4_bin%20DESC", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			h, mock := newMockHandler(t)
+			if tt.order == "" {
+				rec := serve(h.GetBooks, "GET", "/api/v1/books?"+tt.query, "", nil)
+				if rec.Code != http.StatusBadRequest {
+					t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+				}
+				if resp := decodeResponse(t, rec); resp.Code != msgInvalidCollation {
+					t.Errorf("code = %q, want %q", resp.Code, msgInvalidCollation)
+				}
+				return
+			}
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM books")).
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+			mock.ExpectQuery(regexp.QuoteMeta("ORDER BY " + tt.order + " LIMIT")).
+				WillReturnRows(bookRows(storedBook()))
+
+			rec := serve(h.GetBooks, "GET", "/api/v1/books?"+tt.query, "", nil)
+
+			if rec.Code != http.StatusOK {
+				t.Errorf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestParseBookFilter(t *testing.T) {
+	// optional formats an optional filter value, "-" when unset
+	optional := func(v interface{}) string {
+		switch v := v.(type) {
+		case *bool:
+			if v != nil {
+				return strconv.FormatBool(*v)
+			}
+		case *int:
+			if v != nil {
+				return strconv.Itoa(*v)
+			}
+		}
+		return "-"
+	}
+
+	tests := []struct {
+		query string
+		want  string // available, year_min and year_max
+		err   string
+	}{
+		{"", "- - -", ""},
+		{"available=true", "true - -", ""},
+		{"available=1", "true - -", ""},
+		{"available=false", "false - -", ""},
+		{"available=0", "false - -", ""},
+		{"year_min=1990", "- 1990 -", ""},
+		{"year_max=2000", "- - 2000", ""},
+		{"year_min=1990&year_max=2000", "- 1990 2000", ""},
+		{"year_min=2000&year_max=2000", "- 2000 2000", ""},
+		{"available=1&year_min=1990&year_max=2000", "true 1990 2000", ""},
+		{"available=yes", "", "available must be true or false"},
+		{"year_min=1990s", "", "year_min must be a whole number"},
+		{"year_max=late", "", "year_max must be a whole number"},
+		{"year_min=2001&year_max=2000", "", "year_min must not be greater than year_max"},
+	}
+
+	for _, tt := range tests {
+		filter, m := parseBookFilter(httptest.NewRequest("GET", "/api/v1/books?"+tt.query, nil))
+		msg := english(m)
+		if msg != tt.err {
+			t.Errorf("%q: error %q, want %q", tt.query, msg, tt.err)
+			continue
+		}
+		if msg != "" {
+			continue
+		}
+		if got := optional(filter.Available) + " " + optional(filter.YearMin) + " " + optional(filter.YearMax); got != tt.want {
+			t.Errorf("%q: filter %s, want %s", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestGetBooksFiltersComposeWithSearch(t *testing.T) {
+	tests := []struct {
+		query string
+		count string
+		args  []driver.Value
+	}{
+		{
+			"available=true&year_min=1990",
+			"SELECT COUNT(*) FROM books WHERE available = ? AND published_year >= ?",
+			[]driver.Value{true, 1990},
+		},
+		{
+			"q=dune&available=0&year_max=2000",
+			`SELECT COUNT(*) FROM books WHERE (LOWER(title) LIKE LOWER(?) ESCAPE '!' OR LOWER(author) LIKE LOWER(?) ESCAPE '!') AND available = ? AND published_year <= ?`,
+			[]driver.Value{"%dune%", "%dune%", false, 2000},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			h, mock := newMockHandler(t)
+			mock.ExpectQuery("^" + regexp.QuoteMeta(tt.count) + "$").
+				WithArgs(tt.args...).
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+			mock.ExpectQuery(regexp.QuoteMeta("FROM books")).WillReturnRows(bookRows())
+
+			rec := serve(h.GetBooks, "GET", "/api/v1/books?"+tt.query, "", nil)
+
+			if rec.Code != http.StatusOK {
+				t.Errorf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestCreateBookISBN(t *testing.T) {
+	tests := []struct {
+		name     string
+		isbn     string
+		insertIs error // returned by the INSERT
+		status   int
+		error    string
+	}{
+		{name: "valid ISBN-13", isbn: "978-0-306-40615-7", status: http.StatusCreated},
+		{name: "invalid checksum", isbn: "9780306406158", status: http.StatusUnprocessableEntity, error: "ISBN must be a valid ISBN-10 or ISBN-13"},
+		{name: "duplicate", isbn: "9780306406157", insertIs: &mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}, status: http.StatusConflict, error: "Resource already exists"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mock := newMockHandler(t)
+			if tt.status != http.StatusUnprocessableEntity {
+				// The ISBN is stored without its hyphens
+				mock.ExpectBegin()
+				insert := mock.ExpectExec(regexp.QuoteMeta("INSERT INTO books (title, author, isbn, genre, published_year, available)")).
+					WithArgs("Dune", "Frank Herbert", "9780306406157", nil, 1965, true)
+				if tt.insertIs != nil {
+					insert.WillReturnError(tt.insertIs)
+					mock.ExpectRollback()
+				} else {
+					insert.WillReturnResult(sqlmock.NewResult(1, 1))
+					book := storedBook()
+					book.ISBN = "9780306406157"
+					expectBook(mock, book)
+					mock.ExpectCommit()
+				}
+			}
+
+			body := `{"title": "Dune", "author": "Frank Herbert", "isbn": "` + tt.isbn + `", "published_year": 1965}`
+			rec := serve(h.CreateBook, "POST", "/api/v1/books", body, nil)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if resp := decodeResponse(t, rec); resp.Error != tt.error {
+				t.Errorf("error = %q, want %q", resp.Error, tt.error)
+			}
+		})
+	}
+}
+
+func TestCreateBooksBulk(t *testing.T) {
+	dune := `{"title": "Dune", "author": "Frank Herbert", "published_year": 1965}`
+
+	tests := []struct {
+		name   string
+		body   string
+		insert bool
+		status int
+		error  string
+	}{
+		{
+			name:   "created together",
+			body:   `[` + dune + `, {"title": "Dune Messiah", "author": "Frank Herbert", "published_year": 1969}]`,
+			insert: true,
+			status: http.StatusCreated,
+		},
+		{
+			name:   "invalid item",
+			body:   `[` + dune + `, {"title": "", "author": "Frank Herbert", "published_year": 1969}]`,
+			status: http.StatusUnprocessableEntity,
+			error:  "Book at index 1: Title is required",
+		},
+		{
+			name:   "empty",
+			body:   `[]`,
+			status: http.StatusUnprocessableEntity,
+			error:  "At least one book is required",
+		},
+		{
+			name:   "over the cap",
+			body:   `[` + strings.Repeat(dune+`, `, maxBatchCreate) + dune + `]`,
+			status: http.StatusUnprocessableEntity,
+			error:  "At most 1000 books can be created at once",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mock := newMockHandler(t)
+			if tt.insert {
+				first, second := storedBook(), storedBook()
+				second.ID, second.Title, second.PublishedYear = 2, "Dune Messiah", 1969
+				mock.ExpectBegin()
+				mock.ExpectExec(regexp.QuoteMeta("VALUES (?, ?, ?, ?, ?, ?, ?), (?, ?, ?, ?, ?, ?, ?)")).
+					WillReturnResult(sqlmock.NewResult(1, 2))
+				mock.ExpectQuery(regexp.QuoteMeta("FROM books WHERE id IN (?, ?)")).
+					WithArgs(int64(1), int64(2)).
+					WillReturnRows(bookRows(first, second))
+				mock.ExpectCommit()
+			}
+
+			rec := serve(h.CreateBooksBulk, "POST", "/api/v1/books/bulk", tt.body, nil)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if resp := decodeResponse(t, rec); resp.Error != tt.error {
+				t.Errorf("error = %q, want %q", resp.Error, tt.error)
+			}
+		})
+	}
+}
+
+func TestCreateBookAvailability(t *testing.T) {
+	tests := []struct {
+		available string // JSON value, empty when unset
+		stored    bool
+		defaulted string
+	}{
+		{"false", false, "false"},
+		{"true", true, "false"},
+		{"", true, "true"},
+	}
+
+	for _, tt := range tests {
+		t.Run("available="+tt.available, func(t *testing.T) {
+			h, mock := newMockHandler(t)
+			mock.ExpectBegin()
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO books")).
+				WithArgs("Dune", "Frank Herbert", nil, nil, 1965, tt.stored).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			book := storedBook()
+			book.Available = tt.stored
+			expectBook(mock, book)
+			mock.ExpectCommit()
+
+			body := `{"title": "Dune", "author": "Frank Herbert", "published_year": 1965`
+			if tt.available != "" {
+				body += `, "available": ` + tt.available
+			}
+			rec := serve(h.CreateBook, "POST", "/api/v1/books", body+`}`, nil)
+
+			if rec.Code != http.StatusCreated {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body.String())
+			}
+			if got := rec.Header().Get("X-Availability-Defaulted"); got != tt.defaulted {
+				t.Errorf("X-Availability-Defaulted = %q, want %q", got, tt.defaulted)
+			}
+		})
+	}
+}
+
+func TestCloneBook(t *testing.T) {
+	tests := []struct {
+		name      string
+		id        string
+		body      string
+		lastFirst bool // AUTHOR_FORMAT=last_first
+		minimal   bool // Prefer: return=minimal
+		status    int
+		want      string // the clone's published year, or the first violation
+	}{
+		{"copy", "1", "", false, false, http.StatusCreated, "1965"},
+		{"override", "1", `{"published_year": 2024}`, false, false, http.StatusCreated, "2024"},
+		{"minimal", "1", "", false, true, http.StatusCreated, ""},
+		{"invalid override", "1", `{"published_year": 99}`, false, false, http.StatusUnprocessableEntity, "Published year must be between 1000 and 2100"},
+		{"source breaks a newer rule", "1", "", true, false, http.StatusUnprocessableEntity, `Author must be in "Last, First" format, e.g. "Tolkien, J. R. R."`},
+		{"override fixes the source", "1", `{"author": "Herbert, Frank"}`, true, false, http.StatusCreated, "1965"},
+		{"missing source", "9", "", false, false, http.StatusNotFound, "Book not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newFakeRepository(storedBook())
+			h := NewBookHandler(repo)
+			h.requireLastFirstAuthors = tt.lastFirst
+			headers := map[string]string{}
+			if tt.minimal {
+				headers["Prefer"] = "return=minimal"
+			}
+
+			rec := serveWithHeaders(h.CloneBook, "POST", "/api/v1/books/"+tt.id+"/clone", tt.body, map[string]string{"id": tt.id}, headers)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.status != http.StatusCreated {
+				if resp := decodeResponse(t, rec); resp.Error != tt.want {
+					t.Errorf("error = %q, want %q", resp.Error, tt.want)
+				}
+				if len(repo.books) != 1 {
+					t.Error("the clone reached the repository")
+				}
+				return
+			}
+
+			if got := rec.Header().Get("Location"); got != "/api/v1/books/2" {
+				t.Errorf("Location = %q, want /api/v1/books/2", got)
+			}
+			if tt.minimal {
+				var id models.ResourceID
+				decodeData(t, rec, &id)
+				if id.ID != 2 || strings.Contains(rec.Body.String(), "title") {
+					t.Errorf("body = %s, want only the new ID", rec.Body.String())
+				}
+				if got := rec.Header().Get("Preference-Applied"); got != "return=minimal" {
+					t.Errorf("Preference-Applied = %q, want return=minimal", got)
+				}
+				return
+			}
+			var clone models.Book
+			decodeData(t, rec, &clone)
+			if got := fmt.Sprint(clone.PublishedYear); clone.ID != 2 || got != tt.want {
+				t.Errorf("clone = %d published %s, want 2 published %s", clone.ID, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetBooksPagination(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		count   int // total returned by COUNT(*), or -1 when it mustn't run
+		fetched int // books returned by the page query
+		want    models.Pagination
+		books   int
+	}{
+		{
+			name:    "counted, more pages",
+			query:   "limit=2",
+			count:   5,
+			fetched: 2,
+			want:    models.Pagination{Page: 1, Limit: 2, Total: 5, TotalPages: 3, HasNext: true},
+			books:   2,
+		},
+		{
+			name:    "counted, last page",
+			query:   "limit=2&page=3",
+			count:   5,
+			fetched: 1,
+			want:    models.Pagination{Page: 3, Limit: 2, Total: 5, TotalPages: 3},
+			books:   1,
+		},
+		{
+			name:    "uncounted, extra book fetched",
+			query:   "limit=2&count=false",
+			count:   -1,
+			fetched: 3,
+			want:    models.Pagination{Page: 1, Limit: 2, Total: -1, TotalPages: -1, TotalUnknown: true, HasNext: true},
+			books:   2,
+		},
+		{
+			name:    "uncounted, last page",
+			query:   "limit=2&count=false",
+			count:   -1,
+			fetched: 2,
+			want:    models.Pagination{Page: 1, Limit: 2, Total: -1, TotalPages: -1, TotalUnknown: true},
+			books:   2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, mock := newMockHandler(t)
+			if tt.count >= 0 {
+				mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM books")).
+					WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(tt.count))
+			}
+			books := make([]models.Book, tt.fetched)
+			for i := range books {
+				books[i] = storedBook()
+				books[i].ID = i + 1
+			}
+			mock.ExpectQuery(regexp.QuoteMeta("LIMIT ? OFFSET ?")).WillReturnRows(bookRows(books...))
+
+			rec := serve(h.GetBooks, "GET", "/api/v1/books?"+tt.query, "", nil)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+			}
+			var resp struct {
+				Data       []models.Book     `json:"data"`
+				Pagination models.Pagination `json:"pagination"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Pagination != tt.want {
+				t.Errorf("pagination = %+v, want %+v", resp.Pagination, tt.want)
+			}
+			if len(resp.Data) != tt.books {
+				t.Errorf("%d books, want %d", len(resp.Data), tt.books)
+			}
+		})
+	}
+}
+
+func TestGetBook(t *testing.T) {
+	repo := newFakeRepository(storedBook())
+	h := NewBookHandler(repo)
+
+	tests := []struct {
+		id     string
+		status int
+		code   string
+	}{
+		{"1", http.StatusOK, ""},
+		{"2", http.StatusNotFound, msgBookNotFound},
+		{"abc", http.StatusBadRequest, msgInvalidBookID},
+	}
+
+	for _, tt := range tests {
+		rec := serve(h.GetBook, "GET", "/api/v1/books/"+tt.id, "", map[string]string{"id": tt.id})
+
+		if rec.Code != tt.status {
+			t.Errorf("id %s: status = %d, want %d", tt.id, rec.Code, tt.status)
+			continue
+		}
+		if resp := decodeResponse(t, rec); resp.Code != tt.code {
+			t.Errorf("id %s: code = %q, want %q", tt.id, resp.Code, tt.code)
+		}
+	}
+}
+
+func TestGetBookConditional(t *testing.T) {
+	repo := newFakeRepository(storedBook())
+	h := NewBookHandler(repo)
+	vars := map[string]string{"id": "1"}
+
+	etag := serve(h.GetBook, "GET", "/api/v1/books/1", "", vars).Header().Get("ETag")
+	if !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("ETag = %q, want a strong tag", etag)
+	}
+
+	tests := []struct {
+		ifNoneMatch string
+		status      int
+	}{
+		{etag, http.StatusNotModified},
+		{"W/" + etag, http.StatusNotModified},
+		{`"other", ` + etag, http.StatusNotModified},
+		{"*", http.StatusNotModified},
+		{`"other"`, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		rec := serveWithHeaders(h.GetBook, "GET", "/api/v1/books/1", "", vars, map[string]string{"If-None-Match": tt.ifNoneMatch})
+		if rec.Code != tt.status {
+			t.Errorf("If-None-Match %s: status = %d, want %d", tt.ifNoneMatch, rec.Code, tt.status)
+		}
+		if tt.status == http.StatusNotModified && rec.Body.Len() != 0 {
+			t.Errorf("If-None-Match %s: 304 with %d bytes of body", tt.ifNoneMatch, rec.Body.Len())
+		}
+		if got := rec.Header().Get("ETag"); got != etag {
+			t.Errorf("If-None-Match %s: ETag = %q, want %q", tt.ifNoneMatch, got, etag)
+		}
+	}
+
+	// Changing the book changes its ETag, so the old one no longer matches
+	serve(h.UpdateBook, "PATCH", "/api/v1/books/1", `{"available": false}`, vars)
+	rec := serveWithHeaders(h.GetBook, "GET", "/api/v1/books/1", "", vars, map[string]string{"If-None-Match": etag})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("after update: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got := rec.Header().Get("ETag"); got == "" || got == etag {
+		t.Errorf("after update: ETag = %q, want a new one", got)
+	}
+}
+
+func TestUpdateBookIfMatch(t *testing.T) {
+	vars := map[string]string{"id": "1"}
+	stored := storedBook()
+	current := bookETag(&stored)
+
+	tests := []struct {
+		name    string
+		ifMatch string
+		status  int
+	}{
+		{"current", current, http.StatusOK},
+		{"any", "*", http.StatusOK},
+		{"one of several", `"stale", ` + current, http.StatusOK},
+		{"stale", `"0123456789abcdef0123456789abcdef"`, http.StatusPreconditionFailed},
+		{"weak", "W/" + current, http.StatusPreconditionFailed},
+	}
+
+	for _, tt := range tests {
+		repo := newFakeRepository(storedBook())
+		h := NewBookHandler(repo)
+
+		rec := serveWithHeaders(h.UpdateBook, "PATCH", "/api/v1/books/1", `{"title": "Dune Messiah"}`, vars,
+			map[string]string{"If-Match": tt.ifMatch})
+
+		if rec.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.status)
+			continue
+		}
+		if tt.status == http.StatusPreconditionFailed {
+			if resp := decodeResponse(t, rec); resp.Code != msgBookModified {
+				t.Errorf("%s: code = %q, want %q", tt.name, resp.Code, msgBookModified)
+			}
+			if repo.books[1].Title != "Dune" {
+				t.Errorf("%s: book changed despite the failed precondition", tt.name)
+			}
+		} else if rec.Header().Get("ETag") == current {
+			t.Errorf("%s: updated book kept the old ETag", tt.name)
+		}
+	}
+}
+
+func TestGetBooksIncludeScore(t *testing.T) {
+	score := 2.5
+	book := storedBook()
+	book.Score = &score
+	h := NewBookHandler(newFakeRepository(book))
+
+	tests := []struct {
+		query string
+		score bool
+	}{
+		{"q=dune", false},
+		{"q=dune&include_score=false", false},
+		{"q=dune&include_score=true", true},
+	}
+
+	for _, tt := range tests {
+		rec := serve(h.GetBooks, "GET", "/api/v1/books?"+tt.query, "", nil)
+		var resp struct {
+			Data []models.Book `json:"data"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || len(resp.Data) != 1 {
+			t.Fatalf("%q: body %s, want one book", tt.query, rec.Body.String())
+		}
+		if got := resp.Data[0].Score != nil; got != tt.score {
+			t.Errorf("%q: score included %v, want %v", tt.query, got, tt.score)
+		}
+	}
+}
+
+func TestGetBooksCursorVisitsEveryBookOnce(t *testing.T) {
+	for _, order := range []string{"desc", "asc"} {
+		t.Run(order, func(t *testing.T) {
+			// Pairs of books share a creation time, so IDs break ties
+			start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			var books []models.Book
+			for id := 1; id <= 10; id++ {
+				created := start.Add(time.Duration((id+1)/2) * time.Hour)
+				books = append(books, models.Book{ID: id, Title: fmt.Sprintf("Book %d", id), Author: "Author", PublishedYear: 2000, CreatedAt: created})
+			}
+			repo := newFakeRepository(books...)
+			h := NewBookHandler(repo)
+
+			seen := make(map[int]int)
+			cursor := ""
+			for pages := 0; ; pages++ {
+				if pages > 10 {
+					t.Fatal("pagination didn't end")
+				}
+				rec := serve(h.GetBooks, "GET", "/api/v1/books?limit=3&order="+order+"&cursor="+cursor, "", nil)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+				}
+				var resp struct {
+					Data       []models.Book     `json:"data"`
+					Pagination models.Pagination `json:"pagination"`
+				}
+				if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+				for _, book := range resp.Data {
+					seen[book.ID]++
+				}
+
+				// Books added while paging must not shift later pages
+				repo.insert(models.CreateBookRequest{Title: "New", Author: "Author", PublishedYear: 2000})
+
+				if !resp.Pagination.HasNext {
+					break
+				}
+				cursor = resp.Pagination.NextCursor
+			}
+
+			// Ascending walks also reach the books added on the way
+			for id := 1; id <= repo.nextID-1; id++ {
+				if seen[id] > 1 || (id <= 10 && seen[id] != 1) {
+					t.Errorf("book %d returned %d times, want once", id, seen[id])
+				}
+			}
+		})
+	}
+}
+
+func TestGetBooksInvalidCursor(t *testing.T) {
+	h := NewBookHandler(newFakeRepository())
+
+	tests := []struct {
+		query string
+		code  string
+	}{
+		{"cursor=not-a-cursor", msgInvalidCursor},
+		{"cursor=&q=dune", msgCursorUnsupported},
+		{"cursor=&sort=title", msgCursorUnsupported},
+	}
+
+	for _, tt := range tests {
+		rec := serve(h.GetBooks, "GET", "/api/v1/books?"+tt.query, "", nil)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%q: status = %d, want %d", tt.query, rec.Code, http.StatusBadRequest)
+			continue
+		}
+		if resp := decodeResponse(t, rec); resp.Code != tt.code {
+			t.Errorf("%q: code = %q, want %q", tt.query, resp.Code, tt.code)
+		}
+	}
+}
+
+// bookIDs returns the IDs of the books in a list response
+func bookIDs(t *testing.T, rec *httptest.ResponseRecorder) []int {
+	t.Helper()
+	var resp struct {
+		Data []models.Book `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("response is not JSON: %v: %s", err, rec.Body.String())
+	}
+	ids := make([]int, len(resp.Data))
+	for i, book := range resp.Data {
+		ids[i] = book.ID
+	}
+	return ids
+}
+
+func TestGetBooksGenreFilter(t *testing.T) {
+	h := NewBookHandler(newFakeRepository(
+		models.Book{ID: 1, Title: "Dune", Author: "Frank Herbert", PublishedYear: 1965, Genre: "science fiction"},
+		models.Book{ID: 2, Title: "Emma", Author: "Jane Austen", PublishedYear: 1815, Genre: "romance"},
+		models.Book{ID: 3, Title: "Untitled", Author: "Anonymous", PublishedYear: 2000},
+	))
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"genre=romance", "[2]"},
+		{"genre=Science%20Fiction", "[1]"},
+		{"genre=%20romance%20", "[2]"},
+		{"genre=poetry", "[]"},
+		{"", "[1 2 3]"},
+	}
+
+	for _, tt := range tests {
+		rec := serve(h.GetBooks, "GET", "/api/v1/books?"+tt.query, "", nil)
+		if got := fmt.Sprint(bookIDs(t, rec)); got != tt.want {
+			t.Errorf("%q: books %s, want %s", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateBookGenre(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed string // BOOK_GENRES
+		body    string
+		status  int
+		want    string // stored genre afterwards
+	}{
+		{"normalized", "", `{"genre": " Science Fiction "}`, http.StatusOK, "science fiction"},
+		{"cleared", "", `{"genre": ""}`, http.StatusOK, ""},
+		{"allowed", "fiction, Poetry", `{"genre": "POETRY"}`, http.StatusOK, "poetry"},
+		{"not allowed", "fiction, Poetry", `{"genre": "cookbook"}`, http.StatusUnprocessableEntity, "fiction"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("BOOK_GENRES", tt.allowed)
+			book := storedBook()
+			book.Genre = "fiction"
+			repo := newFakeRepository(book)
+			h := NewBookHandler(repo)
+
+			rec := serve(h.UpdateBook, "PATCH", "/api/v1/books/1", tt.body, map[string]string{"id": "1"})
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.status != http.StatusOK {
+				if resp := decodeResponse(t, rec); resp.Code != msgGenreNotAllowed || !strings.Contains(resp.Error, "fiction, poetry") {
+					t.Errorf("response = %+v, want the allowed genres listed", resp)
+				}
+			}
+			got := *repo.books[1]
+			want := storedBook()
+			want.Genre = tt.want
+			if got.Genre != want.Genre || got.Title != want.Title || got.Author != want.Author || got.PublishedYear != want.PublishedYear {
+				t.Errorf("book = %+v, want only the genre %q", got, want.Genre)
+			}
+		})
+	}
+}
+
+func TestPatchAndPut(t *testing.T) {
+	// catalogued is storedBook with the optional fields set
+	catalogued := storedBook()
+	catalogued.ISBN = "9780306406157"
+	catalogued.Genre = "science fiction"
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		status int
+		code   string      // error code, for failures
+		error  string      // part of the error message, for failures
+		want   models.Book // stored fields afterwards
+	}{
+		{
+			name:   "PATCH keeps omitted fields",
+			method: "PATCH",
+			body:   `{"title": "Dune Messiah"}`,
+			status: http.StatusOK,
+			want:   models.Book{Title: "Dune Messiah", Author: "Frank Herbert", PublishedYear: 1965, Available: true, ISBN: "9780306406157", Genre: "science fiction"},
+		},
+		{
+			name:   "PUT requires every field",
+			method: "PUT",
+			body:   `{"title": "Dune Messiah"}`,
+			status: http.StatusBadRequest,
+			code:   msgReplaceFieldsMissing,
+			error:  "missing: author, published_year, available.",
+			want:   models.Book{Title: "Dune", Author: "Frank Herbert", PublishedYear: 1965, Available: true, ISBN: "9780306406157", Genre: "science fiction"},
+		},
+		{
+			name:   "PUT clears omitted optional fields",
+			method: "PUT",
+			body:   `{"title": "Dune Messiah", "author": "Frank Herbert", "published_year": 1969, "available": false}`,
+			status: http.StatusOK,
+			want:   models.Book{Title: "Dune Messiah", Author: "Frank Herbert", PublishedYear: 1969},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newFakeRepository(catalogued)
+			h := NewBookHandler(repo)
+			handler := h.UpdateBook
+			if tt.method == "PUT" {
+				handler = h.ReplaceBook
+			}
+
+			rec := serve(handler, tt.method, "/api/v1/books/1", tt.body, map[string]string{"id": "1"})
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.code != "" {
+				if resp := decodeResponse(t, rec); resp.Code != tt.code || !strings.Contains(resp.Error, tt.error) {
+					t.Errorf("response = %+v, want code %q mentioning %q", resp, tt.code, tt.error)
+				}
+			}
+			got := *repo.books[1]
+			if got.Title != tt.want.Title || got.Author != tt.want.Author || got.PublishedYear != tt.want.PublishedYear ||
+				got.Available != tt.want.Available || got.ISBN != tt.want.ISBN || got.Genre != tt.want.Genre {
+				t.Errorf("book = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpdateBookNotFound(t *testing.T) {
+	h := NewBookHandler(newFakeRepository(storedBook()))
+	vars := map[string]string{"id": "2"}
+
+	tests := []struct {
+		handler http.HandlerFunc
+		method  string
+		body    string
+	}{
+		{h.UpdateBook, "PATCH", `{"title": "Dune Messiah"}`},
+		{h.UpdateBook, "PATCH", `{}`},
+		{h.ReplaceBook, "PUT", `{"title": "Dune Messiah", "author": "Frank Herbert", "published_year": 1969, "available": true}`},
+	}
+
+	for _, tt := range tests {
+		rec := serve(tt.handler, tt.method, "/api/v1/books/2", tt.body, vars)
+
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s %s: status = %d, want %d", tt.method, tt.body, rec.Code, http.StatusNotFound)
+			continue
+		}
+		if resp := decodeResponse(t, rec); resp.Code != msgBookNotFound || resp.Error != "Book not found" {
+			t.Errorf("%s %s: response = %+v, want book_not_found", tt.method, tt.body, resp)
+		}
+	}
+}
+
+func TestCountBooks(t *testing.T) {
+	h := NewBookHandler(newFakeRepository(
+		models.Book{ID: 1, Title: "Dune", Author: "Frank Herbert", PublishedYear: 1965, Available: true},
+		models.Book{ID: 2, Title: "Dune Messiah", Author: "Frank Herbert", PublishedYear: 1969, Available: false},
+		models.Book{ID: 3, Title: "Emma", Author: "Jane Austen", PublishedYear: 1815, Available: true, Genre: "romance"},
+	))
+
+	tests := []struct {
+		query  string
+		status int
+		want   int
+	}{
+		{"", http.StatusOK, 3},
+		{"q=dune", http.StatusOK, 2},
+		{"available=true", http.StatusOK, 2},
+		{"q=dune&available=true", http.StatusOK, 1},
+		{"year_min=1900&year_max=1966", http.StatusOK, 1},
+		{"genre=romance", http.StatusOK, 1},
+		{"q=tolkien", http.StatusOK, 0},
+		{"year_min=soon", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		rec := serve(h.CountBooks, "GET", "/api/v1/books/count?"+tt.query, "", nil)
+		if rec.Code != tt.status {
+			t.Errorf("%q: status = %d, want %d", tt.query, rec.Code, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		var resp struct {
+			Data models.BookCount `json:"data"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Data.Count != tt.want {
+			t.Errorf("%q: count = %d, want %d", tt.query, resp.Data.Count, tt.want)
+		}
+	}
+}
+
+func TestGetBooksMaxScore(t *testing.T) {
+	maxScore := 3.5
+
+	tests := []struct {
+		query    string
+		maxScore *float64 // returned by the repository
+		want     string   // the pagination's max_score, or empty without one
+	}{
+		{"q=dune", &maxScore, "3.5"},
+		{"q=dune", nil, ""},
+		{"", nil, ""},
+	}
+
+	for _, tt := range tests {
+		repo := newFakeRepository(storedBook())
+		repo.maxScore = tt.maxScore
+		h := NewBookHandler(repo)
+
+		rec := serve(h.GetBooks, "GET", "/api/v1/books?"+tt.query, "", nil)
+
+		var resp struct {
+			Pagination map[string]interface{} `json:"pagination"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if v, ok := resp.Pagination["max_score"]; ok {
+			got = fmt.Sprint(v)
+		}
+		if got != tt.want {
+			t.Errorf("%q: max_score = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestGetBooksCountOnly(t *testing.T) {
+	h := NewBookHandler(newFakeRepository(
+		models.Book{ID: 1, Title: "Dune", Author: "Frank Herbert", PublishedYear: 1965},
+		models.Book{ID: 2, Title: "Dune Messiah", Author: "Frank Herbert", PublishedYear: 1969},
+		models.Book{ID: 3, Title: "Children of Dune", Author: "Frank Herbert", PublishedYear: 1976},
+	))
+	h.searchCountOnlyThreshold = 2
+
+	tests := []struct {
+		query    string
+		language string
+		message  string // empty when the books are listed
+	}{
+		{"q=dune", "en", "Search matches more than 2 books; narrow the query or pass force=true to list them"},
+		{"q=dune", "es", "La búsqueda coincide con más de 2 libros; acótela o pase force=true para listarlos"},
+		{"q=dune&force=true", "en", ""},
+		{"q=messiah", "en", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query+"/"+tt.language, func(t *testing.T) {
+			rec := serveWithHeaders(h.GetBooks, "GET", "/api/v1/books?"+tt.query, "", nil, map[string]string{"Accept-Language": tt.language})
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+			}
+			resp := decodeResponse(t, rec)
+			if tt.message == "" {
+				if resp.Code != "" {
+					t.Errorf("code = %q, want the books listed", resp.Code)
+				}
+				return
+			}
+			if resp.Message != tt.message || resp.Code != msgSearchTooBroad {
+				t.Errorf("message = %q (%s), want %q (%s)", resp.Message, resp.Code, tt.message, msgSearchTooBroad)
+			}
+			if got := rec.Header().Get("Content-Language"); got != tt.language {
+				t.Errorf("Content-Language = %q, want %q", got, tt.language)
+			}
+		})
+	}
+}
+
+func TestExportBooks(t *testing.T) {
+	catalogued := storedBook()
+	catalogued.ISBN, catalogued.Genre = "9780306406157", "science fiction"
+	quoted := storedBook()
+	quoted.ID, quoted.Title, quoted.Available = 2, `Dune: "Deluxe", Annotated`, false
+	header := strings.Join(exportColumns, ",") + "\n"
+
+	tests := []struct {
+		name        string
+		query       string
+		books       []models.Book
+		status      int
+		contentType string
+		body        string
+	}{
+		{
+			name:        "csv",
+			books:       []models.Book{catalogued, quoted},
+			status:      http.StatusOK,
+			contentType: "text/csv",
+			body: header +
+				"1,Dune,Frank Herbert,1965,true,9780306406157,science fiction,2024-01-15T10:00:00Z\n" +
+				"2,\"Dune: \"\"Deluxe\"\", Annotated\",Frank Herbert,1965,false,,,2024-01-15T10:00:00Z\n",
+		},
+		{
+			name:        "json",
+			query:       "format=json",
+			books:       []models.Book{storedBook(), quoted},
+			status:      http.StatusOK,
+			contentType: "application/json",
+		},
+		{name: "empty csv", status: http.StatusOK, contentType: "text/csv", body: header},
+		{name: "empty json", query: "format=json", status: http.StatusOK, contentType: "application/json", body: "[]"},
+		{name: "unknown format", query: "format=xml", status: http.StatusBadRequest, contentType: "application/json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewBookHandler(newFakeRepository(tt.books...))
+
+			rec := serve(h.ExportBooks, "GET", "/api/v1/books/export?"+tt.query, "", nil)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if tt.body != "" && rec.Body.String() != tt.body {
+				t.Errorf("export =\n%s\nwant\n%s", rec.Body.String(), tt.body)
+			}
+			if tt.status == http.StatusOK && tt.query == "format=json" {
+				var books []models.Book
+				if err := json.Unmarshal(rec.Body.Bytes(), &books); err != nil || len(books) != len(tt.books) {
+					t.Errorf("export %s, want a JSON array of %d books (%v)", rec.Body.String(), len(tt.books), err)
+				}
+			}
+		})
+	}
+}
+
+func TestExportMatchingBooks(t *testing.T) {
+	books := []models.Book{
+		{ID: 1, Title: "Dune", Author: "Frank Herbert", PublishedYear: 1965, Available: true, Genre: "science fiction"},
+		{ID: 2, Title: "Dune Messiah", Author: "Frank Herbert", PublishedYear: 1969, Genre: "science fiction"},
+		{ID: 3, Title: "Emma", Author: "Jane Austen", PublishedYear: 1815, Available: true, Genre: "fiction"},
+	}
+
+	tests := []struct {
+		name        string
+		body        string
+		status      int
+		contentType string
+		ids         string // IDs of the exported books
+	}{
+		{name: "no body", status: http.StatusOK, contentType: "text/csv", ids: "[1 2 3]"},
+		{name: "author", body: `{"filter": {"author": "herbert"}}`, status: http.StatusOK, contentType: "text/csv", ids: "[1 2]"},
+		{
+			name:        "every filter",
+			body:        `{"format": "json", "filter": {"author": "Herbert", "year_min": 1960, "year_max": 1966, "available": true, "genre": "Science Fiction"}}`,
+			status:      http.StatusOK,
+			contentType: "application/json",
+			ids:         "[1]",
+		},
+		{name: "year range", body: `{"format": "json", "filter": {"year_min": 1900}}`, status: http.StatusOK, contentType: "application/json", ids: "[1 2]"},
+		{name: "nothing matches", body: `{"format": "json", "filter": {"genre": "poetry"}}`, status: http.StatusOK, contentType: "application/json", ids: "[]"},
+		{name: "inverted years", body: `{"filter": {"year_min": 2000, "year_max": 1900}}`, status: http.StatusBadRequest, contentType: "application/json"},
+		{name: "author too long", body: `{"filter": {"author": "` + strings.Repeat("a", maxTextLength+1) + `"}}`, status: http.StatusBadRequest, contentType: "application/json"},
+		{name: "unknown format", body: `{"format": "xml"}`, status: http.StatusBadRequest, contentType: "application/json"},
+		{name: "malformed", body: `{"filter": `, status: http.StatusBadRequest, contentType: "application/json"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewBookHandler(newFakeRepository(books...))
+
+			rec := serve(h.ExportMatchingBooks, "POST", "/api/v1/books/export", tt.body, nil)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			ids := []int{}
+			if tt.contentType == "text/csv" {
+				records, err := csv.NewReader(rec.Body).ReadAll()
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, record := range records[1:] {
+					id, _ := strconv.Atoi(record[0])
+					ids = append(ids, id)
+				}
+			} else {
+				var exported []models.Book
+				if err := json.Unmarshal(rec.Body.Bytes(), &exported); err != nil {
+					t.Fatalf("export %s is not a JSON array: %v", rec.Body.String(), err)
+				}
+				for _, book := range exported {
+					ids = append(ids, book.ID)
+				}
+			}
+			if got := fmt.Sprint(ids); got != tt.ids {
+				t.Errorf("exported books %s, want %s", got, tt.ids)
+			}
+		})
+	}
+}
+
+func TestGetBooksChangedSince(t *testing.T) {
+	jan := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+	feb := time.Date(2024, 2, 10, 0, 0, 0, 0, time.UTC)
+	mar := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	repo := newFakeRepository(
+		models.Book{ID: 1, Title: "Dune", Author: "Frank Herbert", PublishedYear: 1965, CreatedAt: jan, UpdatedAt: mar},
+		models.Book{ID: 2, Title: "Emma", Author: "Jane Austen", PublishedYear: 1815, CreatedAt: jan, UpdatedAt: jan},
+		models.Book{ID: 3, Title: "Ulysses", Author: "James Joyce", PublishedYear: 1922, CreatedAt: feb, UpdatedAt: feb},
+	)
+	h := NewBookHandler(repo)
+
+	tests := []struct {
+		query      string
+		want       string // book IDs, or the error code
+		sortBy     string
+		descending bool
+	}{
+		{"updated_since=2024-02-01T00:00:00Z", "[1 3]", "updated_at", false},
+		{"updated_since=2024-02-01T00:00:00%2B02:00", "[1 3]", "updated_at", false},
+		{"updated_since=2024-02-01T00:00:00Z&order=desc", "[1 3]", "updated_at", true},
+		{"updated_since=2024-02-01T00:00:00Z&sort=title", "[1 3]", "title", true},
+		{"created_since=2024-02-01T00:00:00Z", "[3]", "created_at", true},
+		{"updated_since=yesterday", msgInvalidTimestamp, "", false},
+		{"updated_since=2024-02-01", msgInvalidTimestamp, "", false},
+		{"created_since=" + url.QueryEscape("2024-02-01 00:00:00"), msgInvalidTimestamp, "", false},
+	}
+
+	for _, tt := range tests {
+		rec := serve(h.GetBooks, "GET", "/api/v1/books?"+tt.query, "", nil)
+
+		if tt.sortBy == "" {
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("%q: status = %d, want %d", tt.query, rec.Code, http.StatusBadRequest)
+			} else if resp := decodeResponse(t, rec); resp.Code != tt.want {
+				t.Errorf("%q: code = %q, want %q", tt.query, resp.Code, tt.want)
+			}
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			t.Errorf("%q: status = %d, want %d", tt.query, rec.Code, http.StatusOK)
+			continue
+		}
+		if got := fmt.Sprint(bookIDs(t, rec)); got != tt.want {
+			t.Errorf("%q: books %s, want %s", tt.query, got, tt.want)
+		}
+		if repo.lastSortBy != tt.sortBy || repo.lastDescending != tt.descending {
+			t.Errorf("%q: sorted by %s descending %v, want %s descending %v",
+				tt.query, repo.lastSortBy, repo.lastDescending, tt.sortBy, tt.descending)
+		}
+	}
+}
+
+func TestParsePagination(t *testing.T) {
+	limits := pageLimits{defaultLimit: 10, maxLimit: 100}
+
+	tests := []struct {
+		query string
+		page  int
+		limit int
+	}{
+		{"", 1, 10},
+		{"page=3&limit=25", 3, 25},
+		{"limit=100", 1, 100},
+		{"limit=101", 1, 100},
+		{"limit=100000", 1, 100},
+		{"limit=0", 1, 10},
+		{"limit=-5", 1, 10},
+		{"limit=ten", 1, 10},
+		{"page=0", 1, 10},
+		{"page=-2", 1, 10},
+	}
+
+	for _, tt := range tests {
+		page, limit := limits.parsePagination(httptest.NewRequest("GET", "/api/v1/books?"+tt.query, nil))
+		if page != tt.page || limit != tt.limit {
+			t.Errorf("%q: page %d limit %d, want page %d limit %d", tt.query, page, limit, tt.page, tt.limit)
+		}
+	}
+}
+
+func TestPageLimitsFromEnv(t *testing.T) {
+	tests := []struct {
+		defaultLimit, maxLimit string
+		want                   pageLimits
+	}{
+		{"", "", pageLimits{defaultLimit: 10, maxLimit: 100}},
+		{"20", "50", pageLimits{defaultLimit: 20, maxLimit: 50}},
+		{"0", "many", pageLimits{defaultLimit: 10, maxLimit: 100}},
+		{"80", "50", pageLimits{defaultLimit: 50, maxLimit: 50}},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("DEFAULT_PAGE_LIMIT", tt.defaultLimit)
+		t.Setenv("MAX_PAGE_LIMIT", tt.maxLimit)
+		if got := pageLimitsFromEnv(); got != tt.want {
+			t.Errorf("DEFAULT_PAGE_LIMIT=%q MAX_PAGE_LIMIT=%q: %+v, want %+v", tt.defaultLimit, tt.maxLimit, got, tt.want)
+		}
+	}
+}
+
+func TestGetBooksClampsLimit(t *testing.T) {
+	t.Setenv("DEFAULT_PAGE_LIMIT", "5")
+	t.Setenv("MAX_PAGE_LIMIT", "20")
+	repo := newFakeRepository(storedBook())
+	h := NewBookHandler(repo)
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"limit=500", 20},
+		{"limit=0", 5},
+		{"", 5},
+	}
+
+	for _, tt := range tests {
+		rec := serve(h.GetBooks, "GET", "/api/v1/books?"+tt.query, "", nil)
+		var resp struct {
+			Pagination models.Pagination `json:"pagination"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusOK {
+			t.Errorf("%q: status = %d: %s", tt.query, rec.Code, rec.Body.String())
+			continue
+		}
+		if repo.lastLimit != tt.want || resp.Pagination.Limit != tt.want {
+			t.Errorf("%q: limit %d (reported %d), want %d", tt.query, repo.lastLimit, resp.Pagination.Limit, tt.want)
+		}
+	}
+}
+
+func TestGetBooksLinkHeader(t *testing.T) {
+	var books []models.Book
+	for id := 1; id <= 5; id++ {
+		books = append(books, models.Book{ID: id, Title: fmt.Sprintf("Book %d", id), Author: "Author", PublishedYear: 2000, Available: true})
+	}
+	h := NewBookHandler(newFakeRepository(books...))
+
+	// Other query parameters are kept
+	link := func(page int, rel string) string {
+		return fmt.Sprintf(`</api/v1/books?available=true&limit=2&page=%d>; rel="%s"`, page, rel)
+	}
+
+	tests := []struct {
+		page int
+		want []string
+	}{
+		{1, []string{link(1, "first"), link(2, "next"), link(3, "last")}},
+		{2, []string{link(1, "first"), link(1, "prev"), link(3, "next"), link(3, "last")}},
+		{3, []string{link(1, "first"), link(2, "prev"), link(3, "last")}},
+	}
+
+	for _, tt := range tests {
+		rec := serve(h.GetBooks, "GET", fmt.Sprintf("/api/v1/books?available=true&limit=2&page=%d", tt.page), "", nil)
+		if got, want := rec.Header().Get("Link"), strings.Join(tt.want, ", "); got != want {
+			t.Errorf("page %d: Link =\n%s\nwant\n%s", tt.page, got, want)
+		}
+	}
+}
+
+func TestPaginationLinksWithoutTotal(t *testing.T) {
+	// Without a total there is no last page to link to
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/api/v1/books?page=2&limit=10", nil)
+	pagination := newPagination(2, 10, -1)
+	pagination.HasNext = true
+
+	setPaginationLinks(rec, req, pagination)
+
+	want := `</api/v1/books?limit=10&page=1>; rel="first", </api/v1/books?limit=10&page=1>; rel="prev", </api/v1/books?limit=10&page=3>; rel="next"`
+	if got := rec.Header().Get("Link"); got != want {
+		t.Errorf("Link =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestGetRandomBook(t *testing.T) {
+	lent := storedBook()
+	lent.Available = false
+	onShelf := storedBook()
+	onShelf.ID, onShelf.Title = 2, "Dune Messiah"
+
+	tests := []struct {
+		name   string
+		books  []models.Book
+		query  string
+		status int
+		want   int // picked book ID, for 200s
+	}{
+		{"only available by default", []models.Book{lent, onShelf}, "", http.StatusOK, 2},
+		{"explicit filter", []models.Book{lent, onShelf}, "available=false", http.StatusOK, 1},
+		{"empty catalog", nil, "", http.StatusNotFound, 0},
+		{"no available book", []models.Book{lent}, "", http.StatusNotFound, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewBookHandler(newFakeRepository(tt.books...))
+
+			rec := serve(h.GetRandomBook, "GET", "/api/v1/books/random?"+tt.query, "", nil)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				if resp := decodeResponse(t, rec); resp.Code != msgNoMatchingBooks {
+					t.Errorf("code = %q, want %q", resp.Code, msgNoMatchingBooks)
+				}
+				return
+			}
+			var book models.Book
+			decodeData(t, rec, &book)
+			if book.ID != tt.want {
+				t.Errorf("picked book %d, want %d", book.ID, tt.want)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != "no-store" {
+				t.Errorf("Cache-Control = %q, want no-store", got)
+			}
+		})
+	}
+}
+
+func TestGetBooksTitleAndAuthor(t *testing.T) {
+	repo := newFakeRepository(
+		models.Book{ID: 1, Title: "Dune", Author: "Frank Herbert", PublishedYear: 1965},
+		models.Book{ID: 2, Title: "Dune Messiah", Author: "Frank Herbert", PublishedYear: 1969},
+		models.Book{ID: 3, Title: "The Dosadi Experiment", Author: "Frank Herbert", PublishedYear: 1977},
+		models.Book{ID: 4, Title: "Frankenstein", Author: "Mary Shelley", PublishedYear: 1818},
+	)
+	h := NewBookHandler(repo)
+
+	tests := []struct {
+		query string
+		want  string // book IDs, or the status for rejected queries
+	}{
+		{"title=dune", "[1 2]"},
+		{"author=herbert", "[1 2 3]"},
+		{"title=dune&author=herbert", "[1 2]"},
+		{"title=frank", "[4]"},
+		{"author=frank&title=experiment", "[3]"},
+		{"title=dune&author=shelley", "[]"},
+		{"title=%20Dune%20&author=%20Herbert", "[1 2]"},
+		{"q=frank", "[1 2 3 4]"},
+		{"title=" + strings.Repeat("a", maxTextLength+1), "400"},
+	}
+
+	for _, tt := range tests {
+		rec := serve(h.GetBooks, "GET", "/api/v1/books?"+tt.query, "", nil)
+		if rec.Code != http.StatusOK {
+			if got := fmt.Sprint(rec.Code); got != tt.want {
+				t.Errorf("%q: status = %s, want %s", tt.query, got, tt.want)
+			}
+			continue
+		}
+		if got := fmt.Sprint(bookIDs(t, rec)); got != tt.want {
+			t.Errorf("%q: books %s, want %s", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestGetYearCountsFilters(t *testing.T) {
+	h := NewBookHandler(newFakeRepository(
+		models.Book{ID: 1, Title: "Dune", Author: "Frank Herbert", PublishedYear: 1965, Available: true},
+		models.Book{ID: 2, Title: "Dune Messiah", Author: "Frank Herbert", PublishedYear: 1969},
+		models.Book{ID: 3, Title: "Children of Dune", Author: "Frank Herbert", PublishedYear: 1976, Available: true},
+		models.Book{ID: 4, Title: "Emma", Author: "Jane Austen", PublishedYear: 1815, Available: true},
+	))
+
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"", "[{1815 1} {1965 1} {1969 1} {1976 1}]"},
+		{"q=dune", "[{1965 1} {1969 1} {1976 1}]"},
+		{"author=herbert&available=true", "[{1965 1} {1976 1}]"},
+		{"q=dune&year_max=1970", "[{1965 1} {1969 1}]"},
+	}
+
+	for _, tt := range tests {
+		rec := serve(h.GetYearCounts, "GET", "/api/v1/books/years?"+tt.query, "", nil)
+		var years []models.YearCount
+		decodeData(t, rec, &years)
+		if got := fmt.Sprint(years); got != tt.want {
+			t.Errorf("%q: years %s, want %s", tt.query, got, tt.want)
+		}
+	}
+
+	if rec := serve(h.GetYearCounts, "GET", "/api/v1/books/years?year_min=soon", "", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid filter: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
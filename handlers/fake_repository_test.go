@@ -0,0 +1,516 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"library-api/db"
+	"library-api/models"
+	"sort"
+	"strings"
+	"time"
+)
+
+// errNotSupported is returned by the fakeRepository methods no test needs
+var errNotSupported = errors.New("not supported by fakeRepository")
+
+// fakeRepository is an in-memory BookRepository for handler tests. Books
+// are kept by ID, and the arguments of the last list call are recorded so
+// tests can check what the handler asked for.
+type fakeRepository struct {
+	books  map[int]*models.Book
+	nextID int
+	// importBatches holds the import batch ID of the books imported
+	importBatches map[int]string
+
+	// err, when set, is returned by every method instead of its result
+	err error
+	// maxScore is returned by SearchBooks as the highest relevance score
+	maxScore *float64
+
+	lastQuery      string
+	lastFilter     db.BookFilter
+	lastSortBy     string
+	lastDescending bool
+	lastCollation  string
+	lastPage       int
+	lastLimit      int
+}
+
+// newFakeRepository returns a fakeRepository holding the given books
+func newFakeRepository(books ...models.Book) *fakeRepository {
+	repo := &fakeRepository{books: make(map[int]*models.Book), nextID: 1, importBatches: make(map[int]string)}
+	for _, book := range books {
+		book := book
+		repo.books[book.ID] = &book
+		if book.ID >= repo.nextID {
+			repo.nextID = book.ID + 1
+		}
+	}
+	return repo
+}
+
+// sorted returns copies of the books matching the filter in ID order
+func (f *fakeRepository) sorted(query string, filter db.BookFilter) []models.Book {
+	var books []models.Book
+	for _, book := range f.books {
+		if fakeMatches(book, query, filter) && (filter.ImportBatch == "" || f.importBatches[book.ID] == filter.ImportBatch) {
+			books = append(books, *book)
+		}
+	}
+	sort.Slice(books, func(i, j int) bool { return books[i].ID < books[j].ID })
+	return books
+}
+
+// fakeMatches applies the parts of a search and filter the fake supports
+func fakeMatches(book *models.Book, query string, filter db.BookFilter) bool {
+	contains := func(s, sub string) bool {
+		return strings.Contains(strings.ToLower(s), strings.ToLower(sub))
+	}
+
+	switch {
+	case query != "" && !contains(book.Title, query) && !contains(book.Author, query):
+		return false
+	case filter.Title != "" && !contains(book.Title, filter.Title):
+		return false
+	case filter.Author != "" && !contains(book.Author, filter.Author):
+		return false
+	case filter.IDMin > 0 && book.ID < filter.IDMin:
+		return false
+	case filter.IDMax > 0 && book.ID > filter.IDMax:
+		return false
+	case filter.Available != nil && book.Available != *filter.Available:
+		return false
+	case filter.YearMin != nil && book.PublishedYear < *filter.YearMin:
+		return false
+	case filter.YearMax != nil && book.PublishedYear > *filter.YearMax:
+		return false
+	case filter.Genre != "" && book.Genre != filter.Genre:
+		return false
+	case filter.UpdatedSince != nil && book.UpdatedAt.Before(*filter.UpdatedSince):
+		return false
+	case filter.CreatedSince != nil && book.CreatedAt.Before(*filter.CreatedSince):
+		return false
+	}
+	return true
+}
+
+// page returns one page of books and their total
+func fakePage(books []models.Book, page, limit int) ([]models.Book, int) {
+	total := len(books)
+	start := (page - 1) * limit
+	if start > total {
+		start = total
+	}
+	end := start + limit
+	if end > total {
+		end = total
+	}
+	return books[start:end], total
+}
+
+func (f *fakeRepository) GetBooks(ctx context.Context, filter db.BookFilter, sortBy string, descending bool, collation string, page, limit int, countTotal bool) ([]models.Book, int, error) {
+	f.lastQuery, f.lastFilter, f.lastSortBy, f.lastDescending, f.lastCollation, f.lastPage, f.lastLimit = "", filter, sortBy, descending, collation, page, limit
+	if f.err != nil {
+		return nil, 0, f.err
+	}
+	books, total := fakePage(f.sorted("", filter), page, limit)
+	return books, total, nil
+}
+
+func (f *fakeRepository) GetRandomBook(ctx context.Context, filter db.BookFilter) (*models.Book, error) {
+	f.lastFilter = filter
+	if f.err != nil {
+		return nil, f.err
+	}
+	books := f.sorted("", filter)
+	if len(books) == 0 {
+		return nil, nil
+	}
+	return &books[0], nil
+}
+
+func (f *fakeRepository) ForEachBook(ctx context.Context, filter db.BookFilter, fn func(models.Book) error) error {
+	f.lastFilter = filter
+	if f.err != nil {
+		return f.err
+	}
+	for _, book := range f.sorted("", filter) {
+		if err := fn(book); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeRepository) GetBooksAfter(ctx context.Context, filter db.BookFilter, descending bool, after *db.BookCursor, limit int) ([]models.Book, *db.BookCursor, error) {
+	f.lastFilter, f.lastDescending, f.lastLimit = filter, descending, limit
+	if f.err != nil {
+		return nil, nil, f.err
+	}
+
+	// Order by creation time and ID, as the keyset query does
+	before := func(a, b models.Book) bool {
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt) != descending
+		}
+		if descending {
+			return a.ID > b.ID
+		}
+		return a.ID < b.ID
+	}
+	books := f.sorted("", filter)
+	sort.Slice(books, func(i, j int) bool { return before(books[i], books[j]) })
+
+	if after != nil {
+		key := models.Book{ID: after.ID, CreatedAt: after.CreatedAt}
+		start := sort.Search(len(books), func(i int) bool { return before(key, books[i]) })
+		books = books[start:]
+	}
+
+	var next *db.BookCursor
+	if len(books) > limit {
+		books = books[:limit]
+		last := books[limit-1]
+		next = &db.BookCursor{CreatedAt: last.CreatedAt, ID: last.ID}
+	}
+	return books, next, nil
+}
+
+func (f *fakeRepository) SearchBooks(ctx context.Context, query string, filter db.BookFilter, page, limit, countOnlyAbove int, countTotal bool) ([]models.Book, int, *float64, error) {
+	f.lastQuery, f.lastFilter, f.lastPage, f.lastLimit = query, filter, page, limit
+	if f.err != nil {
+		return nil, 0, nil, f.err
+	}
+	books, total := fakePage(f.sorted(query, filter), page, limit)
+	return books, total, f.maxScore, nil
+}
+
+func (f *fakeRepository) StreamBooks(ctx context.Context, query string, filter db.BookFilter, sortBy string, descending bool, collation string, page, limit int, fn func(models.Book) error) error {
+	f.lastQuery, f.lastFilter, f.lastSortBy, f.lastDescending, f.lastCollation, f.lastPage, f.lastLimit = query, filter, sortBy, descending, collation, page, limit
+	if f.err != nil {
+		return f.err
+	}
+	books, _ := fakePage(f.sorted(query, filter), page, limit)
+	for _, book := range books {
+		if err := fn(book); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeRepository) CountBooks(ctx context.Context, query string, filter db.BookFilter) (int, error) {
+	f.lastQuery, f.lastFilter = query, filter
+	if f.err != nil {
+		return 0, f.err
+	}
+	return len(f.sorted(query, filter)), nil
+}
+
+func (f *fakeRepository) GetBookByID(ctx context.Context, id int) (*models.Book, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	book, ok := f.books[id]
+	if !ok {
+		return nil, nil
+	}
+	found := *book
+	return &found, nil
+}
+
+func (f *fakeRepository) TouchBook(ctx context.Context, id int) error {
+	if f.err != nil {
+		return f.err
+	}
+	if book, ok := f.books[id]; ok {
+		now := time.Now()
+		book.LastAccessedAt = &now
+	}
+	return nil
+}
+
+// checkCreate fails like the database would for books that can't be added
+// together
+func (f *fakeRepository) checkCreate(reqs []models.CreateBookRequest, maxPerAuthor int) error {
+	isbns := make(map[string]bool)
+	perAuthor := make(map[string]int)
+	for _, book := range f.books {
+		if book.ISBN != "" {
+			isbns[book.ISBN] = true
+		}
+		perAuthor[book.Author]++
+	}
+
+	for _, req := range reqs {
+		if req.ISBN != "" {
+			if isbns[req.ISBN] {
+				return db.ErrDuplicate
+			}
+			isbns[req.ISBN] = true
+		}
+		perAuthor[req.Author]++
+		if maxPerAuthor > 0 && perAuthor[req.Author] > maxPerAuthor {
+			return db.ErrAuthorLimitReached
+		}
+	}
+	return nil
+}
+
+// insert stores a new book created from req
+func (f *fakeRepository) insert(req models.CreateBookRequest) models.Book {
+	now := time.Now()
+	book := models.Book{
+		ID:            f.nextID,
+		Title:         req.Title,
+		Author:        req.Author,
+		ISBN:          req.ISBN,
+		Genre:         req.Genre,
+		PublishedYear: req.PublishedYear,
+		Available:     req.Available == nil || *req.Available,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	f.nextID++
+	f.books[book.ID] = &book
+	return book
+}
+
+func (f *fakeRepository) CreateBook(ctx context.Context, req models.CreateBookRequest, maxPerAuthor int) (*models.Book, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if err := f.checkCreate([]models.CreateBookRequest{req}, maxPerAuthor); err != nil {
+		return nil, err
+	}
+	book := f.insert(req)
+	return &book, nil
+}
+
+func (f *fakeRepository) CreateBooks(ctx context.Context, reqs []models.CreateBookRequest, maxPerAuthor int) ([]models.Book, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if err := f.checkCreate(reqs, maxPerAuthor); err != nil {
+		return nil, err
+	}
+	books := make([]models.Book, 0, len(reqs))
+	for _, req := range reqs {
+		books = append(books, f.insert(req))
+	}
+	return books, nil
+}
+
+func (f *fakeRepository) ImportBooks(ctx context.Context, reqs []models.CreateBookRequest, importBatchID string, batchSize, maxPerAuthor int) (int, error) {
+	books, err := f.CreateBooks(ctx, reqs, maxPerAuthor)
+	for _, book := range books {
+		f.importBatches[book.ID] = importBatchID
+	}
+	return len(books), err
+}
+
+func (f *fakeRepository) MatchBooks(ctx context.Context, reqs []models.CreateBookRequest, key string) ([]int, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	ids := make([]int, len(reqs))
+	for i, req := range reqs {
+		for _, book := range f.sorted("", db.BookFilter{}) {
+			byISBN := key == db.ImportKeyISBN && req.ISBN != "" && book.ISBN == req.ISBN
+			byTitle := key == db.ImportKeyTitleAuthorYear &&
+				book.Title == req.Title && book.Author == req.Author && book.PublishedYear == req.PublishedYear
+			if byISBN || byTitle {
+				ids[i] = book.ID
+				break
+			}
+		}
+	}
+	return ids, nil
+}
+
+func (f *fakeRepository) UpsertBooks(ctx context.Context, reqs []models.CreateBookRequest, ids []int, importBatchID string, batchSize, maxPerAuthor int) (int, int, error) {
+	if f.err != nil {
+		return 0, 0, f.err
+	}
+	var creates []models.CreateBookRequest
+	for i, req := range reqs {
+		if ids[i] == 0 {
+			creates = append(creates, req)
+		}
+	}
+	if err := f.checkCreate(creates, maxPerAuthor); err != nil {
+		return 0, 0, err
+	}
+
+	for i, req := range reqs {
+		if ids[i] == 0 {
+			f.importBatches[f.insert(req).ID] = importBatchID
+			continue
+		}
+		book := f.books[ids[i]]
+		book.Title, book.Author, book.ISBN, book.Genre = req.Title, req.Author, req.ISBN, req.Genre
+		book.PublishedYear, book.Available = req.PublishedYear, req.Available == nil || *req.Available
+	}
+	return len(creates), len(reqs) - len(creates), nil
+}
+
+func (f *fakeRepository) ExistingISBNs(ctx context.Context, isbns []string) (map[string]bool, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	existing := make(map[string]bool)
+	for _, book := range f.books {
+		for _, isbn := range isbns {
+			if book.ISBN == isbn {
+				existing[isbn] = true
+			}
+		}
+	}
+	return existing, nil
+}
+
+func (f *fakeRepository) CountBooksByAuthor(ctx context.Context, authors []string) (map[string]int, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	counts := make(map[string]int, len(authors))
+	for _, author := range authors {
+		for _, book := range f.books {
+			if book.Author == author {
+				counts[author]++
+			}
+		}
+	}
+	return counts, nil
+}
+
+func (f *fakeRepository) UpdateBook(ctx context.Context, id int, req models.UpdateBookRequest, matches func(*models.Book) bool) (*models.Book, bool, error) {
+	if f.err != nil {
+		return nil, false, f.err
+	}
+	book, ok := f.books[id]
+	if !ok {
+		return nil, false, db.ErrNotFound
+	}
+	if matches != nil && !matches(book) {
+		return nil, false, db.ErrPreconditionFailed
+	}
+	if req.ISBN != nil && *req.ISBN != "" && *req.ISBN != book.ISBN {
+		for _, other := range f.books {
+			if other.ISBN == *req.ISBN {
+				return nil, false, db.ErrDuplicate
+			}
+		}
+	}
+
+	updated := *book
+	if req.Title != nil {
+		updated.Title = *req.Title
+	}
+	if req.Author != nil {
+		updated.Author = *req.Author
+	}
+	if req.ISBN != nil {
+		updated.ISBN = *req.ISBN
+	}
+	if req.Genre != nil {
+		updated.Genre = *req.Genre
+	}
+	if req.PublishedYear != nil {
+		updated.PublishedYear = *req.PublishedYear
+	}
+	if req.Available != nil {
+		updated.Available = *req.Available
+	}
+
+	// As in the database, only a real change bumps updated_at
+	changed := updated != *book
+	if changed {
+		updated.UpdatedAt = time.Now()
+		*book = updated
+	}
+	result := *book
+	return &result, changed, nil
+}
+
+func (f *fakeRepository) ReplaceBook(ctx context.Context, id int, req models.CreateBookRequest, matches func(*models.Book) bool) (*models.Book, bool, error) {
+	return f.UpdateBook(ctx, id, models.UpdateBookRequest{
+		Title:         &req.Title,
+		Author:        &req.Author,
+		ISBN:          &req.ISBN,
+		Genre:         &req.Genre,
+		PublishedYear: &req.PublishedYear,
+		Available:     req.Available,
+	}, matches)
+}
+
+func (f *fakeRepository) PreviewUpdate(ctx context.Context, id int, req models.UpdateBookRequest) (*models.UpdatePreview, error) {
+	return nil, errNotSupported
+}
+
+func (f *fakeRepository) DeleteBook(ctx context.Context, id int) error {
+	if f.err != nil {
+		return f.err
+	}
+	if _, ok := f.books[id]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(f.books, id)
+	return nil
+}
+
+func (f *fakeRepository) DeleteImportBatch(ctx context.Context, importBatchID string) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	deleted := 0
+	for id, batchID := range f.importBatches {
+		if _, ok := f.books[id]; ok && batchID == importBatchID {
+			delete(f.books, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (f *fakeRepository) GetYearCounts(ctx context.Context, query string, filter db.BookFilter) ([]models.YearCount, error) {
+	f.lastQuery, f.lastFilter = query, filter
+	if f.err != nil {
+		return nil, f.err
+	}
+	counts := make(map[int]int)
+	for _, book := range f.sorted(query, filter) {
+		counts[book.PublishedYear]++
+	}
+	years := []models.YearCount{}
+	for year, count := range counts {
+		years = append(years, models.YearCount{Year: year, Count: count})
+	}
+	sort.Slice(years, func(i, j int) bool { return years[i].Year < years[j].Year })
+	return years, nil
+}
+
+func (f *fakeRepository) GetAvailabilityChanges(ctx context.Context, since time.Time, page, limit int) ([]models.Book, int, error) {
+	return nil, 0, errNotSupported
+}
+
+func (f *fakeRepository) GetStaleBooks(ctx context.Context, before time.Time, page, limit int) ([]models.Book, int, error) {
+	return nil, 0, errNotSupported
+}
+
+func (f *fakeRepository) CountMatrix(ctx context.Context, rowColumn, colColumn string) (map[string]map[string]int, error) {
+	return nil, errNotSupported
+}
+
+func (f *fakeRepository) GetFeaturedBooks(ctx context.Context, orderBy string, descending bool) ([]models.Book, error) {
+	return nil, errNotSupported
+}
+
+func (f *fakeRepository) SetFeatured(ctx context.Context, id int, featured bool, maxFeatured int) (*models.Book, error) {
+	return nil, errNotSupported
+}
+
+func (f *fakeRepository) GetEditions(ctx context.Context, book *models.Book) ([]models.Book, error) {
+	return nil, errNotSupported
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"library-api/models"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type HealthHandler struct {
+	db *sql.DB
+
+	// pingTimeout bounds the database ping made by the readiness probe
+	pingTimeout time.Duration
+
+	// draining is set once shutdown begins, so the readiness probe fails
+	// while in-flight requests finish
+	draining atomic.Bool
+}
+
+func NewHealthHandler(database *sql.DB) *HealthHandler {
+	h := &HealthHandler{
+		db:          database,
+		pingTimeout: 2 * time.Second,
+	}
+
+	if v := os.Getenv("READY_PING_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			h.pingTimeout = d
+		} else {
+			logrus.Warnf("Invalid READY_PING_TIMEOUT %q, using %s", v, h.pingTimeout)
+		}
+	}
+
+	return h
+}
+
+// Health handles GET /health. It only reports that the process is serving
+// requests, so it never touches the database.
+func (h *HealthHandler) Health(w http.ResponseWriter, r *http.Request) {
+	sendJSONResponse(w, http.StatusOK, models.HealthStatus{
+		Status:    "healthy",
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	})
+}
+
+// BeginShutdown makes the readiness probe report the server as unavailable,
+// so load balancers stop routing new requests to it
+func (h *HealthHandler) BeginShutdown() {
+	h.draining.Store(true)
+}
+
+// Ready handles GET /ready, pinging the database and returning 503 if it
+// doesn't answer within the ping timeout or the server is shutting down
+func (h *HealthHandler) Ready(w http.ResponseWriter, r *http.Request) {
+	if h.draining.Load() {
+		setRetryAfter(w, defaultRetryAfter)
+		sendJSONResponse(w, http.StatusServiceUnavailable, models.ReadinessStatus{
+			Status: "shutting_down",
+			Error:  "Server is shutting down",
+		})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.pingTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := h.db.PingContext(ctx)
+	latency := time.Since(start)
+
+	status := models.ReadinessStatus{
+		Status:      "ready",
+		DBLatencyMs: latency.Milliseconds(),
+	}
+
+	if err != nil {
+		logrus.WithError(err).Warn("Readiness check failed to ping database")
+		status.Status = "unavailable"
+		status.Error = "Database is unreachable"
+		setRetryAfter(w, defaultRetryAfter)
+		sendJSONResponse(w, http.StatusServiceUnavailable, status)
+		return
+	}
+
+	sendJSONResponse(w, http.StatusOK, status)
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestProbes(t *testing.T) {
+	tests := []struct {
+		name       string
+		probe      func(h *HealthHandler) http.HandlerFunc
+		ping       bool // whether the probe pings the database
+		pingErr    error
+		status     int
+		body       string
+		retryAfter bool
+	}{
+		{
+			name:   "health",
+			probe:  func(h *HealthHandler) http.HandlerFunc { return h.Health },
+			status: http.StatusOK,
+			body:   "healthy",
+		},
+		{
+			name:   "ready",
+			probe:  func(h *HealthHandler) http.HandlerFunc { return h.Ready },
+			ping:   true,
+			status: http.StatusOK,
+			body:   "ready",
+		},
+		{
+			name:       "ping fails",
+			probe:      func(h *HealthHandler) http.HandlerFunc { return h.Ready },
+			ping:       true,
+			pingErr:    errors.New("connection refused"),
+			status:     http.StatusServiceUnavailable,
+			body:       "unavailable",
+			retryAfter: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Without an expected ping, a probe pinging the database fails
+			database, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer database.Close()
+			if tt.ping {
+				mock.ExpectPing().WillReturnError(tt.pingErr)
+			}
+			h := NewHealthHandler(database)
+
+			rec := serve(tt.probe(h), "GET", "/", "", nil)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			var body struct {
+				Status string `json:"status"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body.Status != tt.body {
+				t.Errorf("body = %s, want status %q", rec.Body.String(), tt.body)
+			}
+			if got := rec.Header().Get("Retry-After") != ""; got != tt.retryAfter {
+				t.Errorf("Retry-After set = %v, want %v", got, tt.retryAfter)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
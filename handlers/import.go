@@ -0,0 +1,521 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"library-api/db"
+	"library-api/models"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// importMaxMemory is how much of an upload ParseMultipartForm keeps in
+// memory before spilling to disk. Uploads are already capped by the
+// server's body size limit.
+const importMaxMemory = 4 << 20
+
+// importRow is one parsed row of an import file. msg is set instead of req
+// when the row couldn't be parsed. In upsert mode, matchID is the stored
+// book the row replaces, or 0 when it creates one.
+type importRow struct {
+	line       int
+	req        models.CreateBookRequest
+	msg        *message
+	violations []fieldViolation
+	matchID    int
+}
+
+// importOptions are how an import writes its rows
+type importOptions struct {
+	// upsert replaces the stored book with the same key as a row instead of
+	// creating another
+	upsert bool
+	key    string
+}
+
+// ImportBooks handles POST /api/v1/books/import. It takes a CSV or JSON file
+// in the multipart form field "file" and creates a book for every valid row,
+// in batches inside one transaction. Invalid rows are skipped and reported
+// with their line numbers. With dry_run=true the rows are only validated.
+// With mode=upsert, a row with the key of a stored book, its ISBN or with
+// key=title_author_year its title, author and year, replaces that book, so
+// the same file can be imported again.
+func (h *BookHandler) ImportBooks(w http.ResponseWriter, r *http.Request) {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+
+	opts, ok := parseImportOptions(r)
+	if !ok {
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgInvalidImportMode))
+		return
+	}
+
+	if err := r.ParseMultipartForm(importMaxMemory); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			sendErrorResponse(w, r, http.StatusRequestEntityTooLarge, newMessage(msgBodyTooLarge, tooLarge.Limit))
+			return
+		}
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgImportFileRequired))
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgImportFileRequired))
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgUnreadableBody))
+		return
+	}
+
+	var rows []importRow
+	var msg *message
+	if isJSONImport(header.Filename, data) {
+		rows, msg = parseJSONImport(data)
+	} else {
+		rows, msg = parseCSVImport(data)
+	}
+	if msg != nil {
+		sendErrorResponse(w, r, http.StatusBadRequest, msg)
+		return
+	}
+
+	lang := requestLanguage(r)
+	result := models.ImportResult{
+		DryRun: dryRun,
+		Errors: []models.ImportRowError{},
+	}
+
+	for i := range rows {
+		if rows[i].msg == nil {
+			rows[i].violations = h.validateCreate(&rows[i].req)
+			if len(rows[i].violations) > 0 {
+				rows[i].msg = rows[i].violations[0].msg
+			}
+		}
+	}
+	if err := h.markImportConflicts(r.Context(), rows, opts); err != nil {
+		logrus.WithError(err).Error("Failed to check import conflicts")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgImportBooksFailed))
+		return
+	}
+
+	var reqs []models.CreateBookRequest
+	var matchIDs []int
+	for _, row := range rows {
+		if row.msg != nil {
+			result.Errors = append(result.Errors, importRowError(row, lang))
+			continue
+		}
+		reqs = append(reqs, row.req)
+		matchIDs = append(matchIDs, row.matchID)
+	}
+	result.Valid = len(reqs)
+
+	if !dryRun {
+		batchID, err := newImportBatchID()
+		if err != nil {
+			logrus.WithError(err).Error("Failed to generate import batch ID")
+			sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgImportBooksFailed))
+			return
+		}
+
+		// Conflicts were already reported by row, so these only happen when
+		// another write races the import
+		if opts.upsert {
+			result.Inserted, result.Updated, err = h.books.UpsertBooks(r.Context(), reqs, matchIDs, batchID, maxBatchCreate, h.maxBooksPerAuthor)
+		} else {
+			result.Inserted, err = h.books.ImportBooks(r.Context(), reqs, batchID, maxBatchCreate, h.maxBooksPerAuthor)
+		}
+		if err == db.ErrAuthorLimitReached {
+			h.sendAuthorLimitResponse(w, r)
+			return
+		}
+		if err == db.ErrDuplicate {
+			sendDuplicateResponse(w, r)
+			return
+		}
+		if err != nil {
+			logrus.WithError(err).Error("Failed to import books")
+			sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgImportBooksFailed))
+			return
+		}
+		if result.Inserted > 0 {
+			result.ImportBatchID = batchID
+		}
+	}
+
+	w.Header().Set("Content-Language", lang)
+	response := models.APIResponse{
+		Success: true,
+		Data:    result,
+	}
+
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// DeleteImportBatch handles DELETE /api/v1/books/import-batch/{batch}. It
+// deletes every book created by one import, in a single transaction, and
+// reports how many there were.
+func (h *BookHandler) DeleteImportBatch(w http.ResponseWriter, r *http.Request) {
+	batchID := strings.ToLower(mux.Vars(r)["batch"])
+	if !isImportBatchID(batchID) {
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgInvalidImportBatch, "batch"))
+		return
+	}
+
+	deleted, err := h.books.DeleteImportBatch(r.Context(), batchID)
+	if err != nil {
+		logrus.WithError(err).WithField("import_batch_id", batchID).Error("Failed to delete import batch")
+		sendErrorResponse(w, r, http.StatusInternalServerError, newMessage(msgDeleteImportBatchFailed))
+		return
+	}
+	if deleted == 0 {
+		sendErrorResponse(w, r, http.StatusNotFound, newMessage(msgImportBatchNotFound))
+		return
+	}
+
+	response := models.APIResponse{
+		Success: true,
+		Message: "Import batch deleted successfully",
+		Data:    models.ImportBatchDeletion{ImportBatchID: batchID, Deleted: deleted},
+	}
+
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// newImportBatchID returns a random (version 4) UUID identifying the books
+// created by one import
+func newImportBatchID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+}
+
+// isImportBatchID reports whether id is a lower-case UUID in its canonical
+// hyphenated form, as import batch IDs are stored
+func isImportBatchID(id string) bool {
+	if len(id) != 36 {
+		return false
+	}
+	for i, c := range id {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdef", c) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// parseImportOptions reads the import's mode and upsert key, reporting
+// whether they are valid
+func parseImportOptions(r *http.Request) (importOptions, bool) {
+	opts := importOptions{key: db.ImportKeyISBN}
+	switch r.URL.Query().Get("mode") {
+	case "", "insert":
+	case "upsert":
+		opts.upsert = true
+	default:
+		return opts, false
+	}
+	if key := r.URL.Query().Get("key"); key != "" {
+		opts.key = key
+	}
+	return opts, db.IsImportKey(opts.key)
+}
+
+// markImportConflicts flags the valid rows that would fail on insert: those
+// whose ISBN is used on an earlier line or by a stored book, and those that
+// would take their author over the per-author limit. Checking before the
+// insert lets them be reported by line, in dry runs too, while the rest of
+// the file is imported. In upsert mode it also sets the book each row
+// replaces: a stored book's ISBN is then only a conflict on a row replacing
+// another book, rows repeating an earlier row's key are conflicts, and only
+// rows creating a book count toward the per-author limit.
+func (h *BookHandler) markImportConflicts(ctx context.Context, rows []importRow, opts importOptions) error {
+	var isbns, authors []string
+	var reqs []models.CreateBookRequest
+	seenAuthors := make(map[string]bool)
+	for _, row := range rows {
+		if row.msg != nil {
+			continue
+		}
+		reqs = append(reqs, row.req)
+		if row.req.ISBN != "" {
+			isbns = append(isbns, row.req.ISBN)
+		}
+		if !seenAuthors[row.req.Author] {
+			seenAuthors[row.req.Author] = true
+			authors = append(authors, row.req.Author)
+		}
+	}
+
+	// isbnOwners holds the stored book using each valid row's ISBN, in upsert
+	// mode by its ID and otherwise only as whether there is one
+	var existing map[string]bool
+	var matchIDs, isbnOwners []int
+	var err error
+	if opts.upsert {
+		if matchIDs, err = h.books.MatchBooks(ctx, reqs, opts.key); err != nil {
+			return err
+		}
+		isbnOwners = matchIDs
+		if opts.key != db.ImportKeyISBN {
+			if isbnOwners, err = h.books.MatchBooks(ctx, reqs, db.ImportKeyISBN); err != nil {
+				return err
+			}
+		}
+	} else if existing, err = h.books.ExistingISBNs(ctx, isbns); err != nil {
+		return err
+	}
+	var perAuthor map[string]int
+	if h.maxBooksPerAuthor > 0 {
+		if perAuthor, err = h.books.CountBooksByAuthor(ctx, authors); err != nil {
+			return err
+		}
+	}
+
+	isbnLines := make(map[string]int)
+	keyLines := make(map[string]int)
+	valid := 0
+	for i := range rows {
+		row := &rows[i]
+		if row.msg != nil {
+			continue
+		}
+		isbnTaken := existing[row.req.ISBN]
+		if opts.upsert {
+			row.matchID = matchIDs[valid]
+			isbnTaken = isbnOwners[valid] != 0 && isbnOwners[valid] != row.matchID
+		}
+		valid++
+
+		isbn := row.req.ISBN
+		key := fmt.Sprintf("%s\x00%s\x00%d", row.req.Title, row.req.Author, row.req.PublishedYear)
+		switch {
+		case isbn != "" && isbnLines[isbn] > 0:
+			row.conflict("isbn", newMessage(msgImportDuplicateISBN, isbn, isbnLines[isbn]))
+		case opts.upsert && opts.key == db.ImportKeyTitleAuthorYear && keyLines[key] > 0:
+			row.conflict("title", newMessage(msgImportDuplicateBook, keyLines[key]))
+		case isbn != "" && isbnTaken:
+			row.conflict("isbn", newMessage(msgISBNExists, isbn))
+		case h.maxBooksPerAuthor > 0 && row.matchID == 0 && perAuthor[row.req.Author] >= h.maxBooksPerAuthor:
+			row.conflict("author", newMessage(msgAuthorLimitReached, h.maxBooksPerAuthor))
+		default:
+			if isbn != "" {
+				isbnLines[isbn] = row.line
+			}
+			keyLines[key] = row.line
+			if perAuthor != nil && row.matchID == 0 {
+				perAuthor[row.req.Author]++
+			}
+		}
+	}
+
+	return nil
+}
+
+// conflict marks a row as skipped because of its value for field
+func (row *importRow) conflict(field string, msg *message) {
+	row.msg = msg
+	row.violations = []fieldViolation{{field: field, msg: msg}}
+}
+
+// importRowError reports a skipped row in the given language
+func importRowError(row importRow, lang string) models.ImportRowError {
+	rowErr := models.ImportRowError{
+		Line:  row.line,
+		Error: row.msg.localize(lang),
+		Code:  row.msg.code,
+	}
+	if len(row.violations) > 0 {
+		rowErr.Fields = make(map[string]string, len(row.violations))
+		for _, v := range row.violations {
+			rowErr.Fields[v.field] = v.msg.localize(lang)
+		}
+	}
+	return rowErr
+}
+
+// isJSONImport reports whether an uploaded file holds JSON rather than CSV,
+// going by its extension and otherwise by whether it starts with an array
+func isJSONImport(filename string, data []byte) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return true
+	case ".csv":
+		return false
+	}
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
+// importCSVColumns lists the columns a CSV import may have, required ones
+// first
+var importCSVColumns = []string{"title", "author", "published_year", "available", "isbn", "genre"}
+
+// importRequiredColumns is how many of importCSVColumns are required
+const importRequiredColumns = 3
+
+// importSkippedColumns are the columns of the catalog export that an import
+// ignores, so an export can be imported again
+var importSkippedColumns = []string{"id", "created_at"}
+
+// parseCSVImport parses a CSV import with a header row naming its columns.
+// A row that can't be parsed is returned with its error rather than failing
+// the whole file; a bad header fails it.
+func parseCSVImport(data []byte) ([]importRow, *message) {
+	reader := csv.NewReader(bytes.NewReader(data))
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, newMessage(msgImportEmpty)
+	}
+	if err != nil {
+		return nil, newMessage(msgImportBadHeader)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if slices.Contains(importSkippedColumns, name) {
+			continue
+		}
+		if !slices.Contains(importCSVColumns, name) {
+			return nil, newMessage(msgImportUnknownColumn, name)
+		}
+		columns[name] = i
+	}
+	for _, name := range importCSVColumns[:importRequiredColumns] {
+		if _, ok := columns[name]; !ok {
+			return nil, newMessage(msgImportMissingColumn, name)
+		}
+	}
+
+	var rows []importRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			rows = append(rows, importRow{line: parseErr.StartLine, msg: newMessage(msgImportMalformedRow)})
+			continue
+		}
+		if err != nil {
+			return nil, newMessage(msgImportBadHeader)
+		}
+
+		line, _ := reader.FieldPos(0)
+		rows = append(rows, csvImportRow(line, columns, record))
+	}
+
+	return rows, nil
+}
+
+// csvImportRow converts a CSV record into a create request
+func csvImportRow(line int, columns map[string]int, record []string) importRow {
+	row := importRow{line: line}
+	field := func(name string) (string, bool) {
+		i, ok := columns[name]
+		if !ok {
+			return "", false
+		}
+		return record[i], true
+	}
+
+	row.req.Title, _ = field("title")
+	row.req.Author, _ = field("author")
+	row.req.ISBN, _ = field("isbn")
+	row.req.Genre, _ = field("genre")
+
+	year, _ := field("published_year")
+	publishedYear, err := strconv.Atoi(strings.TrimSpace(year))
+	if err != nil {
+		row.msg = newMessage(msgInvalidField, "published_year")
+		return row
+	}
+	row.req.PublishedYear = publishedYear
+
+	// An empty availability takes the default, as if the field were omitted
+	if value, ok := field("available"); ok && strings.TrimSpace(value) != "" {
+		available, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			row.msg = newMessage(msgInvalidField, "available")
+			return row
+		}
+		row.req.Available = &available
+	}
+
+	return row
+}
+
+// parseJSONImport parses a JSON import holding an array of books shaped like
+// Create Book requests. A row with the wrong fields or types is returned
+// with its error; JSON that isn't a well-formed array fails the whole file.
+func parseJSONImport(data []byte) ([]importRow, *message) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+		return nil, newMessage(msgImportNotArray)
+	}
+
+	var rows []importRow
+	for dec.More() {
+		row := importRow{line: lineAt(data, dec.InputOffset())}
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, decodeErrorMessage(err)
+		}
+		if err := decodeJSON(raw, &row.req); err != nil {
+			row.msg = decodeErrorMessage(err)
+		}
+		rows = append(rows, row)
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return nil, decodeErrorMessage(err)
+	}
+	return rows, nil
+}
+
+// lineAt returns the line of the first value at or after offset, skipping
+// the whitespace and comma separating it from the previous one
+func lineAt(data []byte, offset int64) int {
+	for offset < int64(len(data)) && bytes.IndexByte([]byte(" \t\r\n,"), data[offset]) >= 0 {
+		offset++
+	}
+	return 1 + bytes.Count(data[:offset], []byte("\n"))
+}
@@ -0,0 +1,389 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"library-api/models"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// importRequest builds an import upload of a file with the given name and
+// contents
+func importRequest(t *testing.T, target, filename, contents string) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(contents))
+	form.Close()
+
+	req := httptest.NewRequest("POST", target, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req
+}
+
+// runImport uploads a file to ImportBooks and returns its result
+func runImport(t *testing.T, h *BookHandler, target, filename, contents string) models.ImportResult {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ImportBooks(rec, importRequest(t, target, filename, contents))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+
+	var result models.ImportResult
+	decodeData(t, rec, &result)
+	return result
+}
+
+// rowErrors formats import row errors as "line:code" pairs
+func rowErrors(errs []models.ImportRowError) string {
+	pairs := make([]string, len(errs))
+	for i, e := range errs {
+		pairs[i] = fmt.Sprintf("%d:%s", e.Line, e.Code)
+	}
+	return fmt.Sprint(pairs)
+}
+
+func TestImportBooks(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   string
+		filename string
+		contents string
+		inserted int
+		valid    int
+		errors   string // rowErrors of the result
+		stored   []models.Book
+	}{
+		{
+			name:     "csv",
+			target:   "/api/v1/books/import",
+			filename: "books.csv",
+			contents: "title,author,published_year,available,isbn,genre\n" +
+				"Dune,Frank Herbert,1965,true,9780306406157,Fiction\n" +
+				"\"Go, in Practice\",Matt Butcher,2016,false,,\n",
+			inserted: 2,
+			valid:    2,
+			errors:   "[]",
+			stored: []models.Book{
+				{Title: "Dune", Author: "Frank Herbert", PublishedYear: 1965, Available: true, ISBN: "9780306406157", Genre: "fiction"},
+				{Title: "Go, in Practice", Author: "Matt Butcher", PublishedYear: 2016},
+			},
+		},
+		{
+			name:     "bad rows skipped",
+			target:   "/api/v1/books/import",
+			filename: "books.csv",
+			contents: "title,author,published_year\n" +
+				"Dune,Frank Herbert,1965\n" +
+				"Bad \"quote,Someone,2000\n" +
+				"Untitled,Nobody,not-a-year\n" +
+				",Anonymous,1999\n" +
+				"Emma,Jane Austen,1815\n",
+			inserted: 2,
+			valid:    2,
+			errors:   fmt.Sprintf("[3:%s 4:%s 5:%s]", msgImportMalformedRow, msgInvalidField, msgTitleRequired),
+			stored: []models.Book{
+				{Title: "Dune", Author: "Frank Herbert", PublishedYear: 1965, Available: true},
+				{Title: "Emma", Author: "Jane Austen", PublishedYear: 1815, Available: true},
+			},
+		},
+		{
+			name:     "json dry run",
+			target:   "/api/v1/books/import?dry_run=true",
+			filename: "books.json",
+			contents: `[
+  {"title": "Dune", "author": "Frank Herbert", "published_year": 1965},
+  {"title": "", "author": "Nobody", "published_year": 2000}
+]`,
+			valid:  1,
+			errors: fmt.Sprintf("[3:%s]", msgTitleRequired),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newFakeRepository()
+			h := NewBookHandler(repo)
+
+			result := runImport(t, h, tt.target, tt.filename, tt.contents)
+
+			if result.Inserted != tt.inserted || result.Valid != tt.valid {
+				t.Errorf("inserted %d of %d valid rows, want %d of %d", result.Inserted, result.Valid, tt.inserted, tt.valid)
+			}
+			if got := rowErrors(result.Errors); got != tt.errors {
+				t.Errorf("errors %s, want %s", got, tt.errors)
+			}
+			if len(repo.books) != len(tt.stored) {
+				t.Fatalf("repository holds %d books, want %d", len(repo.books), len(tt.stored))
+			}
+			for i, want := range tt.stored {
+				got := repo.books[i+1]
+				if got.Title != want.Title || got.Author != want.Author || got.PublishedYear != want.PublishedYear ||
+					got.Available != want.Available || got.ISBN != want.ISBN || got.Genre != want.Genre {
+					t.Errorf("book %d = %+v, want %+v", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestImportTemplateMatchesParser(t *testing.T) {
+	h := NewBookHandler(newFakeRepository())
+
+	template := serve(h.GetImportTemplate, "GET", "/api/v1/books/import-template.csv", "", nil)
+	if got, want := template.Body.String(), "title,author,published_year,available,isbn,genre\n"; got != want {
+		t.Errorf("template = %q, want %q", got, want)
+	}
+
+	// A filled-in template imports without errors
+	row := "Dune,Frank Herbert,1965,true,9780306406157,fiction\n"
+	result := runImport(t, h, "/api/v1/books/import", "books.csv", template.Body.String()+row)
+	if result.Inserted != 1 || len(result.Errors) != 0 {
+		t.Errorf("result = %+v, want the row imported", result)
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	book := storedBook()
+	book.ISBN, book.Genre = "9780306406157", "science fiction"
+	exported := serve(NewBookHandler(newFakeRepository(book)).ExportBooks, "GET", "/api/v1/books/export", "", nil)
+
+	repo := newFakeRepository()
+	result := runImport(t, NewBookHandler(repo), "/api/v1/books/import", "books.csv", exported.Body.String())
+
+	if result.Inserted != 1 || len(result.Errors) != 0 {
+		t.Fatalf("result = %+v, want the exported book imported", result)
+	}
+	got := repo.books[1]
+	if got.Title != book.Title || got.Author != book.Author || got.PublishedYear != book.PublishedYear ||
+		got.Available != book.Available || got.ISBN != book.ISBN || got.Genre != book.Genre {
+		t.Errorf("imported %+v, want %+v", got, book)
+	}
+}
+
+func TestImportBooksConflicts(t *testing.T) {
+	tests := []struct {
+		name         string
+		stored       models.Book
+		maxPerAuthor string // MAX_BOOKS_PER_AUTHOR
+		contents     string
+		valid        int
+		errors       string // rowErrors of the result
+		stores       int    // books held afterwards, without a dry run
+	}{
+		{
+			name:   "duplicate ISBNs",
+			stored: models.Book{ID: 1, Title: "Stored", Author: "Someone", ISBN: "9780306406157", PublishedYear: 2000},
+			contents: "title,author,published_year,isbn\n" +
+				"Clash,Frank Herbert,1965,978-0-306-40615-7\n" +
+				"First,Jane Austen,1815,0306406152\n" +
+				"Repeat,Jane Austen,1816,0-306-40615-2\n" +
+				"Fresh,Jane Austen,1817,\n",
+			valid:  2,
+			errors: fmt.Sprintf("[2:%s 4:%s]", msgISBNExists, msgImportDuplicateISBN),
+			stores: 3,
+		},
+		{
+			name:         "author limit",
+			stored:       models.Book{ID: 1, Title: "Emma", Author: "Jane Austen", PublishedYear: 1815},
+			maxPerAuthor: "2",
+			contents: "title,author,published_year\n" +
+				"Persuasion,Jane Austen,1817\n" +
+				"Sanditon,Jane Austen,1817\n" +
+				"Dune,Frank Herbert,1965\n",
+			valid:  2,
+			errors: fmt.Sprintf("[3:%s]", msgAuthorLimitReached),
+			stores: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		for _, dryRun := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/dry run %v", tt.name, dryRun), func(t *testing.T) {
+				t.Setenv("MAX_BOOKS_PER_AUTHOR", tt.maxPerAuthor)
+				repo := newFakeRepository(tt.stored)
+				h := NewBookHandler(repo)
+
+				target := "/api/v1/books/import"
+				if dryRun {
+					target += "?dry_run=true"
+				}
+				result := runImport(t, h, target, "books.csv", tt.contents)
+
+				if result.Valid != tt.valid {
+					t.Errorf("%d valid rows, want %d", result.Valid, tt.valid)
+				}
+				if got := rowErrors(result.Errors); got != tt.errors {
+					t.Errorf("errors %s, want %s", got, tt.errors)
+				}
+				for _, e := range result.Errors {
+					if e.Code == msgImportDuplicateISBN && e.Fields["isbn"] == "" {
+						t.Errorf("duplicate error %+v doesn't name the isbn field", e)
+					}
+				}
+				stores := tt.stores
+				if dryRun {
+					stores = 1
+				}
+				if len(repo.books) != stores {
+					t.Errorf("repository holds %d books, want %d", len(repo.books), stores)
+				}
+			})
+		}
+	}
+}
+
+func TestImportBooksUpsert(t *testing.T) {
+	stored := []models.Book{
+		{ID: 1, Title: "Dune", Author: "Frank Herbert", PublishedYear: 1965, ISBN: "9780306406157"},
+		{ID: 2, Title: "Emma", Author: "Jane Austen", PublishedYear: 1815},
+	}
+
+	tests := []struct {
+		name         string
+		query        string
+		maxPerAuthor string // MAX_BOOKS_PER_AUTHOR
+		contents     string
+		inserted     int
+		updated      int
+		errors       string         // rowErrors of the result
+		titles       map[int]string // stored titles by ID afterwards
+	}{
+		{
+			name:  "by isbn",
+			query: "mode=upsert",
+			contents: "title,author,published_year,isbn\n" +
+				"Dune Messiah,Frank Herbert,1969,978-0-306-40615-7\n" +
+				"Emma,Jane Austen,1815,\n",
+			inserted: 1,
+			updated:  1,
+			errors:   "[]",
+			titles:   map[int]string{1: "Dune Messiah", 2: "Emma", 3: "Emma"},
+		},
+		{
+			name:  "by title, author and year",
+			query: "mode=upsert&key=title_author_year",
+			contents: "title,author,published_year,isbn\n" +
+				"Emma,Jane Austen,1815,0306406152\n" +
+				"Emma,Jane Austen,1815,\n" +
+				"Persuasion,Jane Austen,1817,978-0-306-40615-7\n",
+			updated: 1,
+			errors:  fmt.Sprintf("[3:%s 4:%s]", msgImportDuplicateBook, msgISBNExists),
+			titles:  map[int]string{1: "Dune", 2: "Emma"},
+		},
+		{
+			name:         "author limit counts created books",
+			query:        "mode=upsert&key=title_author_year",
+			maxPerAuthor: "1",
+			contents: "title,author,published_year\n" +
+				"Emma,Jane Austen,1815\n" +
+				"Persuasion,Jane Austen,1817\n",
+			updated: 1,
+			errors:  fmt.Sprintf("[3:%s]", msgAuthorLimitReached),
+			titles:  map[int]string{1: "Dune", 2: "Emma"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("MAX_BOOKS_PER_AUTHOR", tt.maxPerAuthor)
+			repo := newFakeRepository(stored...)
+			h := NewBookHandler(repo)
+
+			result := runImport(t, h, "/api/v1/books/import?"+tt.query, "books.csv", tt.contents)
+
+			if result.Inserted != tt.inserted || result.Updated != tt.updated {
+				t.Errorf("inserted %d and updated %d, want %d and %d", result.Inserted, result.Updated, tt.inserted, tt.updated)
+			}
+			if got := rowErrors(result.Errors); got != tt.errors {
+				t.Errorf("errors %s, want %s", got, tt.errors)
+			}
+			titles := make(map[int]string, len(repo.books))
+			for id, book := range repo.books {
+				titles[id] = book.Title
+			}
+			if got, want := fmt.Sprint(titles), fmt.Sprint(tt.titles); got != want {
+				t.Errorf("stored titles %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestImportBooksRejectsUnknownMode(t *testing.T) {
+	for _, query := range []string{"mode=replace", "mode=upsert&key=title"} {
+		h := NewBookHandler(newFakeRepository())
+		rec := httptest.NewRecorder()
+		h.ImportBooks(rec, importRequest(t, "/api/v1/books/import?"+query, "books.csv", "title,author,published_year\n"))
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", query, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestImportBatchLifecycle(t *testing.T) {
+	repo := newFakeRepository(models.Book{ID: 1, Title: "Emma", Author: "Jane Austen", PublishedYear: 1815})
+	h := NewBookHandler(repo)
+
+	dryRun := runImport(t, h, "/api/v1/books/import?dry_run=true", "books.csv", "title,author,published_year\nDune,Frank Herbert,1965\n")
+	if dryRun.ImportBatchID != "" {
+		t.Errorf("dry run returned import batch %q", dryRun.ImportBatchID)
+	}
+
+	contents := "title,author,published_year\nDune,Frank Herbert,1965\nDune Messiah,Frank Herbert,1969\n"
+	batch := runImport(t, h, "/api/v1/books/import", "books.csv", contents).ImportBatchID
+	if !isImportBatchID(batch) {
+		t.Fatalf("import batch ID %q is not a UUID", batch)
+	}
+	other := runImport(t, h, "/api/v1/books/import", "books.csv", "title,author,published_year\nPersuasion,Jane Austen,1817\n").ImportBatchID
+	if other == batch {
+		t.Fatalf("two imports share the batch ID %q", batch)
+	}
+
+	listed := serve(h.GetBooks, "GET", "/api/v1/books?import_batch="+strings.ToUpper(batch), "", nil)
+	if got := fmt.Sprint(bookIDs(t, listed)); got != "[2 3]" {
+		t.Errorf("the batch lists books %s, want [2 3]", got)
+	}
+
+	deleted := serve(h.DeleteImportBatch, "DELETE", "/api/v1/books/import-batch/"+batch, "", map[string]string{"batch": batch})
+	var deletion models.ImportBatchDeletion
+	decodeData(t, deleted, &deletion)
+	if deletion.Deleted != 2 {
+		t.Errorf("deleted %d books, want 2", deletion.Deleted)
+	}
+	if _, ok := repo.books[4]; len(repo.books) != 2 || !ok {
+		t.Errorf("repository holds %d books, want the stored and the other batch's", len(repo.books))
+	}
+
+	again := serve(h.DeleteImportBatch, "DELETE", "/api/v1/books/import-batch/"+batch, "", map[string]string{"batch": batch})
+	if again.Code != http.StatusNotFound {
+		t.Errorf("deleting again: status = %d, want %d", again.Code, http.StatusNotFound)
+	}
+}
+
+func TestImportBatchIDValidation(t *testing.T) {
+	for _, id := range []string{"", "1", "0b5e5bd6-7f5b-4c5e-9f7a-2f3c1d7c9a1", "0b5e5bd67f5b-4c5e-9f7a-2f3c1d7c9a100", "0b5e5bd6-7f5b-4c5e-9f7a-2f3c1d7c9a1g"} {
+		h := NewBookHandler(newFakeRepository())
+
+		rec := serve(h.DeleteImportBatch, "DELETE", "/api/v1/books/import-batch/x", "", map[string]string{"batch": id})
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("delete %q: status = %d, want %d", id, rec.Code, http.StatusBadRequest)
+		}
+		if id == "" {
+			continue
+		}
+		rec = serve(h.GetBooks, "GET", "/api/v1/books?import_batch="+id, "", nil)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("list %q: status = %d, want %d", id, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Message codes identify an error, or a notice such as a search too broad to
+// list, independently of the language its text is sent in. They are part of
+// the API, so existing codes must not change.
+const (
+	msgInvalidBookID          = "invalid_book_id"
+	msgBookNotFound           = "book_not_found"
+	msgNoMatchingBooks        = "no_matching_books"
+	msgInvalidJSON            = "invalid_json"
+	msgUnreadableBody         = "unreadable_body"
+	msgBodyTooLarge           = "body_too_large"
+	msgJSONSyntax             = "json_syntax"
+	msgJSONTruncated          = "json_truncated"
+	msgInvalidFieldValue      = "invalid_field_value"
+	msgUnknownField           = "unknown_field"
+	msgInvalidField           = "invalid_field"
+	msgReplaceFieldsMissing   = "replace_fields_missing"
+	msgSearchTooLong          = "search_too_long"
+	msgSearchRequired         = "search_required"
+	msgSearchTooBroad         = "search_too_broad"
+	msgInvalidFilter          = "invalid_filter"
+	msgNotPositiveInteger     = "not_positive_integer"
+	msgNotWholeNumber         = "not_whole_number"
+	msgNotBoolean             = "not_boolean"
+	msgParamTooLong           = "param_too_long"
+	msgIDRangeInverted        = "id_range_inverted"
+	msgYearRangeInverted      = "year_range_inverted"
+	msgParamRequired          = "param_required"
+	msgInvalidTimestamp       = "invalid_timestamp"
+	msgInvalidCursor          = "invalid_cursor"
+	msgCursorUnsupported      = "cursor_unsupported"
+	msgInvalidCollation       = "invalid_collation"
+	msgInvalidMatrixDimension = "invalid_matrix_dimension"
+	msgSameMatrixDimension    = "same_matrix_dimension"
+	msgFeaturedLimitReached   = "featured_limit_reached"
+	msgAuthorLimitReached     = "author_limit_reached"
+	msgDuplicate              = "duplicate"
+	msgTitleRequired          = "title_required"
+	msgTitleEmpty             = "title_empty"
+	msgTitleTooLong           = "title_too_long"
+	msgAuthorRequired         = "author_required"
+	msgAuthorEmpty            = "author_empty"
+	msgAuthorTooLong          = "author_too_long"
+	msgAuthorFormat           = "author_format"
+	msgYearOutOfRange         = "year_out_of_range"
+	msgInvalidISBN            = "invalid_isbn"
+	msgGenreTooLong           = "genre_too_long"
+	msgGenreNotAllowed        = "genre_not_allowed"
+	msgNoFieldsToUpdate       = "no_fields_to_update"
+	msgBookModified           = "book_modified"
+	msgEmptyBatch             = "empty_batch"
+	msgBatchTooLarge          = "batch_too_large"
+	msgBatchItemInvalid       = "batch_item_invalid"
+	msgInvalidSnapshotName    = "invalid_snapshot_name"
+	msgSnapshotExists         = "snapshot_exists"
+	msgSnapshotNotFound       = "snapshot_not_found"
+
+	msgRetrieveBooksFailed      = "retrieve_books_failed"
+	msgRetrieveBookFailed       = "retrieve_book_failed"
+	msgRetrieveYearCountsFailed = "retrieve_year_counts_failed"
+	msgCountBooksFailed         = "count_books_failed"
+	msgExportBooksFailed        = "export_books_failed"
+	msgInvalidExportFormat      = "invalid_export_format"
+	msgImportBooksFailed        = "import_books_failed"
+	msgImportFileRequired       = "import_file_required"
+	msgImportEmpty              = "import_empty"
+	msgImportBadHeader          = "import_bad_header"
+	msgImportUnknownColumn      = "import_unknown_column"
+	msgImportMissingColumn      = "import_missing_column"
+	msgImportMalformedRow       = "import_malformed_row"
+	msgImportNotArray           = "import_not_array"
+	msgImportDuplicateISBN      = "import_duplicate_isbn"
+	msgImportDuplicateBook      = "import_duplicate_book"
+	msgInvalidImportMode        = "invalid_import_mode"
+	msgISBNExists               = "isbn_exists"
+	msgRetrieveChangesFailed    = "retrieve_availability_changes_failed"
+	msgRetrieveStaleBooksFailed = "retrieve_stale_books_failed"
+	msgRetrieveMatrixFailed     = "retrieve_matrix_failed"
+	msgRetrieveFeaturedFailed   = "retrieve_featured_failed"
+	msgRetrieveEditionsFailed   = "retrieve_editions_failed"
+	msgCreateBookFailed         = "create_book_failed"
+	msgCreateBooksFailed        = "create_books_failed"
+	msgUpdateBookFailed         = "update_book_failed"
+	msgDeleteBookFailed         = "delete_book_failed"
+	msgDeleteImportBatchFailed  = "delete_import_batch_failed"
+	msgInvalidImportBatch       = "invalid_import_batch"
+	msgImportBatchNotFound      = "import_batch_not_found"
+	msgPreviewUpdateFailed      = "preview_update_failed"
+	msgCloneBookFailed          = "clone_book_failed"
+	msgExplainSearchFailed      = "explain_search_failed"
+	msgDiagnoseQueriesFailed    = "diagnose_queries_failed"
+	msgValidateBooksFailed      = "validate_books_failed"
+	msgHealthReportFailed       = "health_report_failed"
+	msgCreateSnapshotFailed     = "create_snapshot_failed"
+	msgRestoreSnapshotFailed    = "restore_snapshot_failed"
+)
+
+// defaultLanguage is used when the client accepts none of the catalog's
+// languages. Its catalog must have a text for every code.
+const defaultLanguage = "en"
+
+// messageCatalog holds each supported language's message texts by code, as
+// fmt formats. Languages are keyed by their primary subtag.
+var messageCatalog = map[string]map[string]string{
+	"en": {
+		msgInvalidBookID:          "Invalid book ID",
+		msgBookNotFound:           "Book not found",
+		msgNoMatchingBooks:        "No books match",
+		msgInvalidJSON:            "Invalid JSON payload",
+		msgUnreadableBody:         "Failed to read request body",
+		msgBodyTooLarge:           "Request body must be at most %d bytes",
+		msgJSONSyntax:             "Malformed JSON at position %d",
+		msgJSONTruncated:          "Request body ends before the JSON value is complete",
+		msgInvalidFieldValue:      "Invalid value for field '%s' at position %d: expected %s",
+		msgUnknownField:           "Unknown field '%s'",
+		msgInvalidField:           "Invalid value for field '%s'",
+		msgReplaceFieldsMissing:   "Replacing a book requires every field; missing: %s. Use PATCH to change only some fields",
+		msgSearchTooLong:          "Search query must be at most %d characters",
+		msgSearchRequired:         "Search query is required",
+		msgSearchTooBroad:         "Search matches more than %d books; narrow the query or pass force=true to list them",
+		msgInvalidFilter:          "Invalid filter: %s",
+		msgNotPositiveInteger:     "%s must be a positive integer",
+		msgNotWholeNumber:         "%s must be a whole number",
+		msgNotBoolean:             "%s must be true or false",
+		msgParamTooLong:           "%s must be at most %d characters",
+		msgIDRangeInverted:        "id_min must not be greater than id_max",
+		msgYearRangeInverted:      "year_min must not be greater than year_max",
+		msgParamRequired:          "%s is required",
+		msgInvalidTimestamp:       "%s must be an RFC3339 timestamp",
+		msgInvalidCursor:          "Invalid cursor; pass the next_cursor of a previous page",
+		msgCursorUnsupported:      "cursor can't be combined with q or a sort other than created_at",
+		msgInvalidCollation:       "collation must be one of: %s",
+		msgInvalidMatrixDimension: "rows and cols must each be one of: author, available, genre, published_year",
+		msgSameMatrixDimension:    "rows and cols must be different",
+		msgFeaturedLimitReached:   "The maximum of %d featured books has been reached",
+		msgAuthorLimitReached:     "Author already has the maximum of %d books",
+		msgDuplicate:              "Resource already exists",
+		msgTitleRequired:          "Title is required",
+		msgTitleEmpty:             "Title cannot be empty",
+		msgTitleTooLong:           "Title must be at most %d characters",
+		msgAuthorRequired:         "Author is required",
+		msgAuthorEmpty:            "Author cannot be empty",
+		msgAuthorTooLong:          "Author must be at most %d characters",
+		msgAuthorFormat:           `Author must be in "Last, First" format, e.g. "Tolkien, J. R. R."`,
+		msgYearOutOfRange:         "Published year must be between %d and %d",
+		msgInvalidISBN:            "ISBN must be a valid ISBN-10 or ISBN-13",
+		msgGenreTooLong:           "Genre must be at most %d characters",
+		msgGenreNotAllowed:        "Genre must be one of: %s",
+		msgNoFieldsToUpdate:       "No fields to update",
+		msgBookModified:           "The book was modified since it was read; fetch it again and retry",
+		msgEmptyBatch:             "At least one book is required",
+		msgBatchTooLarge:          "At most %d books can be created at once",
+		msgBatchItemInvalid:       "Book at index %d: %s",
+		msgInvalidSnapshotName:    "Snapshot name must be 1-100 letters, digits, underscores or hyphens",
+		msgSnapshotExists:         "Snapshot already exists",
+		msgSnapshotNotFound:       "Snapshot not found",
+
+		msgRetrieveBooksFailed:      "Failed to retrieve books",
+		msgRetrieveBookFailed:       "Failed to retrieve book",
+		msgRetrieveYearCountsFailed: "Failed to retrieve year counts",
+		msgCountBooksFailed:         "Failed to count books",
+		msgExportBooksFailed:        "Failed to export books",
+		msgInvalidExportFormat:      "format must be csv or json",
+		msgImportBooksFailed:        "Failed to import books",
+		msgImportFileRequired:       "Upload the file to import as multipart/form-data in the field 'file'",
+		msgImportEmpty:              "The import file is empty",
+		msgImportBadHeader:          "The import file's CSV header row could not be read",
+		msgImportUnknownColumn:      "Unknown column '%s' in the import file",
+		msgImportMissingColumn:      "The import file is missing the required column '%s'",
+		msgImportMalformedRow:       "Malformed CSV row",
+		msgImportNotArray:           "A JSON import file must hold an array of books",
+		msgImportDuplicateISBN:      "ISBN %s is already used on line %d of the import file",
+		msgImportDuplicateBook:      "The same title, author and published year are on line %d of the import file",
+		msgInvalidImportMode:        "mode must be insert or upsert, and key isbn or title_author_year",
+		msgISBNExists:               "A book with ISBN %s already exists",
+		msgRetrieveChangesFailed:    "Failed to retrieve availability changes",
+		msgRetrieveStaleBooksFailed: "Failed to retrieve stale books",
+		msgRetrieveMatrixFailed:     "Failed to retrieve book matrix",
+		msgRetrieveFeaturedFailed:   "Failed to retrieve featured books",
+		msgRetrieveEditionsFailed:   "Failed to retrieve editions",
+		msgCreateBookFailed:         "Failed to create book",
+		msgCreateBooksFailed:        "Failed to create books",
+		msgUpdateBookFailed:         "Failed to update book",
+		msgDeleteBookFailed:         "Failed to delete book",
+		msgDeleteImportBatchFailed:  "Failed to delete import batch",
+		msgInvalidImportBatch:       "%s must be an import batch ID (a UUID)",
+		msgImportBatchNotFound:      "No books were created by that import batch",
+		msgPreviewUpdateFailed:      "Failed to preview book update",
+		msgCloneBookFailed:          "Failed to clone book",
+		msgExplainSearchFailed:      "Failed to explain search query",
+		msgDiagnoseQueriesFailed:    "Failed to diagnose queries",
+		msgValidateBooksFailed:      "Failed to validate books",
+		msgHealthReportFailed:       "Failed to compute catalog health report",
+		msgCreateSnapshotFailed:     "Failed to create snapshot",
+		msgRestoreSnapshotFailed:    "Failed to restore snapshot",
+	},
+	"es": {
+		msgInvalidBookID:          "ID de libro no válido",
+		msgBookNotFound:           "Libro no encontrado",
+		msgNoMatchingBooks:        "Ningún libro coincide",
+		msgInvalidJSON:            "Cuerpo JSON no válido",
+		msgUnreadableBody:         "No se pudo leer el cuerpo de la solicitud",
+		msgBodyTooLarge:           "El cuerpo de la solicitud debe tener como máximo %d bytes",
+		msgJSONSyntax:             "JSON mal formado en la posición %d",
+		msgJSONTruncated:          "El cuerpo de la solicitud termina antes de completar el valor JSON",
+		msgInvalidFieldValue:      "Valor no válido para el campo '%s' en la posición %d: se esperaba %s",
+		msgUnknownField:           "Campo desconocido '%s'",
+		msgInvalidField:           "Valor no válido para el campo '%s'",
+		msgReplaceFieldsMissing:   "Reemplazar un libro requiere todos los campos; faltan: %s. Use PATCH para cambiar solo algunos campos",
+		msgSearchTooLong:          "La búsqueda debe tener como máximo %d caracteres",
+		msgSearchRequired:         "La búsqueda es obligatoria",
+		msgSearchTooBroad:         "La búsqueda coincide con más de %d libros; acótela o pase force=true para listarlos",
+		msgInvalidFilter:          "Filtro no válido: %s",
+		msgNotPositiveInteger:     "%s debe ser un entero positivo",
+		msgNotWholeNumber:         "%s debe ser un número entero",
+		msgNotBoolean:             "%s debe ser true o false",
+		msgParamTooLong:           "%s debe tener como máximo %d caracteres",
+		msgIDRangeInverted:        "id_min no debe ser mayor que id_max",
+		msgYearRangeInverted:      "year_min no debe ser mayor que year_max",
+		msgParamRequired:          "%s es obligatorio",
+		msgInvalidTimestamp:       "%s debe ser una fecha RFC3339",
+		msgInvalidCursor:          "Cursor no válido; use el next_cursor de una página anterior",
+		msgCursorUnsupported:      "cursor no se puede combinar con q ni con un orden distinto de created_at",
+		msgInvalidCollation:       "collation debe ser uno de: %s",
+		msgInvalidMatrixDimension: "rows y cols deben ser uno de: author, available, genre, published_year",
+		msgSameMatrixDimension:    "rows y cols deben ser distintos",
+		msgFeaturedLimitReached:   "Ya se ha alcanzado el máximo de %d libros destacados",
+		msgAuthorLimitReached:     "El autor ya tiene el máximo de %d libros",
+		msgDuplicate:              "El recurso ya existe",
+		msgTitleRequired:          "El título es obligatorio",
+		msgTitleEmpty:             "El título no puede estar vacío",
+		msgTitleTooLong:           "El título debe tener como máximo %d caracteres",
+		msgAuthorRequired:         "El autor es obligatorio",
+		msgAuthorEmpty:            "El autor no puede estar vacío",
+		msgAuthorTooLong:          "El autor debe tener como máximo %d caracteres",
+		msgAuthorFormat:           `El autor debe tener el formato "Apellido, Nombre", p. ej. "Tolkien, J. R. R."`,
+		msgYearOutOfRange:         "El año de publicación debe estar entre %d y %d",
+		msgInvalidISBN:            "El ISBN debe ser un ISBN-10 o ISBN-13 válido",
+		msgGenreTooLong:           "El género debe tener como máximo %d caracteres",
+		msgGenreNotAllowed:        "El género debe ser uno de: %s",
+		msgNoFieldsToUpdate:       "No hay campos que actualizar",
+		msgBookModified:           "El libro se modificó después de leerlo; vuelva a obtenerlo y reintente",
+		msgEmptyBatch:             "Se requiere al menos un libro",
+		msgBatchTooLarge:          "Se pueden crear como máximo %d libros a la vez",
+		msgBatchItemInvalid:       "Libro en la posición %d: %s",
+		msgInvalidSnapshotName:    "El nombre de la instantánea debe tener de 1 a 100 letras, dígitos, guiones bajos o guiones",
+		msgSnapshotExists:         "La instantánea ya existe",
+		msgSnapshotNotFound:       "Instantánea no encontrada",
+
+		msgRetrieveBooksFailed:      "No se pudieron obtener los libros",
+		msgRetrieveBookFailed:       "No se pudo obtener el libro",
+		msgRetrieveYearCountsFailed: "No se pudo obtener el recuento por año",
+		msgCountBooksFailed:         "No se pudieron contar los libros",
+		msgExportBooksFailed:        "No se pudieron exportar los libros",
+		msgInvalidExportFormat:      "format debe ser csv o json",
+		msgImportBooksFailed:        "No se pudieron importar los libros",
+		msgImportFileRequired:       "Suba el archivo a importar como multipart/form-data en el campo 'file'",
+		msgImportEmpty:              "El archivo de importación está vacío",
+		msgImportBadHeader:          "No se pudo leer la fila de encabezado CSV del archivo de importación",
+		msgImportUnknownColumn:      "Columna desconocida '%s' en el archivo de importación",
+		msgImportMissingColumn:      "Al archivo de importación le falta la columna obligatoria '%s'",
+		msgImportMalformedRow:       "Fila CSV mal formada",
+		msgImportNotArray:           "Un archivo de importación JSON debe contener un array de libros",
+		msgImportDuplicateISBN:      "El ISBN %s ya se usa en la línea %d del archivo de importación",
+		msgImportDuplicateBook:      "El mismo título, autor y año de publicación están en la línea %d del archivo de importación",
+		msgInvalidImportMode:        "mode debe ser insert o upsert, y key isbn o title_author_year",
+		msgISBNExists:               "Ya existe un libro con el ISBN %s",
+		msgRetrieveChangesFailed:    "No se pudieron obtener los cambios de disponibilidad",
+		msgRetrieveStaleBooksFailed: "No se pudieron obtener los libros sin acceso reciente",
+		msgRetrieveMatrixFailed:     "No se pudo obtener la matriz de libros",
+		msgRetrieveFeaturedFailed:   "No se pudieron obtener los libros destacados",
+		msgRetrieveEditionsFailed:   "No se pudieron obtener las ediciones",
+		msgCreateBookFailed:         "No se pudo crear el libro",
+		msgCreateBooksFailed:        "No se pudieron crear los libros",
+		msgUpdateBookFailed:         "No se pudo actualizar el libro",
+		msgDeleteBookFailed:         "No se pudo eliminar el libro",
+		msgDeleteImportBatchFailed:  "No se pudo eliminar el lote de importación",
+		msgInvalidImportBatch:       "%s debe ser un ID de lote de importación (un UUID)",
+		msgImportBatchNotFound:      "Ningún libro fue creado por ese lote de importación",
+		msgPreviewUpdateFailed:      "No se pudo previsualizar la actualización del libro",
+		msgCloneBookFailed:          "No se pudo clonar el libro",
+		msgExplainSearchFailed:      "No se pudo explicar la búsqueda",
+		msgDiagnoseQueriesFailed:    "No se pudieron diagnosticar las consultas",
+		msgValidateBooksFailed:      "No se pudieron validar los libros",
+		msgHealthReportFailed:       "No se pudo generar el informe de estado del catálogo",
+		msgCreateSnapshotFailed:     "No se pudo crear la instantánea",
+		msgRestoreSnapshotFailed:    "No se pudo restaurar la instantánea",
+	},
+}
+
+// message is a catalog message identified by its code, with the arguments its
+// text is formatted with. Arguments that are themselves messages are
+// localized into the same language.
+type message struct {
+	code string
+	args []interface{}
+}
+
+func newMessage(code string, args ...interface{}) *message {
+	return &message{code: code, args: args}
+}
+
+// localize formats the message in the given language, falling back to the
+// default language for languages or codes missing from the catalog
+func (m *message) localize(lang string) string {
+	format, ok := messageCatalog[lang][m.code]
+	if !ok {
+		format = messageCatalog[defaultLanguage][m.code]
+	}
+
+	args := make([]interface{}, len(m.args))
+	for i, arg := range m.args {
+		if nested, ok := arg.(*message); ok {
+			arg = nested.localize(lang)
+		}
+		args[i] = arg
+	}
+
+	return fmt.Sprintf(format, args...)
+}
+
+// requestLanguage picks the catalog language the client prefers most in its
+// Accept-Language header, or the default language if it accepts none
+func requestLanguage(r *http.Request) string {
+	type acceptedLanguage struct {
+		lang    string
+		quality float64
+	}
+
+	var accepted []acceptedLanguage
+	for _, header := range r.Header.Values("Accept-Language") {
+		for _, part := range strings.Split(header, ",") {
+			tag, params, _ := strings.Cut(part, ";")
+			quality := 1.0
+			if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+				parsed, err := strconv.ParseFloat(q, 64)
+				if err != nil {
+					continue
+				}
+				quality = parsed
+			}
+
+			// Only the primary subtag matters, so "es-MX" selects "es"
+			primary, _, _ := strings.Cut(strings.TrimSpace(tag), "-")
+			primary = strings.ToLower(primary)
+			if _, ok := messageCatalog[primary]; ok && quality > 0 {
+				accepted = append(accepted, acceptedLanguage{primary, quality})
+			}
+		}
+	}
+
+	if len(accepted) == 0 {
+		return defaultLanguage
+	}
+
+	// Ties keep header order
+	sort.SliceStable(accepted, func(i, j int) bool {
+		return accepted[i].quality > accepted[j].quality
+	})
+	return accepted[0].lang
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"library-api/db"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestLanguage(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", "en"},
+		{"es", "es"},
+		{"es-MX", "es"},
+		{"ES", "es"},
+		{"fr", "en"},
+		{"fr, es;q=0.5", "es"},
+		{"en;q=0.4, es;q=0.8", "es"},
+		{"es;q=0, en", "en"},
+		{"es;q=abc", "en"},
+		{"en, es", "en"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept-Language", tt.accept)
+		}
+		if got := requestLanguage(r); got != tt.want {
+			t.Errorf("Accept-Language %q: %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestLocalizeNestedMessage(t *testing.T) {
+	m := newMessage(msgBatchItemInvalid, 2, newMessage(msgTitleRequired))
+
+	tests := []struct {
+		lang string
+		want string
+	}{
+		{"en", "Book at index 2: Title is required"},
+		{"es", "Libro en la posición 2: El título es obligatorio"},
+		{"fr", "Book at index 2: Title is required"},
+	}
+
+	for _, tt := range tests {
+		if got := m.localize(tt.lang); got != tt.want {
+			t.Errorf("%s: %q, want %q", tt.lang, got, tt.want)
+		}
+	}
+}
+
+func TestMatrixDimensionMessageListsDimensions(t *testing.T) {
+	columns := []string{"title", "author", "isbn", "genre", "published_year", "available", "featured"}
+
+	for lang := range messageCatalog {
+		text := newMessage(msgInvalidMatrixDimension).localize(lang)
+		for _, column := range columns {
+			if listed := strings.Contains(text, column); listed != db.IsMatrixDimension(column) {
+				t.Errorf("%s: %q lists %s: %v, want %v", lang, text, column, listed, !listed)
+			}
+		}
+	}
+}
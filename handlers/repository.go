@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"context"
+	"database/sql"
+	"library-api/db"
+	"library-api/models"
+	"time"
+)
+
+// BookRepository is the book storage BookHandler works against. The
+// handler depends only on this interface, so tests can substitute a fake
+// for the database.
+type BookRepository interface {
+	GetBooks(ctx context.Context, filter db.BookFilter, sortBy string, descending bool, collation string, page, limit int, countTotal bool) ([]models.Book, int, error)
+	CountBooks(ctx context.Context, query string, filter db.BookFilter) (int, error)
+	GetRandomBook(ctx context.Context, filter db.BookFilter) (*models.Book, error)
+	ForEachBook(ctx context.Context, filter db.BookFilter, fn func(models.Book) error) error
+	GetBooksAfter(ctx context.Context, filter db.BookFilter, descending bool, after *db.BookCursor, limit int) ([]models.Book, *db.BookCursor, error)
+	SearchBooks(ctx context.Context, query string, filter db.BookFilter, page, limit, countOnlyAbove int, countTotal bool) ([]models.Book, int, *float64, error)
+	StreamBooks(ctx context.Context, query string, filter db.BookFilter, sortBy string, descending bool, collation string, page, limit int, fn func(models.Book) error) error
+	// GetBookByID returns nil without an error when the book doesn't exist
+	GetBookByID(ctx context.Context, id int) (*models.Book, error)
+	TouchBook(ctx context.Context, id int) error
+	CreateBook(ctx context.Context, req models.CreateBookRequest, maxPerAuthor int) (*models.Book, error)
+	CreateBooks(ctx context.Context, reqs []models.CreateBookRequest, maxPerAuthor int) ([]models.Book, error)
+	ImportBooks(ctx context.Context, reqs []models.CreateBookRequest, importBatchID string, batchSize, maxPerAuthor int) (int, error)
+	ExistingISBNs(ctx context.Context, isbns []string) (map[string]bool, error)
+	// MatchBooks returns the ID of the stored book each request has the key
+	// of, or 0, and UpsertBooks imports the requests, replacing those books
+	MatchBooks(ctx context.Context, reqs []models.CreateBookRequest, key string) ([]int, error)
+	UpsertBooks(ctx context.Context, reqs []models.CreateBookRequest, ids []int, importBatchID string, batchSize, maxPerAuthor int) (created, updated int, err error)
+	CountBooksByAuthor(ctx context.Context, authors []string) (map[string]int, error)
+	// UpdateBook fails with db.ErrNotFound for an unknown ID, and with
+	// db.ErrPreconditionFailed when matches is non-nil and rejects the stored
+	// book
+	UpdateBook(ctx context.Context, id int, req models.UpdateBookRequest, matches func(*models.Book) bool) (*models.Book, bool, error)
+	// ReplaceBook is UpdateBook with every field set from req
+	ReplaceBook(ctx context.Context, id int, req models.CreateBookRequest, matches func(*models.Book) bool) (*models.Book, bool, error)
+	PreviewUpdate(ctx context.Context, id int, req models.UpdateBookRequest) (*models.UpdatePreview, error)
+	DeleteBook(ctx context.Context, id int) error
+	// DeleteImportBatch returns how many books it deleted, 0 for an unknown
+	// batch
+	DeleteImportBatch(ctx context.Context, importBatchID string) (int, error)
+
+	GetYearCounts(ctx context.Context, query string, filter db.BookFilter) ([]models.YearCount, error)
+	GetAvailabilityChanges(ctx context.Context, since time.Time, page, limit int) ([]models.Book, int, error)
+	GetStaleBooks(ctx context.Context, before time.Time, page, limit int) ([]models.Book, int, error)
+	CountMatrix(ctx context.Context, rowColumn, colColumn string) (map[string]map[string]int, error)
+	GetFeaturedBooks(ctx context.Context, orderBy string, descending bool) ([]models.Book, error)
+	SetFeatured(ctx context.Context, id int, featured bool, maxFeatured int) (*models.Book, error)
+	GetEditions(ctx context.Context, book *models.Book) ([]models.Book, error)
+}
+
+// sqlRepository is the BookRepository backed by the db package
+type sqlRepository struct {
+	db *sql.DB
+}
+
+// NewSQLRepository returns a BookRepository storing books in database
+func NewSQLRepository(database *sql.DB) BookRepository {
+	return &sqlRepository{db: database}
+}
+
+func (r *sqlRepository) GetBooks(ctx context.Context, filter db.BookFilter, sortBy string, descending bool, collation string, page, limit int, countTotal bool) ([]models.Book, int, error) {
+	return db.GetBooks(ctx, r.db, filter, sortBy, descending, collation, page, limit, countTotal)
+}
+
+func (r *sqlRepository) CountBooks(ctx context.Context, query string, filter db.BookFilter) (int, error) {
+	return db.CountBooks(ctx, r.db, query, filter)
+}
+
+func (r *sqlRepository) GetRandomBook(ctx context.Context, filter db.BookFilter) (*models.Book, error) {
+	return db.GetRandomBook(ctx, r.db, filter)
+}
+
+func (r *sqlRepository) ForEachBook(ctx context.Context, filter db.BookFilter, fn func(models.Book) error) error {
+	return db.ForEachBook(ctx, r.db, filter, fn)
+}
+
+func (r *sqlRepository) GetBooksAfter(ctx context.Context, filter db.BookFilter, descending bool, after *db.BookCursor, limit int) ([]models.Book, *db.BookCursor, error) {
+	return db.GetBooksAfter(ctx, r.db, filter, descending, after, limit)
+}
+
+func (r *sqlRepository) SearchBooks(ctx context.Context, query string, filter db.BookFilter, page, limit, countOnlyAbove int, countTotal bool) ([]models.Book, int, *float64, error) {
+	return db.SearchBooks(ctx, r.db, query, filter, page, limit, countOnlyAbove, countTotal)
+}
+
+func (r *sqlRepository) StreamBooks(ctx context.Context, query string, filter db.BookFilter, sortBy string, descending bool, collation string, page, limit int, fn func(models.Book) error) error {
+	return db.StreamBooks(ctx, r.db, query, filter, sortBy, descending, collation, page, limit, fn)
+}
+
+func (r *sqlRepository) GetBookByID(ctx context.Context, id int) (*models.Book, error) {
+	return db.GetBookByID(ctx, r.db, id)
+}
+
+func (r *sqlRepository) TouchBook(ctx context.Context, id int) error {
+	return db.TouchBook(ctx, r.db, id)
+}
+
+func (r *sqlRepository) CreateBook(ctx context.Context, req models.CreateBookRequest, maxPerAuthor int) (*models.Book, error) {
+	return db.CreateBook(ctx, r.db, req, maxPerAuthor)
+}
+
+func (r *sqlRepository) CreateBooks(ctx context.Context, reqs []models.CreateBookRequest, maxPerAuthor int) ([]models.Book, error) {
+	return db.CreateBooks(ctx, r.db, reqs, maxPerAuthor)
+}
+
+func (r *sqlRepository) ImportBooks(ctx context.Context, reqs []models.CreateBookRequest, importBatchID string, batchSize, maxPerAuthor int) (int, error) {
+	return db.ImportBooks(ctx, r.db, reqs, importBatchID, batchSize, maxPerAuthor)
+}
+
+func (r *sqlRepository) MatchBooks(ctx context.Context, reqs []models.CreateBookRequest, key string) ([]int, error) {
+	return db.MatchBooks(ctx, r.db, reqs, key)
+}
+
+func (r *sqlRepository) UpsertBooks(ctx context.Context, reqs []models.CreateBookRequest, ids []int, importBatchID string, batchSize, maxPerAuthor int) (int, int, error) {
+	return db.UpsertBooks(ctx, r.db, reqs, ids, importBatchID, batchSize, maxPerAuthor)
+}
+
+func (r *sqlRepository) ExistingISBNs(ctx context.Context, isbns []string) (map[string]bool, error) {
+	return db.ExistingISBNs(ctx, r.db, isbns)
+}
+
+func (r *sqlRepository) CountBooksByAuthor(ctx context.Context, authors []string) (map[string]int, error) {
+	return db.CountBooksByAuthor(ctx, r.db, authors)
+}
+
+func (r *sqlRepository) UpdateBook(ctx context.Context, id int, req models.UpdateBookRequest, matches func(*models.Book) bool) (*models.Book, bool, error) {
+	return db.UpdateBook(ctx, r.db, id, req, matches)
+}
+
+func (r *sqlRepository) ReplaceBook(ctx context.Context, id int, req models.CreateBookRequest, matches func(*models.Book) bool) (*models.Book, bool, error) {
+	return db.ReplaceBook(ctx, r.db, id, req, matches)
+}
+
+func (r *sqlRepository) PreviewUpdate(ctx context.Context, id int, req models.UpdateBookRequest) (*models.UpdatePreview, error) {
+	return db.PreviewUpdate(ctx, r.db, id, req)
+}
+
+func (r *sqlRepository) DeleteBook(ctx context.Context, id int) error {
+	return db.DeleteBook(ctx, r.db, id)
+}
+
+func (r *sqlRepository) DeleteImportBatch(ctx context.Context, importBatchID string) (int, error) {
+	return db.DeleteImportBatch(ctx, r.db, importBatchID)
+}
+
+func (r *sqlRepository) GetYearCounts(ctx context.Context, query string, filter db.BookFilter) ([]models.YearCount, error) {
+	return db.GetYearCounts(ctx, r.db, query, filter)
+}
+
+func (r *sqlRepository) GetAvailabilityChanges(ctx context.Context, since time.Time, page, limit int) ([]models.Book, int, error) {
+	return db.GetAvailabilityChanges(ctx, r.db, since, page, limit)
+}
+
+func (r *sqlRepository) GetStaleBooks(ctx context.Context, before time.Time, page, limit int) ([]models.Book, int, error) {
+	return db.GetStaleBooks(ctx, r.db, before, page, limit)
+}
+
+func (r *sqlRepository) CountMatrix(ctx context.Context, rowColumn, colColumn string) (map[string]map[string]int, error) {
+	return db.CountMatrix(ctx, r.db, rowColumn, colColumn)
+}
+
+func (r *sqlRepository) GetFeaturedBooks(ctx context.Context, orderBy string, descending bool) ([]models.Book, error) {
+	return db.GetFeaturedBooks(ctx, r.db, orderBy, descending)
+}
+
+func (r *sqlRepository) SetFeatured(ctx context.Context, id int, featured bool, maxFeatured int) (*models.Book, error) {
+	return db.SetFeatured(ctx, r.db, id, featured, maxFeatured)
+}
+
+func (r *sqlRepository) GetEditions(ctx context.Context, book *models.Book) ([]models.Book, error) {
+	return db.GetEditions(ctx, r.db, book)
+}
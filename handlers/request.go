@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errTrailingData is returned by decodeJSON for bodies holding more than
+// one JSON value
+var errTrailingData = errors.New("unexpected data after JSON value")
+
+// readRequestBody reads the whole request body. If it can't be read, an
+// error response is sent and ok is false: 413 when the body is over the
+// server's size limit, 400 otherwise.
+func readRequestBody(w http.ResponseWriter, r *http.Request) (body []byte, ok bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			sendErrorResponse(w, r, http.StatusRequestEntityTooLarge, newMessage(msgBodyTooLarge, tooLarge.Limit))
+			return nil, false
+		}
+		sendErrorResponse(w, r, http.StatusBadRequest, newMessage(msgUnreadableBody))
+		return nil, false
+	}
+	return body, true
+}
+
+// decodeJSON decodes a request body into v. Fields v doesn't have are
+// rejected, so a misspelled field isn't silently ignored.
+func decodeJSON(body []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errTrailingData
+	}
+	return nil
+}
+
+// decodeJSONBody reads the request body and decodes it into v. If either
+// fails, an error response is sent and false is returned. An empty body is
+// accepted, leaving v unchanged, when optional is true.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}, optional bool) bool {
+	body, ok := readRequestBody(w, r)
+	if !ok {
+		return false
+	}
+
+	if optional && len(bytes.TrimSpace(body)) == 0 {
+		return true
+	}
+
+	if err := decodeJSON(body, v); err != nil {
+		sendErrorResponse(w, r, http.StatusBadRequest, decodeErrorMessage(err))
+		return false
+	}
+	return true
+}
+
+// decodeErrorMessage describes a decodeJSON error precisely enough for the
+// client to find the mistake: the offending field and byte offset where
+// encoding/json reports them.
+func decodeErrorMessage(err error) *message {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case errors.As(err, &syntaxErr):
+		return newMessage(msgJSONSyntax, syntaxErr.Offset)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return newMessage(msgJSONTruncated)
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return newMessage(msgInvalidFieldValue, typeErr.Field, typeErr.Offset, typeErr.Type.String())
+	}
+
+	// encoding/json has no error type for unknown fields, only this text
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		if unquoted, err := strconv.Unquote(name); err == nil {
+			name = unquoted
+		}
+		return newMessage(msgUnknownField, name)
+	}
+	return newMessage(msgInvalidJSON)
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCreateBookRejectedBodies(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		code   string
+		error  string // part of the message
+	}{
+		{
+			name:   "too large",
+			body:   `{"title": "` + strings.Repeat("a", 2048) + `", "author": "Frank Herbert", "published_year": 1965}`,
+			status: http.StatusRequestEntityTooLarge,
+			code:   msgBodyTooLarge,
+			error:  "1024",
+		},
+		{
+			name:   "unknown field",
+			body:   `{"titel": "Dune", "author": "Frank Herbert", "published_year": 1965}`,
+			status: http.StatusBadRequest,
+			code:   msgUnknownField,
+			error:  "titel",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newFakeRepository()
+			h := NewBookHandler(repo)
+
+			req := httptest.NewRequest("POST", "/api/v1/books", strings.NewReader(tt.body))
+			rec := httptest.NewRecorder()
+			req.Body = http.MaxBytesReader(rec, req.Body, 1024)
+			h.CreateBook(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if resp := decodeResponse(t, rec); resp.Code != tt.code || !strings.Contains(resp.Error, tt.error) {
+				t.Errorf("response = %+v, want code %q mentioning %q", resp, tt.code, tt.error)
+			}
+			if len(repo.books) != 0 {
+				t.Error("the book reached the repository")
+			}
+		})
+	}
+}
+
+func TestDecodeErrorMessage(t *testing.T) {
+	tests := []struct {
+		body string
+		code string
+		text string // English message, when it has a fixed text
+	}{
+		{`{"title": "Dune", "published_year": "1965"}`, msgInvalidFieldValue, "Invalid value for field 'published_year' at position 42: expected int"},
+		{`{"title": 12}`, msgInvalidFieldValue, "Invalid value for field 'title' at position 12: expected string"},
+		{`{"titel": "Dune"}`, msgUnknownField, "Unknown field 'titel'"},
+		{`{"title": "Dune",}`, msgJSONSyntax, "Malformed JSON at position 18"},
+		{`{"title": "Dune"`, msgJSONTruncated, "Request body ends before the JSON value is complete"},
+		{`{"title": "Dune"} {}`, msgInvalidJSON, ""},
+	}
+
+	for _, tt := range tests {
+		var req struct {
+			Title         string `json:"title"`
+			PublishedYear int    `json:"published_year"`
+		}
+		err := decodeJSON([]byte(tt.body), &req)
+		if err == nil {
+			t.Errorf("%s: decoded without error", tt.body)
+			continue
+		}
+		msg := decodeErrorMessage(err)
+		if msg.code != tt.code {
+			t.Errorf("%s: code = %q, want %q", tt.body, msg.code, tt.code)
+		}
+		if text := english(msg); tt.text != "" && text != tt.text {
+			t.Errorf("%s: message = %q, want %q", tt.body, text, tt.text)
+		}
+	}
+}
+
+func TestUpdateBookDecodeErrors(t *testing.T) {
+	tests := []struct {
+		body string
+		code string
+	}{
+		{`{"published_year": "nineteen"}`, msgInvalidFieldValue},
+		{`{"availble": false}`, msgUnknownField},
+	}
+
+	for _, tt := range tests {
+		h := NewBookHandler(newFakeRepository(storedBook()))
+
+		rec := serve(h.UpdateBook, "PATCH", "/api/v1/books/1", tt.body, map[string]string{"id": "1"})
+
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want %d", tt.body, rec.Code, http.StatusBadRequest)
+			continue
+		}
+		if resp := decodeResponse(t, rec); resp.Code != tt.code {
+			t.Errorf("%s: code = %q, want %q", tt.body, resp.Code, tt.code)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"library-api/models"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Helper methods
+func sendJSONResponse(w http.ResponseWriter, statusCode int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		logrus.WithError(err).Error("Failed to encode JSON response")
+	}
+}
+
+// defaultRetryAfter is advertised on 503 responses that don't set their own
+// Retry-After value
+const defaultRetryAfter = 5 * time.Second
+
+// sendErrorResponse sends an error with the message's code and its text in
+// the language the request prefers
+func sendErrorResponse(w http.ResponseWriter, r *http.Request, statusCode int, msg *message) {
+	if statusCode == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+		setRetryAfter(w, defaultRetryAfter)
+	}
+
+	lang := requestLanguage(r)
+	w.Header().Set("Content-Language", lang)
+
+	response := models.APIResponse{
+		Success: false,
+		Error:   msg.localize(lang),
+		Code:    msg.code,
+	}
+
+	sendJSONResponse(w, statusCode, response)
+}
+
+// sendValidationError sends a 422 with msg as the error and every
+// violation, keyed by field, in fields
+func sendValidationError(w http.ResponseWriter, r *http.Request, msg *message, violations []fieldViolation) {
+	lang := requestLanguage(r)
+	w.Header().Set("Content-Language", lang)
+
+	response := models.APIResponse{
+		Success: false,
+		Error:   msg.localize(lang),
+		Code:    msg.code,
+		Fields:  make(map[string]string, len(violations)),
+	}
+	for _, v := range violations {
+		response.Fields[v.field] = v.msg.localize(lang)
+	}
+
+	sendJSONResponse(w, http.StatusUnprocessableEntity, response)
+}
+
+// sendUnavailableResponse sends a 503 telling the client to retry after the
+// given cool-down
+func sendUnavailableResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration, msg *message) {
+	setRetryAfter(w, retryAfter)
+	sendErrorResponse(w, r, http.StatusServiceUnavailable, msg)
+}
+
+// setRetryAfter sets the Retry-After header in whole seconds, rounding up
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	seconds := int(math.Ceil(d.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
+
+// sendOptionsResponse describes a resource's supported methods in the Allow
+// header and its content types in the body
+func sendOptionsResponse(w http.ResponseWriter, methods, contentTypes []string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+
+	response := models.APIResponse{
+		Success: true,
+		Data: models.ResourceOptions{
+			Methods:      methods,
+			ContentTypes: contentTypes,
+		},
+	}
+
+	sendJSONResponse(w, http.StatusOK, response)
+}
+
+// newPagination builds the pagination block for a page of results. A negative
+// total means it wasn't counted; the caller then sets HasNext itself.
+func newPagination(page, limit, total int) models.Pagination {
+	if total < 0 {
+		return models.Pagination{
+			Page:         page,
+			Limit:        limit,
+			Total:        -1,
+			TotalPages:   -1,
+			TotalUnknown: true,
+		}
+	}
+
+	totalPages := int(math.Ceil(float64(total) / float64(limit)))
+	return models.Pagination{
+		Page:       page,
+		Limit:      limit,
+		Total:      total,
+		TotalPages: totalPages,
+		HasNext:    page < totalPages,
+	}
+}
+
+// setPaginationLinks sets an RFC 8288 Link header pointing at the first,
+// previous, next and last pages of a list, as far as they exist and are
+// known. Links are relative and keep the request's other query parameters.
+// For cursor pagination, which has no page numbers, they point at the start
+// and the next cursor.
+func setPaginationLinks(w http.ResponseWriter, r *http.Request, p models.Pagination) {
+	var links []string
+	link := func(rel, param, value string) {
+		query := r.URL.Query()
+		query.Set(param, value)
+		links = append(links, fmt.Sprintf(`<%s?%s>; rel="%s"`, r.URL.Path, query.Encode(), rel))
+	}
+
+	if p.Page == 0 {
+		link("first", "cursor", "")
+		if p.NextCursor != "" {
+			link("next", "cursor", p.NextCursor)
+		}
+	} else {
+		link("first", "page", "1")
+		if p.Page > 1 {
+			prev := p.Page - 1
+			// Past the end, step back onto the last page
+			if !p.TotalUnknown && prev > p.TotalPages {
+				prev = max(p.TotalPages, 1)
+			}
+			link("prev", "page", strconv.Itoa(prev))
+		}
+		if p.HasNext {
+			link("next", "page", strconv.Itoa(p.Page+1))
+		}
+		if !p.TotalUnknown {
+			link("last", "page", strconv.Itoa(max(p.TotalPages, 1)))
+		}
+	}
+
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
+
+// prefersMinimal reports whether the client asked for a minimal response with
+// a "Prefer: return=minimal" header (RFC 7240)
+func prefersMinimal(r *http.Request) bool {
+	for _, header := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(header, ",") {
+			// Ignore any parameters following the preference
+			token, _, _ := strings.Cut(pref, ";")
+			if strings.EqualFold(strings.TrimSpace(token), "return=minimal") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sendCreatedBook sends the 201 response for a newly created book, with a
+// Location header. Only the book's ID is returned if the client prefers a
+// minimal response.
+func sendCreatedBook(w http.ResponseWriter, r *http.Request, book *models.Book, message string) {
+	w.Header().Set("Location", fmt.Sprintf("/api/v1/books/%d", book.ID))
+
+	if prefersMinimal(r) {
+		w.Header().Set("Preference-Applied", "return=minimal")
+		sendJSONResponse(w, http.StatusCreated, models.APIResponse{
+			Success: true,
+			Data:    models.ResourceID{ID: book.ID},
+		})
+		return
+	}
+
+	sendJSONResponse(w, http.StatusCreated, models.APIResponse{
+		Success: true,
+		Data:    book,
+		Message: message,
+	})
+}
+
+// bookETag returns a strong entity tag for a book, hashed from its fields.
+// It identifies a version of the book, so it can be compared strongly for
+// If-Match. last_accessed_at records reads rather than changes to the book,
+// so it is left out and merely reading a book doesn't change its tag.
+func bookETag(book *models.Book) string {
+	tagged := *book
+	tagged.LastAccessedAt = nil
+
+	data, err := json.Marshal(tagged)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header matches etag, using
+// the weak comparison conditional GETs call for
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// etagMatchesStrong reports whether an If-Match header matches etag, using
+// the strong comparison RFC 7232 requires for it: weak tags never match
+func etagMatchesStrong(ifMatch, etag string) bool {
+	if ifMatch == "" || etag == "" || strings.HasPrefix(etag, "W/") {
+		return false
+	}
+
+	for _, candidate := range strings.Split(ifMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"errors"
+	"library-api/models"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// Published years accepted by validation
+const (
+	minPublishedYear = 1000
+	maxPublishedYear = 2100
+)
+
+// maxTextLength is the width in characters of the title and author columns
+const maxTextLength = 255
+
+// maxGenreLength is the width in characters of the genre column
+const maxGenreLength = 100
+
+// isEmptyUpdate reports whether an update request sets no fields
+func isEmptyUpdate(req models.UpdateBookRequest) bool {
+	return req.Title == nil && req.Author == nil && req.ISBN == nil && req.Genre == nil && req.PublishedYear == nil && req.Available == nil
+}
+
+// fieldViolation is a broken validation rule and the request field, by its
+// JSON name, that broke it
+type fieldViolation struct {
+	field string
+	msg   *message
+}
+
+// requestValidator checks request structs against their validate tags
+var requestValidator = newRequestValidator()
+
+// newRequestValidator returns a validator that names fields by their JSON
+// names and checks ISBNs with isValidISBN, which unlike the built-in isbn
+// rule accepts ISBN-13s outside the 978 and 979 prefixes
+func newRequestValidator() *validator.Validate {
+	v := validator.New()
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	if err := v.RegisterValidation("isbn", func(fl validator.FieldLevel) bool {
+		return isValidISBN(fl.Field().String())
+	}); err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// validateStruct checks a request struct against its validate tags and
+// returns a violation for every field that breaks one, in field order
+func validateStruct(req interface{}) []fieldViolation {
+	err := requestValidator.Struct(req)
+	if err == nil {
+		return nil
+	}
+
+	var errs validator.ValidationErrors
+	if !errors.As(err, &errs) {
+		// Only returned for a nil or non-struct req, which is a bug
+		panic(err)
+	}
+
+	violations := make([]fieldViolation, 0, len(errs))
+	for _, fe := range errs {
+		violations = append(violations, fieldViolation{field: fe.Field(), msg: fieldErrorMessage(fe)})
+	}
+	return violations
+}
+
+// fieldErrorMessage returns the message for a field breaking one of its
+// validate rules. Empty text fails required when creating and min when
+// updating, which keeps the message codes clients already match on.
+func fieldErrorMessage(fe validator.FieldError) *message {
+	switch fe.Field() {
+	case "title":
+		switch fe.Tag() {
+		case "required":
+			return newMessage(msgTitleRequired)
+		case "min":
+			return newMessage(msgTitleEmpty)
+		case "max":
+			return newMessage(msgTitleTooLong, maxTextLength)
+		}
+	case "author":
+		switch fe.Tag() {
+		case "required":
+			return newMessage(msgAuthorRequired)
+		case "min":
+			return newMessage(msgAuthorEmpty)
+		case "max":
+			return newMessage(msgAuthorTooLong, maxTextLength)
+		}
+	case "isbn":
+		return newMessage(msgInvalidISBN)
+	case "genre":
+		return newMessage(msgGenreTooLong, maxGenreLength)
+	case "published_year":
+		return yearOutOfRangeMessage()
+	}
+	return newMessage(msgInvalidField, fe.Field())
+}
+
+// validateCreateRequest normalizes the request fields in place and returns
+// a violation for every invalid one
+func validateCreateRequest(req *models.CreateBookRequest) []fieldViolation {
+	req.Title = strings.TrimSpace(req.Title)
+	req.Author = strings.TrimSpace(req.Author)
+	req.ISBN = normalizeISBN(req.ISBN)
+	req.Genre = normalizeGenre(req.Genre)
+
+	return validateStruct(req)
+}
+
+// validateCreate applies validateCreateRequest and then the handler's
+// configured genres and author format to fields that are otherwise valid
+func (h *BookHandler) validateCreate(req *models.CreateBookRequest) []fieldViolation {
+	violations := validateCreateRequest(req)
+	if !hasViolation(violations, "author") {
+		violations = appendViolation(violations, "author", h.authorFormatViolation(req.Author))
+	}
+	if !hasViolation(violations, "genre") {
+		violations = appendViolation(violations, "genre", h.genreViolation(req.Genre))
+	}
+	return violations
+}
+
+// validateUpdate applies validateUpdateRequest and then the handler's
+// configured genres and author format to otherwise valid fields being set
+func (h *BookHandler) validateUpdate(req *models.UpdateBookRequest) []fieldViolation {
+	violations := validateUpdateRequest(req)
+	if req.Author != nil && !hasViolation(violations, "author") {
+		violations = appendViolation(violations, "author", h.authorFormatViolation(*req.Author))
+	}
+	if req.Genre != nil && !hasViolation(violations, "genre") {
+		violations = appendViolation(violations, "genre", h.genreViolation(*req.Genre))
+	}
+	return violations
+}
+
+// hasViolation reports whether field already has a violation
+func hasViolation(violations []fieldViolation, field string) bool {
+	for _, v := range violations {
+		if v.field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// appendViolation appends a violation for field if msg isn't nil
+func appendViolation(violations []fieldViolation, field string, msg *message) []fieldViolation {
+	if msg == nil {
+		return violations
+	}
+	return append(violations, fieldViolation{field: field, msg: msg})
+}
+
+// lastFirstAuthor matches author names written as "Last, First"
+var lastFirstAuthor = regexp.MustCompile(`^[^,]+, [^,]+$`)
+
+// authorFormatViolation returns an error message if a trimmed author name
+// doesn't match the configured format, or nil otherwise
+func (h *BookHandler) authorFormatViolation(author string) *message {
+	if h.requireLastFirstAuthors && !lastFirstAuthor.MatchString(author) {
+		return newMessage(msgAuthorFormat)
+	}
+	return nil
+}
+
+// normalizeGenre trims and lower-cases a genre, so filtering matches it
+// exactly whatever case it was written in
+func normalizeGenre(genre string) string {
+	return strings.ToLower(strings.TrimSpace(genre))
+}
+
+// genreViolation returns an error message if a normalized genre isn't one
+// of the configured genres, or nil otherwise. Any genre is accepted when
+// none are configured, and an empty genre always is.
+func (h *BookHandler) genreViolation(genre string) *message {
+	if genre == "" || len(h.allowedGenres) == 0 || h.allowedGenres[genre] {
+		return nil
+	}
+
+	genres := make([]string, 0, len(h.allowedGenres))
+	for g := range h.allowedGenres {
+		genres = append(genres, g)
+	}
+	sort.Strings(genres)
+	return newMessage(msgGenreNotAllowed, strings.Join(genres, ", "))
+}
+
+// validateUpdateRequest normalizes the provided fields in place and returns
+// a violation for every invalid one
+func validateUpdateRequest(req *models.UpdateBookRequest) []fieldViolation {
+	if req.Title != nil {
+		trimmed := strings.TrimSpace(*req.Title)
+		req.Title = &trimmed
+	}
+	if req.Author != nil {
+		trimmed := strings.TrimSpace(*req.Author)
+		req.Author = &trimmed
+	}
+	// An empty ISBN clears it
+	if req.ISBN != nil {
+		normalized := normalizeISBN(*req.ISBN)
+		req.ISBN = &normalized
+	}
+	// As does an empty genre
+	if req.Genre != nil {
+		normalized := normalizeGenre(*req.Genre)
+		req.Genre = &normalized
+	}
+
+	return validateStruct(req)
+}
+
+// yearOutOfRangeMessage reports the accepted published year range
+func yearOutOfRangeMessage() *message {
+	return newMessage(msgYearOutOfRange, minPublishedYear, maxPublishedYear)
+}
+
+// normalizeISBN strips the hyphens and spaces ISBNs are often written with
+// and upper-cases an ISBN-10 check digit of x
+func normalizeISBN(isbn string) string {
+	isbn = strings.NewReplacer("-", "", " ", "").Replace(isbn)
+	return strings.ToUpper(isbn)
+}
+
+// isValidISBN reports whether a normalized ISBN is a well-formed ISBN-10 or
+// ISBN-13 with a correct check digit
+func isValidISBN(isbn string) bool {
+	switch len(isbn) {
+	case 10:
+		// Digits are weighted 10 down to 1; X stands for 10 as the check digit
+		sum := 0
+		for i, r := range isbn {
+			var digit int
+			switch {
+			case r >= '0' && r <= '9':
+				digit = int(r - '0')
+			case r == 'X' && i == 9:
+				digit = 10
+			default:
+				return false
+			}
+			sum += (10 - i) * digit
+		}
+		return sum%11 == 0
+
+	case 13:
+		// Digits are weighted alternately 1 and 3
+		sum := 0
+		for i, r := range isbn {
+			if r < '0' || r > '9' {
+				return false
+			}
+			weight := 1
+			if i%2 == 1 {
+				weight = 3
+			}
+			sum += weight * int(r-'0')
+		}
+		return sum%10 == 0
+	}
+
+	return false
+}
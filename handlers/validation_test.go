@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"fmt"
+	"library-api/models"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// english returns a message's English text, or an empty string for none
+func english(m *message) string {
+	if m == nil {
+		return ""
+	}
+	return m.localize("en")
+}
+
+// violations formats the English text of each violation by field, e.g.
+// "map[title:Title is required]"
+func violations(vs []fieldViolation) string {
+	texts := make(map[string]string, len(vs))
+	for _, v := range vs {
+		texts[v.field] = english(v.msg)
+	}
+	return fmt.Sprint(texts)
+}
+
+func TestTextLengthBoundaries(t *testing.T) {
+	atLimit := strings.Repeat("a", maxTextLength)
+	over := atLimit + "a"
+
+	tests := []struct {
+		name   string
+		title  string
+		author string
+		want   string
+	}{
+		{"at the limit", atLimit, strings.Repeat("b", maxTextLength), "map[]"},
+		{"multibyte at the limit", strings.Repeat("é", maxTextLength), "Author", "map[]"},
+		{"surrounding spaces trimmed", " " + atLimit + " ", "Author", "map[]"},
+		{"title over", over, "Author", "map[title:Title must be at most 255 characters]"},
+		{"author over", "Title", over, "map[author:Author must be at most 255 characters]"},
+		{"both over", over, over, "map[author:Author must be at most 255 characters title:Title must be at most 255 characters]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			create := models.CreateBookRequest{Title: tt.title, Author: tt.author, PublishedYear: 2000}
+			if got := violations(validateCreateRequest(&create)); got != tt.want {
+				t.Errorf("create: %q, want %q", got, tt.want)
+			}
+
+			title, author := tt.title, tt.author
+			update := models.UpdateBookRequest{Title: &title, Author: &author}
+			if got := violations(validateUpdateRequest(&update)); got != tt.want {
+				t.Errorf("update: %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestISBNValidation(t *testing.T) {
+	tests := []struct {
+		isbn  string
+		valid bool
+	}{
+		{"9780306406157", true},
+		{"978-0-306-40615-7", true},
+		{"978 0 306 40615 7", true},
+		{"0306406152", true},
+		{"080442957X", true},
+		{"080442957x", true},
+		{"9780306406158", false},
+		{"0306406153", false},
+		{"X804429570", false},
+		{"978030640615", false},
+		{"97803064061570", false},
+		{"978030640615A", false},
+	}
+
+	for _, tt := range tests {
+		if got := isValidISBN(normalizeISBN(tt.isbn)); got != tt.valid {
+			t.Errorf("%q: valid = %v, want %v", tt.isbn, got, tt.valid)
+		}
+	}
+}
+
+func TestAuthorFormat(t *testing.T) {
+	const lastFirst = `map[author:Author must be in "Last, First" format, e.g. "Tolkien, J. R. R."]`
+
+	tests := []struct {
+		author    string
+		lastFirst bool // AUTHOR_FORMAT=last_first
+		want      string
+	}{
+		{"Frank Herbert", false, "map[]"},
+		{"Herbert, Frank", true, "map[]"},
+		{"Le Guin, Ursula K.", true, "map[]"},
+		{"  Herbert, Frank  ", true, "map[]"},
+		{"Frank Herbert", true, lastFirst},
+		{"Herbert,Frank", true, lastFirst},
+		{"Herbert, Frank, Jr.", true, lastFirst},
+		{", Frank", true, lastFirst},
+	}
+
+	for _, tt := range tests {
+		h := &BookHandler{requireLastFirstAuthors: tt.lastFirst}
+
+		create := models.CreateBookRequest{Title: "Dune", Author: tt.author, PublishedYear: 1965}
+		if got := violations(h.validateCreate(&create)); got != tt.want {
+			t.Errorf("create %q: %q, want %q", tt.author, got, tt.want)
+		}
+
+		author := tt.author
+		update := models.UpdateBookRequest{Author: &author}
+		if got := violations(h.validateUpdate(&update)); got != tt.want {
+			t.Errorf("update %q: %q, want %q", tt.author, got, tt.want)
+		}
+	}
+}
+
+func TestCreateBookReportsEveryViolation(t *testing.T) {
+	body := `{"title": "  ", "author": "", "published_year": 99, "isbn": "12345"}`
+
+	tests := []struct {
+		language string
+		fields   map[string]string
+	}{
+		{"en", map[string]string{
+			"title":          "Title is required",
+			"author":         "Author is required",
+			"published_year": "Published year must be between 1000 and 2100",
+			"isbn":           "ISBN must be a valid ISBN-10 or ISBN-13",
+		}},
+		{"es", map[string]string{
+			"title":          "El título es obligatorio",
+			"author":         "El autor es obligatorio",
+			"published_year": "El año de publicación debe estar entre 1000 y 2100",
+			"isbn":           "El ISBN debe ser un ISBN-10 o ISBN-13 válido",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.language, func(t *testing.T) {
+			repo := newFakeRepository()
+			h := NewBookHandler(repo)
+
+			rec := serveWithHeaders(h.CreateBook, "POST", "/api/v1/books", body, nil, map[string]string{"Accept-Language": tt.language})
+
+			if rec.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("status = %d, want %d", rec.Code, http.StatusUnprocessableEntity)
+			}
+			resp := decodeResponse(t, rec)
+			if got, want := fmt.Sprint(resp.Fields), fmt.Sprint(tt.fields); got != want {
+				t.Errorf("fields = %s, want %s", got, want)
+			}
+			if resp.Error != tt.fields["title"] {
+				t.Errorf("error = %q, want the first violation", resp.Error)
+			}
+			if len(repo.books) != 0 {
+				t.Error("the book reached the repository")
+			}
+		})
+	}
+}
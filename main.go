@@ -2,16 +2,29 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"library-api/db"
 	"library-api/handlers"
+	"library-api/models"
+	"library-api/spec"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 )
 
@@ -38,7 +51,6 @@ func main() {
 	if err != nil {
 		logrus.Fatal("Failed to initialize database: ", err)
 	}
-	defer database.Close()
 
 	// Run migrations
 	if err := db.RunMigrations(database); err != nil {
@@ -46,10 +58,30 @@ func main() {
 	}
 
 	// Initialize handlers
-	bookHandler := handlers.NewBookHandler(database)
+	bookHandler := handlers.NewBookHandler(handlers.NewSQLRepository(database))
+	adminHandler := handlers.NewAdminHandler(database, bookHandler)
+	healthHandler := handlers.NewHealthHandler(database)
 
 	// Setup routes
-	router := setupRoutes(bookHandler)
+	router := setupRoutes(bookHandler, adminHandler, healthHandler)
+
+	// Cancelled on SIGINT or SIGTERM, shutting down the server and anything
+	// running alongside it
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+
+	// Middleware wraps the whole router rather than being registered with
+	// router.Use, so it also sees requests matching no route, such as CORS
+	// preflights
+	var handler http.Handler = recoveryMiddleware(router)
+	handler = maxBodyMiddleware(maxBodyBytesFromEnv())(handler)
+	// Optionally limit each client's request rate
+	if limiter := rateLimiterFromEnv(); limiter != nil {
+		go limiter.sweepEvery(ctx, rateLimitSweepInterval)
+		handler = limiter.middleware(handler)
+	}
+	// CORS goes outside the limiter so browsers can read 429 responses
+	handler = corsMiddleware(corsConfigFromEnv())(handler)
+	handler = metricsMiddleware(router)(handler)
 
 	// Server configuration
 	port := os.Getenv("PORT")
@@ -59,90 +91,409 @@ func main() {
 
 	server := &http.Server{
 		Addr:         ":" + port,
-		Handler:      router,
+		Handler:      loggingMiddleware(handler),
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
 
-	// Start server in a goroutine
-	go func() {
-		logrus.Infof("Server starting on port %s", port)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logrus.Fatal("Failed to start server: ", err)
+	// Give in-flight requests this long to finish on shutdown
+	drainTimeout := 15 * time.Second
+	if v := os.Getenv("SHUTDOWN_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			drainTimeout = d
+		} else {
+			logrus.Warnf("Invalid SHUTDOWN_TIMEOUT %q, using %s", v, drainTimeout)
 		}
-	}()
-
-	// Wait for interrupt signal to gracefully shutdown
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
+	}
 
-	logrus.Info("Shutting down server...")
+	code := run(ctx, server, healthHandler, database, drainTimeout)
+	stop()
+	os.Exit(code)
+}
 
-	// Gracefully shutdown the server with a timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+// run serves until ctx is cancelled or the server fails, then closes the
+// database. It returns the process exit code, which is 1 when the server
+// failed, e.g. because its port was taken, so supervisors see the failure.
+func run(ctx context.Context, server *http.Server, healthHandler *handlers.HealthHandler, database *sql.DB, drainTimeout time.Duration) int {
+	code := 0
+	if err := serve(ctx, server, healthHandler, drainTimeout); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logrus.Error("Server stopped with error: ", err)
+		code = 1
+	}
 
-	if err := server.Shutdown(ctx); err != nil {
-		logrus.Fatal("Server forced to shutdown: ", err)
+	if err := database.Close(); err != nil {
+		logrus.WithError(err).Error("Failed to close database")
 	}
 
 	logrus.Info("Server exited")
+	return code
 }
 
-func setupRoutes(bookHandler *handlers.BookHandler) *mux.Router {
-	router := mux.NewRouter()
+// maxBodyBytesFromEnv returns the largest request body the server accepts
+func maxBodyBytesFromEnv() int64 {
+	limit := int64(1 << 20)
+	if v := os.Getenv("MAX_BODY_BYTES"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			limit = n
+		} else {
+			logrus.Warnf("Invalid MAX_BODY_BYTES %q, using %d", v, limit)
+		}
+	}
+	return limit
+}
+
+// maxBodyMiddleware caps request bodies at limit bytes. Reading past the
+// limit fails, and handlers answer with 413.
+func maxBodyMiddleware(limit int64) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Body != nil {
+				r.Body = http.MaxBytesReader(w, r.Body, limit)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimiterFromEnv returns the per-client rate limiter configured by
+// RATE_LIMIT_RPS and RATE_LIMIT_BURST, or nil when rate limiting is off
+func rateLimiterFromEnv() *rateLimiter {
+	v := os.Getenv("RATE_LIMIT_RPS")
+	if v == "" {
+		return nil
+	}
+	rps, err := strconv.ParseFloat(v, 64)
+	if err != nil || rps <= 0 {
+		logrus.Warnf("Invalid RATE_LIMIT_RPS %q, rate limiting disabled", v)
+		return nil
+	}
+
+	// Allow short bursts of a second's worth of requests by default
+	burst := int(math.Ceil(rps))
+	if v := os.Getenv("RATE_LIMIT_BURST"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			burst = n
+		} else {
+			logrus.Warnf("Invalid RATE_LIMIT_BURST %q, using %d", v, burst)
+		}
+	}
 
-	// Middleware
-	router.Use(loggingMiddleware)
-	router.Use(corsMiddleware)
+	trustForwarded, _ := strconv.ParseBool(os.Getenv("TRUST_PROXY_HEADERS"))
+
+	logrus.WithFields(logrus.Fields{
+		"rps":             rps,
+		"burst":           burst,
+		"trust_forwarded": trustForwarded,
+	}).Info("Rate limiting enabled")
+	return newRateLimiter(rps, burst, trustForwarded)
+}
+
+// serve runs the server until ctx is cancelled, then fails the readiness
+// probe and gives in-flight requests up to drainTimeout to finish
+func serve(ctx context.Context, server *http.Server, healthHandler *handlers.HealthHandler, drainTimeout time.Duration) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		logrus.Infof("Server starting on %s", server.Addr)
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	logrus.WithField("drain_timeout", drainTimeout).Info("Shutting down server...")
+	healthHandler.BeginShutdown()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	return server.Shutdown(shutdownCtx)
+}
+
+func setupRoutes(bookHandler *handlers.BookHandler, adminHandler *handlers.AdminHandler, healthHandler *handlers.HealthHandler) *mux.Router {
+	router := mux.NewRouter()
 
 	// API routes
 	api := router.PathPrefix("/api/v1").Subrouter()
 
-	// Health check
-	router.HandleFunc("/health", healthCheckHandler).Methods("GET")
+	// Liveness and readiness probes
+	router.HandleFunc("/health", healthHandler.Health).Methods("GET")
+	router.HandleFunc("/ready", healthHandler.Ready).Methods("GET")
+
+	// Prometheus metrics
+	router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+
+	// API documentation
+	router.Handle("/openapi.json", spec.Handler()).Methods("GET")
+	router.Handle("/docs", spec.DocsHandler()).Methods("GET")
 
 	// Book routes
 	api.HandleFunc("/books", bookHandler.GetBooks).Methods("GET")
 	api.HandleFunc("/books", bookHandler.CreateBook).Methods("POST")
+	api.HandleFunc("/books", bookHandler.BooksOptions).Methods("OPTIONS")
+	api.HandleFunc("/books/bulk", bookHandler.CreateBooksBulk).Methods("POST")
+	api.HandleFunc("/books/featured", bookHandler.GetFeaturedBooks).Methods("GET")
+	api.HandleFunc("/books/import-template.csv", bookHandler.GetImportTemplate).Methods("GET")
+	api.HandleFunc("/books/count", bookHandler.CountBooks).Methods("GET")
+	api.HandleFunc("/books/random", bookHandler.GetRandomBook).Methods("GET")
+	api.HandleFunc("/books/export", bookHandler.ExportBooks).Methods("GET")
+	api.HandleFunc("/books/export", bookHandler.ExportMatchingBooks).Methods("POST")
+	api.HandleFunc("/books/import", bookHandler.ImportBooks).Methods("POST")
+	api.HandleFunc("/books/import-batch/{batch}", bookHandler.DeleteImportBatch).Methods("DELETE")
+	api.HandleFunc("/books/years", bookHandler.GetYearCounts).Methods("GET")
+	api.HandleFunc("/books/matrix", bookHandler.GetBookMatrix).Methods("GET")
+	api.HandleFunc("/books/availability-changes", bookHandler.GetAvailabilityChanges).Methods("GET")
+	api.HandleFunc("/books/stale", bookHandler.GetStaleBooks).Methods("GET")
 	api.HandleFunc("/books/{id}", bookHandler.GetBook).Methods("GET")
-	api.HandleFunc("/books/{id}", bookHandler.UpdateBook).Methods("PUT")
+	api.HandleFunc("/books/{id}", bookHandler.ReplaceBook).Methods("PUT")
+	api.HandleFunc("/books/{id}", bookHandler.UpdateBook).Methods("PATCH")
 	api.HandleFunc("/books/{id}", bookHandler.DeleteBook).Methods("DELETE")
+	api.HandleFunc("/books/{id}", bookHandler.BookOptions).Methods("OPTIONS")
+	api.HandleFunc("/books/{id}/editions", bookHandler.GetBookEditions).Methods("GET")
+	api.HandleFunc("/books/{id}/feature", bookHandler.FeatureBook).Methods("POST")
+	api.HandleFunc("/books/{id}/unfeature", bookHandler.UnfeatureBook).Methods("POST")
+	api.HandleFunc("/books/{id}/clone", bookHandler.CloneBook).Methods("POST")
+	api.HandleFunc("/books/{id}/preview-update", bookHandler.PreviewUpdate).Methods("POST")
+
+	// Admin routes
+	admin := api.PathPrefix("/admin").Subrouter()
+	admin.Use(adminAuthMiddleware(os.Getenv("ADMIN_API_KEY")))
+	admin.HandleFunc("/validate-all", adminHandler.ValidateAll).Methods("GET")
+	admin.HandleFunc("/health-report", adminHandler.HealthReport).Methods("GET")
+	admin.HandleFunc("/snapshot", adminHandler.CreateSnapshot).Methods("POST")
+	admin.HandleFunc("/snapshot/{name}/restore", adminHandler.RestoreSnapshot).Methods("POST")
+
+	// Debug routes are only registered when explicitly enabled
+	if debug, _ := strconv.ParseBool(os.Getenv("DEBUG_ENDPOINTS")); debug {
+		logrus.Warn("Debug endpoints enabled")
+		admin.HandleFunc("/explain", adminHandler.ExplainSearch).Methods("GET")
+		admin.HandleFunc("/diagnostics/queries", adminHandler.DiagnoseQueries).Methods("GET")
+	}
 
 	return router
 }
 
+// maxRequestIDLength caps an incoming X-Request-ID, which is copied into
+// logs and the response
+const maxRequestIDLength = 128
+
+// loggingMiddleware logs each request with its status and duration under a
+// request ID. A client's X-Request-ID is reused so requests can be traced
+// across services; otherwise one is generated. Either way it is returned in
+// the X-Request-ID response header.
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		next.ServeHTTP(w, r)
+
+		requestID := r.Header.Get("X-Request-ID")
+		if !isValidRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", requestID)
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
 		logrus.WithFields(logrus.Fields{
-			"method":   r.Method,
-			"path":     r.URL.Path,
-			"duration": time.Since(start),
+			"request_id":  requestID,
+			"method":      r.Method,
+			"path":        r.URL.Path,
+			"status":      recorder.status,
+			"duration_ms": time.Since(start).Milliseconds(),
 		}).Info("Request processed")
 	})
 }
 
-func corsMiddleware(next http.Handler) http.Handler {
+// recoveryMiddleware turns a panicking handler into a 500 error response
+// instead of a dropped connection, logging the stack trace under the
+// request ID. A response already under way can't be replaced, so its
+// connection is still aborted.
+func recoveryMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				// Deliberate abort, already logged by the handler
+				panic(err)
+			}
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+			logrus.WithFields(logrus.Fields{
+				"request_id": w.Header().Get("X-Request-ID"),
+				"method":     r.Method,
+				"path":       r.URL.Path,
+				"panic":      err,
+				"stack":      string(debug.Stack()),
+			}).Error("Handler panicked")
+
+			if recorder.wroteHeader {
+				panic(http.ErrAbortHandler)
+			}
+			writeJSONError(w, http.StatusInternalServerError, "internal_error", "Internal server error")
+		}()
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(recorder, r)
 	})
 }
 
-func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
+// isValidRequestID reports whether an incoming request ID is safe to log
+// and echo: non-empty, bounded and printable ASCII
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random 128-bit ID as hex
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// Still log the request, just without a unique ID
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// statusRecorder remembers the status code a handler writes. A handler
+// that never calls WriteHeader sends 200.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	return rec.ResponseWriter.Write(b)
+}
+
+// Flush keeps streamed responses working through the recorder
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// corsConfig lists what cross-origin requests may do
+type corsConfig struct {
+	// origins holds the allowed origins; nil allows any origin
+	origins map[string]bool
+	methods string
+	headers string
+}
+
+// corsConfigFromEnv reads CORS_ALLOWED_ORIGINS, CORS_ALLOWED_METHODS and
+// CORS_ALLOWED_HEADERS. Origins are comma-separated, and "*" allows any.
+func corsConfigFromEnv() corsConfig {
+	cfg := corsConfig{
+		methods: "GET, POST, PUT, PATCH, DELETE, OPTIONS",
+		headers: "Content-Type, Authorization, If-Match, If-None-Match",
+	}
+
+	if v := os.Getenv("CORS_ALLOWED_ORIGINS"); v != "" && strings.TrimSpace(v) != "*" {
+		cfg.origins = make(map[string]bool)
+		for _, origin := range strings.Split(v, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				cfg.origins[origin] = true
+			}
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("CORS_ALLOWED_METHODS")); v != "" {
+		cfg.methods = v
+	}
+	if v := strings.TrimSpace(os.Getenv("CORS_ALLOWED_HEADERS")); v != "" {
+		cfg.headers = v
+	}
+
+	return cfg
+}
+
+// corsMiddleware adds the CORS headers for allowed origins. With an origin
+// list, a matching Origin is echoed back and other origins get no CORS
+// headers, so browsers block their requests.
+func corsMiddleware(cfg corsConfig) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+
+			allowed := true
+			if cfg.origins == nil {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				// The response depends on the Origin, so caches must key on it
+				w.Header().Add("Vary", "Origin")
+				allowed = cfg.origins[origin]
+				if allowed {
+					w.Header().Set("Access-Control-Allow-Origin", origin)
+				}
+			}
+			if allowed {
+				w.Header().Set("Access-Control-Allow-Methods", cfg.methods)
+				w.Header().Set("Access-Control-Allow-Headers", cfg.headers)
+			}
+
+			// Only answer CORS preflights here; plain OPTIONS requests reach the
+			// route's handler so it can describe the resource
+			if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// adminAuthMiddleware only lets through requests carrying the admin API key in
+// the X-Admin-Key header. Admin routes are disabled when no key is configured.
+func adminAuthMiddleware(apiKey string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if apiKey == "" {
+				writeJSONError(w, http.StatusForbidden, "admin_not_configured", "Admin access is not configured")
+				return
+			}
+
+			provided := r.Header.Get("X-Admin-Key")
+			if subtle.ConstantTimeCompare([]byte(provided), []byte(apiKey)) != 1 {
+				writeJSONError(w, http.StatusUnauthorized, "invalid_admin_key", "Invalid or missing admin key")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// writeJSONError sends an error for requests rejected before reaching a
+// handler. Its message is always in English.
+func writeJSONError(w http.ResponseWriter, statusCode int, code, message string) {
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"status":"healthy","timestamp":"` + time.Now().UTC().Format(time.RFC3339) + `"}`))
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(models.APIResponse{Success: false, Error: message, Code: code})
 }
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"library-api/handlers"
+	"library-api/models"
+	"library-api/spec"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestMain(m *testing.M) {
+	logrus.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// startServer serves handler until ctx is done, returning its URL and a
+// channel receiving serve's result
+func startServer(t *testing.T, ctx context.Context, handler http.Handler, healthHandler *handlers.HealthHandler, drainTimeout time.Duration) (string, <-chan error) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	server := &http.Server{Addr: addr, Handler: handler}
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(ctx, server, healthHandler, drainTimeout)
+	}()
+
+	// Wait for the listener
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return "http://" + addr, done
+		}
+		if i == 100 {
+			t.Fatalf("server didn't start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServeShutdown(t *testing.T) {
+	tests := []struct {
+		name         string
+		drainTimeout time.Duration
+		finish       bool // whether the in-flight request finishes while draining
+		want         error
+	}{
+		{"drains in-flight requests", 5 * time.Second, true, nil},
+		{"drain timeout expires", 50 * time.Millisecond, false, context.DeadlineExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Pings of an unmonitored mock succeed, so the server is ready
+			// until it starts draining
+			database, _, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer database.Close()
+			healthHandler := handlers.NewHealthHandler(database)
+			started, release := make(chan struct{}), make(chan struct{})
+			routes := http.NewServeMux()
+			routes.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				<-release
+				w.Write([]byte("done"))
+			})
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			url, done := startServer(t, ctx, routes, healthHandler, tt.drainTimeout)
+
+			responses := make(chan error, 1)
+			go func() {
+				resp, err := http.Get(url + "/slow")
+				if err == nil {
+					_, err = io.ReadAll(resp.Body)
+					resp.Body.Close()
+				}
+				responses <- err
+			}()
+			<-started
+			cancel()
+
+			// Readiness fails as soon as draining starts
+			for i := 0; ; i++ {
+				rec := httptest.NewRecorder()
+				healthHandler.Ready(rec, httptest.NewRequest("GET", "/ready", nil))
+				if rec.Code == http.StatusServiceUnavailable {
+					break
+				}
+				if i == 100 {
+					t.Fatalf("readiness status while draining = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			if tt.finish {
+				close(release)
+				if err := <-responses; err != nil {
+					t.Errorf("in-flight request failed: %v", err)
+				}
+			}
+			if err := <-done; !errors.Is(err, tt.want) {
+				t.Errorf("serve = %v, want %v", err, tt.want)
+			}
+			if !tt.finish {
+				close(release)
+			}
+		})
+	}
+}
+
+func TestRunExitCode(t *testing.T) {
+	// taken is an address another listener already holds
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	taken := l.Addr().String()
+
+	tests := []struct {
+		name     string
+		addr     string
+		shutdown bool // cancel the context once serving
+		want     int
+	}{
+		{"port taken", taken, false, 1},
+		{"shut down", "127.0.0.1:0", true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The database is closed whether or not serving failed
+			mock.ExpectClose()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.shutdown {
+				time.AfterFunc(50*time.Millisecond, cancel)
+			}
+
+			server := &http.Server{Addr: tt.addr}
+			if got := run(ctx, server, handlers.NewHealthHandler(database), database, time.Second); got != tt.want {
+				t.Errorf("exit code = %d, want %d", got, tt.want)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	tests := []struct {
+		name      string
+		requestID string
+		reused    bool
+		status    int // written by the handler, or 0 to only write a body
+		logged    int
+	}{
+		{"generated", "", false, http.StatusTeapot, http.StatusTeapot},
+		{"reused", "trace-1234", true, http.StatusTeapot, http.StatusTeapot},
+		{"unsafe replaced", "bad id\n", false, http.StatusTeapot, http.StatusTeapot},
+		{"implicit status", "", false, 0, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		handler := loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tt.status != 0 {
+				w.WriteHeader(tt.status)
+			}
+			w.Write([]byte("ok"))
+		}))
+		req := httptest.NewRequest("GET", "/api/v1/books", nil)
+		if tt.requestID != "" {
+			req.Header.Set("X-Request-ID", tt.requestID)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		requestID := rec.Header().Get("X-Request-ID")
+		if tt.reused && requestID != tt.requestID {
+			t.Errorf("%s: X-Request-ID = %q, want %q", tt.name, requestID, tt.requestID)
+		}
+		if !tt.reused && (len(requestID) != 32 || requestID == tt.requestID) {
+			t.Errorf("%s: X-Request-ID = %q, want a generated ID", tt.name, requestID)
+		}
+
+		entry := hook.LastEntry()
+		if entry == nil {
+			t.Fatalf("%s: nothing logged", tt.name)
+		}
+		if entry.Data["request_id"] != requestID || entry.Data["status"] != tt.logged ||
+			entry.Data["method"] != "GET" || entry.Data["path"] != "/api/v1/books" {
+			t.Errorf("%s: logged %v", tt.name, entry.Data)
+		}
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	const list = "https://app.example.com, https://admin.example.com"
+
+	tests := []struct {
+		name      string
+		origins   string // CORS_ALLOWED_ORIGINS
+		method    string
+		origin    string
+		preflight bool
+		status    int
+		reached   bool
+		allow     string // Access-Control-Allow-Origin, empty for no CORS headers
+		vary      string
+	}{
+		{"any origin", "", "GET", "https://anywhere.example.com", false, http.StatusOK, true, "*", ""},
+		{"listed origin", list, "GET", "https://admin.example.com", false, http.StatusOK, true, "https://admin.example.com", "Origin"},
+		{"listed origin preflight", list, "OPTIONS", "https://app.example.com", true, http.StatusNoContent, false, "https://app.example.com", "Origin"},
+		{"other origin", list, "GET", "https://evil.example.com", false, http.StatusOK, true, "", "Origin"},
+		{"other origin preflight", list, "OPTIONS", "https://evil.example.com", true, http.StatusNoContent, false, "", "Origin"},
+		{"plain OPTIONS", list, "OPTIONS", "https://app.example.com", false, http.StatusOK, true, "https://app.example.com", "Origin"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CORS_ALLOWED_ORIGINS", tt.origins)
+			reached := false
+			handler := corsMiddleware(corsConfigFromEnv())(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				reached = true
+			}))
+
+			req := httptest.NewRequest(tt.method, "/api/v1/books", nil)
+			req.Header.Set("Origin", tt.origin)
+			if tt.preflight {
+				req.Header.Set("Access-Control-Request-Method", "POST")
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status || reached != tt.reached {
+				t.Errorf("status = %d, reached handler %v; want %d, %v", rec.Code, reached, tt.status, tt.reached)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.allow {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.allow)
+			}
+			allowsMethods := rec.Header().Get("Access-Control-Allow-Methods") != "" && rec.Header().Get("Access-Control-Allow-Headers") != ""
+			if allowsMethods != (tt.allow != "") {
+				t.Errorf("allowed methods and headers sent = %v, want %v", allowsMethods, tt.allow != "")
+			}
+			if got := rec.Header().Get("Vary"); got != tt.vary {
+				t.Errorf("Vary = %q, want %q", got, tt.vary)
+			}
+		})
+	}
+}
+
+func TestMaxBodyMiddleware(t *testing.T) {
+	handler := maxBodyMiddleware(8)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			var tooLarge *http.MaxBytesError
+			if !errors.As(err, &tooLarge) {
+				t.Errorf("read error = %v, want *http.MaxBytesError", err)
+			}
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		}
+	}))
+
+	tests := []struct {
+		body string
+		want int
+	}{
+		{"12345678", http.StatusOK},
+		{"123456789", http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/books", strings.NewReader(tt.body)))
+		if rec.Code != tt.want {
+			t.Errorf("%d byte body: status = %d, want %d", len(tt.body), rec.Code, tt.want)
+		}
+	}
+}
+
+func TestMaxBodyBytesFromEnv(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+	}{
+		{"", 1 << 20},
+		{"4096", 4096},
+		{"0", 1 << 20},
+		{"1MB", 1 << 20},
+	}
+
+	for _, tt := range tests {
+		t.Setenv("MAX_BODY_BYTES", tt.value)
+		if got := maxBodyBytesFromEnv(); got != tt.want {
+			t.Errorf("MAX_BODY_BYTES=%q: limit = %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestSpecDescribesEveryRoute(t *testing.T) {
+	t.Setenv("DEBUG_ENDPOINTS", "true")
+	bookHandler := handlers.NewBookHandler(handlers.NewSQLRepository(nil))
+	router := setupRoutes(bookHandler, handlers.NewAdminHandler(nil, bookHandler), handlers.NewHealthHandler(nil))
+
+	encoded, err := json.Marshal(spec.Build())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Paths map[string]map[string]interface{} `json:"paths"`
+	}
+	if err := json.Unmarshal(encoded, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	err = router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(path, "/api/") {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, method := range methods {
+			if _, ok := doc.Paths[path][strings.ToLower(method)]; !ok {
+				t.Errorf("the OpenAPI document lacks %s %s", method, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	handler := loggingMiddleware(recoveryMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m map[string]int
+		m["boom"]++
+	})))
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/api/v1/books", nil)
+	req.Header.Set("X-Request-ID", "trace-42")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("connection dropped: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusInternalServerError)
+	}
+	if got := resp.Header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	if got := resp.Header.Get("X-Request-ID"); got != "trace-42" {
+		t.Errorf("X-Request-ID = %q, want trace-42", got)
+	}
+	var body models.APIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("body is not JSON: %v", err)
+	}
+	if body.Success || body.Code != "internal_error" {
+		t.Errorf("body = %+v, want an internal_error response", body)
+	}
+
+	var logged *logrus.Entry
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Handler panicked" {
+			logged = entry
+		}
+	}
+	if logged == nil {
+		t.Fatal("the panic wasn't logged")
+	}
+	if logged.Data["request_id"] != "trace-42" || !strings.Contains(logged.Data["stack"].(string), "TestRecoveryMiddleware") {
+		t.Errorf("logged %v, want the request ID and stack trace", logged.Data)
+	}
+}
+
+func TestRecoveryMiddlewareAfterWrite(t *testing.T) {
+	handler := recoveryMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"partial":`))
+		panic("midway")
+	}))
+
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler to abort the response", p)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/books", nil))
+}
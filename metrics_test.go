@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// scrapeMetric returns the value of a series in the /metrics output, or 0
+// when it hasn't been recorded yet
+func scrapeMetric(t *testing.T, handler http.Handler, series string) float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("scrape status = %d", rec.Code)
+	}
+
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), series+" "); ok {
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("series %s has value %q", series, value)
+			}
+			return v
+		}
+	}
+	return 0
+}
+
+func TestMetricsMiddlewareCountsRequests(t *testing.T) {
+	router := mux.NewRouter()
+	router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	router.HandleFunc("/api/v1/books/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["id"] == "404" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}).Methods("GET")
+	handler := metricsMiddleware(router)(router)
+
+	series := []struct {
+		name string
+		want float64 // increase after the requests below
+	}{
+		{`http_requests_total{method="GET",path="/api/v1/books/{id}",status="200"}`, 2},
+		{`http_requests_total{method="GET",path="/api/v1/books/{id}",status="404"}`, 1},
+		{`http_requests_total{method="GET",path="unmatched",status="404"}`, 1},
+		{`http_request_duration_seconds_count{method="GET",path="/api/v1/books/{id}"}`, 3},
+	}
+	before := make([]float64, len(series))
+	for i, s := range series {
+		before[i] = scrapeMetric(t, handler, s.name)
+	}
+
+	for _, path := range []string{"/api/v1/books/1", "/api/v1/books/2", "/api/v1/books/404", "/nowhere/1"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	for i, s := range series {
+		if got := scrapeMetric(t, handler, s.name) - before[i]; got != s.want {
+			t.Errorf("%s increased by %v, want %v", s.name, got, s.want)
+		}
+	}
+}
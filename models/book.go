@@ -6,19 +6,27 @@ import (
 
 // Book represents a book in the library
 type Book struct {
-	ID            int       `json:"id" db:"id"`
-	Title         string    `json:"title" db:"title"`
-	Author        string    `json:"author" db:"author"`
-	PublishedYear int       `json:"published_year" db:"published_year"`
-	Available     bool      `json:"available" db:"available"`
-	CreatedAt     time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt     time.Time `json:"updated_at" db:"updated_at"`
+	ID                    int        `json:"id" db:"id"`
+	Title                 string     `json:"title" db:"title"`
+	Author                string     `json:"author" db:"author"`
+	ISBN                  string     `json:"isbn" db:"isbn"`
+	Genre                 string     `json:"genre" db:"genre"`
+	PublishedYear         int        `json:"published_year" db:"published_year"`
+	Available             bool       `json:"available" db:"available"`
+	Featured              bool       `json:"featured" db:"featured"`
+	AvailabilityChangedAt *time.Time `json:"availability_changed_at" db:"availability_changed_at"`
+	LastAccessedAt        *time.Time `json:"last_accessed_at" db:"last_accessed_at"`
+	CreatedAt             time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt             time.Time  `json:"updated_at" db:"updated_at"`
+	Score                 *float64   `json:"score,omitempty" db:"-"`
 }
 
 // CreateBookRequest represents the request payload for creating a book
 type CreateBookRequest struct {
 	Title         string `json:"title" validate:"required,min=1,max=255"`
 	Author        string `json:"author" validate:"required,min=1,max=255"`
+	ISBN          string `json:"isbn,omitempty" validate:"omitempty,isbn"`
+	Genre         string `json:"genre,omitempty" validate:"omitempty,max=100"`
 	PublishedYear int    `json:"published_year" validate:"required,min=1000,max=2100"`
 	Available     *bool  `json:"available,omitempty"`
 }
@@ -27,16 +35,169 @@ type CreateBookRequest struct {
 type UpdateBookRequest struct {
 	Title         *string `json:"title,omitempty" validate:"omitempty,min=1,max=255"`
 	Author        *string `json:"author,omitempty" validate:"omitempty,min=1,max=255"`
+	ISBN          *string `json:"isbn,omitempty" validate:"omitempty,len=0|isbn"` // Empty clears the ISBN
+	Genre         *string `json:"genre,omitempty" validate:"omitempty,max=100"`
 	PublishedYear *int    `json:"published_year,omitempty" validate:"omitempty,min=1000,max=2100"`
 	Available     *bool   `json:"available,omitempty"`
 }
 
+// BookEditions represents a book together with its other editions
+type BookEditions struct {
+	Book     *Book  `json:"book"`
+	Editions []Book `json:"editions"`
+}
+
+// YearCount represents the number of books published in a year
+type YearCount struct {
+	Year  int `json:"year"`
+	Count int `json:"count"`
+}
+
+// FieldChange represents a single field's value before and after an update
+type FieldChange struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// UpdatePreview represents the changes an update would make to a book
+type UpdatePreview struct {
+	ID      int           `json:"id"`
+	Changes []FieldChange `json:"changes"`
+}
+
+// ValidationReport represents the result of re-validating stored books
+type ValidationReport struct {
+	Checked int               `json:"checked"`
+	Invalid []InvalidBookInfo `json:"invalid"`
+}
+
+// InvalidBookInfo represents a stored book and the rules it violates
+type InvalidBookInfo struct {
+	ID         int      `json:"id"`
+	Violations []string `json:"violations"`
+}
+
+// CatalogHealthReport represents data-quality counts for the catalog
+type CatalogHealthReport struct {
+	TotalBooks                 int `json:"total_books"`
+	MissingISBN                int `json:"missing_isbn"`
+	DuplicateTitleAuthorGroups int `json:"duplicate_title_author_groups"`
+	OutOfRangeYears            int `json:"out_of_range_years"`
+}
+
+// ResourceID represents a created or updated resource by its ID alone
+type ResourceID struct {
+	ID int `json:"id"`
+}
+
+// Snapshot represents a saved copy of the catalog
+type Snapshot struct {
+	Name      string    `json:"name"`
+	BookCount int       `json:"book_count"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateSnapshotRequest represents the request payload for creating a snapshot
+type CreateSnapshotRequest struct {
+	Name string `json:"name" validate:"required,min=1,max=100"`
+}
+
+// QueryDiagnostic represents the query plan for one of the standard queries
+type QueryDiagnostic struct {
+	Name          string                   `json:"name"`
+	Query         string                   `json:"query"`
+	Plan          []map[string]interface{} `json:"plan"`
+	FullTableScan bool                     `json:"full_table_scan"`
+}
+
+// ResourceOptions represents the methods and content types a resource supports
+type ResourceOptions struct {
+	Methods      []string `json:"methods"`
+	ContentTypes []string `json:"content_types"`
+}
+
+// SearchCount represents the match count returned instead of a page of
+// results for overly broad searches
+type SearchCount struct {
+	Total     int `json:"total"`
+	Threshold int `json:"threshold"`
+}
+
+// BookCount represents the number of books matching a count request
+type BookCount struct {
+	Count int `json:"count"`
+}
+
+// ExportBooksRequest represents the request payload for exporting the books
+// matching a filter
+type ExportBooksRequest struct {
+	// Format is csv (the default) or json
+	Format string       `json:"format,omitempty"`
+	Filter ExportFilter `json:"filter"`
+}
+
+// ExportFilter restricts an export to matching books; unset fields don't
+// filter
+type ExportFilter struct {
+	// Author matches authors containing it, ignoring case
+	Author    string `json:"author,omitempty"`
+	YearMin   *int   `json:"year_min,omitempty"`
+	YearMax   *int   `json:"year_max,omitempty"`
+	Available *bool  `json:"available,omitempty"`
+	Genre     string `json:"genre,omitempty"`
+}
+
+// ImportResult represents the outcome of a book import
+type ImportResult struct {
+	Inserted int `json:"inserted"`
+	// Updated counts the stored books an upsert import replaced
+	Updated int              `json:"updated"`
+	Valid   int              `json:"valid"`
+	DryRun  bool             `json:"dry_run"`
+	Errors  []ImportRowError `json:"errors"`
+	// ImportBatchID identifies the books the import created, for listing
+	// or deleting them later; it's empty when it created none
+	ImportBatchID string `json:"import_batch_id,omitempty"`
+}
+
+// ImportBatchDeletion represents the books deleted with an import batch
+type ImportBatchDeletion struct {
+	ImportBatchID string `json:"import_batch_id"`
+	Deleted       int    `json:"deleted"`
+}
+
+// ImportRowError describes why one row of an import was skipped
+type ImportRowError struct {
+	Line   int               `json:"line"`
+	Error  string            `json:"error"`
+	Code   string            `json:"code"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// HealthStatus represents the liveness probe response
+type HealthStatus struct {
+	Status    string `json:"status"`
+	Timestamp string `json:"timestamp"`
+}
+
+// ReadinessStatus represents the readiness probe response, including how long
+// the database took to answer
+type ReadinessStatus struct {
+	Status      string `json:"status"`
+	DBLatencyMs int64  `json:"db_latency_ms"`
+	Error       string `json:"error,omitempty"`
+}
+
 // APIResponse represents a standard API response
 type APIResponse struct {
 	Success bool        `json:"success"`
 	Data    interface{} `json:"data,omitempty"`
 	Error   string      `json:"error,omitempty"`
+	Code    string      `json:"code,omitempty"`
 	Message string      `json:"message,omitempty"`
+	// Fields maps each invalid request field to what is wrong with it
+	Fields map[string]string `json:"fields,omitempty"`
 }
 
 // PaginatedResponse represents a paginated API response
@@ -47,10 +208,18 @@ type PaginatedResponse struct {
 	Error      string      `json:"error,omitempty"`
 }
 
-// Pagination represents pagination metadata
+// Pagination represents pagination metadata. When the total wasn't counted,
+// Total and TotalPages are -1 and TotalUnknown is set.
 type Pagination struct {
-	Page       int `json:"page"`
-	Limit      int `json:"limit"`
-	Total      int `json:"total"`
-	TotalPages int `json:"total_pages"`
+	// Page is omitted for cursor pagination, which has no page numbers
+	Page         int    `json:"page,omitempty"`
+	Limit        int    `json:"limit"`
+	Total        int    `json:"total"`
+	TotalPages   int    `json:"total_pages"`
+	TotalUnknown bool   `json:"total_unknown,omitempty"`
+	HasNext      bool   `json:"has_next"`
+	NextCursor   string `json:"next_cursor,omitempty"`
+	// MaxScore is the highest relevance score of any book a full-text
+	// search matches, for scaling scores. It is counted with the total.
+	MaxScore *float64 `json:"max_score,omitempty"`
 }
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Idle buckets are swept periodically, by sweepEvery, so one-off clients
+// don't accumulate
+const (
+	rateLimitSweepInterval = time.Minute
+	rateLimitIdleTimeout   = 3 * time.Minute
+)
+
+// rateLimiter is a token bucket per client IP. Each bucket holds up to
+// burst tokens and refills at rate tokens per second; a request spends one.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	// trustForwarded takes the client IP from X-Forwarded-For, which is only
+	// safe behind a proxy that sets it
+	trustForwarded bool
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int, trustForwarded bool) *rateLimiter {
+	return &rateLimiter{
+		rate:           rate,
+		burst:          float64(burst),
+		trustForwarded: trustForwarded,
+		buckets:        make(map[string]*tokenBucket),
+	}
+}
+
+// sweepEvery sweeps idle buckets every interval until ctx is cancelled
+func (l *rateLimiter) sweepEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			l.sweep(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// allow spends a token from key's bucket, or reports how long until one is
+// available
+func (l *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep drops buckets that have been idle long enough to be full again
+func (l *rateLimiter) sweep(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > rateLimitIdleTimeout {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// clientIP returns the IP a request is limited under
+func (l *rateLimiter) clientIP(r *http.Request) string {
+	if l.trustForwarded {
+		// The left-most address is the original client
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			if ip := strings.TrimSpace(first); ip != "" {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// middleware rejects requests over the client's limit with 429. Health
+// probes and metrics scrapes are never limited.
+func (l *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" || r.URL.Path == "/ready" || r.URL.Path == "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ok, wait := l.allow(l.clientIP(r), time.Now())
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeJSONError(w, http.StatusTooManyRequests, "rate_limited", "Too many requests, please retry later")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterMiddleware(t *testing.T) {
+	limiter := newRateLimiter(0.5, 3, false)
+	handler := limiter.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// Requests run in order against the same limiter, so the first client
+	// spends its burst of three before being limited
+	steps := []struct {
+		name       string
+		path       string
+		remoteAddr string
+		status     int
+		retryAfter string
+	}{
+		{"first", "/api/v1/books", "192.0.2.1:1234", http.StatusOK, ""},
+		{"second", "/api/v1/books", "192.0.2.1:1234", http.StatusOK, ""},
+		{"third", "/api/v1/books", "192.0.2.1:1234", http.StatusOK, ""},
+		{"over the burst from another port", "/api/v1/books", "192.0.2.1:5678", http.StatusTooManyRequests, "2"},
+		{"other client", "/api/v1/books", "192.0.2.2:1234", http.StatusOK, ""},
+		{"health probe", "/health", "192.0.2.1:1234", http.StatusOK, ""},
+		{"readiness probe", "/ready", "192.0.2.1:1234", http.StatusOK, ""},
+	}
+
+	for _, step := range steps {
+		req := httptest.NewRequest("GET", step.path, nil)
+		req.RemoteAddr = step.remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if rec.Code != step.status {
+			t.Errorf("%s: status = %d, want %d", step.name, rec.Code, step.status)
+		}
+		if got := rec.Header().Get("Retry-After"); got != step.retryAfter {
+			t.Errorf("%s: Retry-After = %q, want %q", step.name, got, step.retryAfter)
+		}
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	limiter := newRateLimiter(2, 1, false)
+	start := time.Now()
+
+	steps := []struct {
+		at      time.Duration
+		allowed bool
+		wait    time.Duration
+	}{
+		{0, true, 0},
+		{0, false, 500 * time.Millisecond},
+		{250 * time.Millisecond, false, 250 * time.Millisecond},
+		{500 * time.Millisecond, true, 0},
+	}
+
+	for _, step := range steps {
+		ok, wait := limiter.allow("client", start.Add(step.at))
+		if ok != step.allowed || wait != step.wait {
+			t.Errorf("at %v: allowed %v, wait %v; want %v, %v", step.at, ok, wait, step.allowed, step.wait)
+		}
+	}
+}
+
+func TestRateLimiterClientIP(t *testing.T) {
+	tests := []struct {
+		trustForwarded bool
+		forwarded      string
+		want           string
+	}{
+		{false, "203.0.113.7, 10.0.0.1", "10.0.0.1"},
+		{true, "203.0.113.7, 10.0.0.1", "203.0.113.7"},
+		{true, "", "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/v1/books", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		if tt.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tt.forwarded)
+		}
+		if got := newRateLimiter(1, 1, tt.trustForwarded).clientIP(req); got != tt.want {
+			t.Errorf("trust %v, X-Forwarded-For %q: clientIP = %q, want %q", tt.trustForwarded, tt.forwarded, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimiterSweepEvery(t *testing.T) {
+	limiter := newRateLimiter(1, 1, false)
+	limiter.allow("idle", time.Now().Add(-rateLimitIdleTimeout-time.Second))
+	limiter.allow("active", time.Now())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		limiter.sweepEvery(ctx, time.Millisecond)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		limiter.mu.Lock()
+		_, idle := limiter.buckets["idle"]
+		_, active := limiter.buckets["active"]
+		limiter.mu.Unlock()
+		if !active {
+			t.Fatal("the active bucket was swept")
+		}
+		if !idle {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the idle bucket was not swept")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the sweeper did not stop when its context was cancelled")
+	}
+}
@@ -0,0 +1,644 @@
+package spec
+
+import (
+	"library-api/models"
+)
+
+// Build returns the OpenAPI document describing every endpoint
+func Build() *Document {
+	reg := newSchemaRegistry()
+	book := reg.ref(models.Book{})
+
+	doc := &Document{
+		OpenAPI: "3.0.3",
+		Info: Info{
+			Title:       "Library API",
+			Description: "Manage a library's book catalog. Errors share the Error schema; see the README for details of each endpoint.",
+			Version:     "1.0.0",
+		},
+		Paths: map[string]*PathItem{
+			"/health": {
+				Get: &Operation{
+					Summary:     "Liveness probe",
+					OperationID: "health",
+					Tags:        []string{"health"},
+					Responses: map[string]*Response{
+						"200": jsonResponse("The process is running", reg.ref(models.HealthStatus{})),
+					},
+				},
+			},
+			"/ready": {
+				Get: &Operation{
+					Summary:     "Readiness probe",
+					Description: "Checks that the database answers.",
+					OperationID: "ready",
+					Tags:        []string{"health"},
+					Responses: map[string]*Response{
+						"200": jsonResponse("Ready to serve traffic", reg.ref(models.ReadinessStatus{})),
+						"503": jsonResponse("The database is unreachable", reg.ref(models.ReadinessStatus{})),
+					},
+				},
+			},
+			"/metrics": {
+				Get: &Operation{
+					Summary:     "Prometheus metrics",
+					OperationID: "metrics",
+					Tags:        []string{"health"},
+					Responses: map[string]*Response{
+						"200": {Description: "Metrics in the Prometheus text format", Content: map[string]*MediaType{"text/plain": {Schema: &Schema{Type: "string"}}}},
+					},
+				},
+			},
+			"/api/v1/books": {
+				Get: &Operation{
+					Summary:     "List books",
+					Description: "Pages through books, optionally searching and filtering them. Pagination links are also sent in a Link header. A search matching more than SEARCH_COUNT_ONLY_THRESHOLD books returns a SearchCount instead of a page unless force is set.",
+					OperationID: "listBooks",
+					Tags:        []string{"books"},
+					Parameters: append(append(pageParams(),
+						queryParam("sort", "Column to order by", enumSchema("id", "title", "author", "published_year", "created_at", "updated_at", "completeness")),
+						queryParam("order", "Sort direction", enumSchema("asc", "desc")),
+						queryParam("collation", "Collation ordering a title or author sort, such as utf8mb4_da_0900_ai_ci on MySQL or da-x-icu on PostgreSQL", &Schema{Type: "string"}),
+						queryParam("include_score", "Include each search result's relevance score", &Schema{Type: "boolean"}),
+						queryParam("force", "List results of a search matching more than SEARCH_COUNT_ONLY_THRESHOLD books", &Schema{Type: "boolean"}),
+						queryParam("cursor", "Page by cursor instead of page number; empty to start", &Schema{Type: "string"}),
+						queryParam("count", "Count the matching books", &Schema{Type: "boolean"}),
+						queryParam("stream", "Send the page as a bare JSON array, flushed as rows are read", &Schema{Type: "boolean"}),
+					), filterParams()...),
+					Responses: map[string]*Response{
+						"200": paginatedResponse("A page of books", book),
+						"400": errorResponse("Invalid query parameters"),
+						"500": errorResponse("Internal error"),
+					},
+				},
+				Post: &Operation{
+					Summary:     "Create books",
+					Description: "Creates one book, or all books in an array body.",
+					OperationID: "createBook",
+					Tags:        []string{"books"},
+					RequestBody: jsonBody(reg.ref(models.CreateBookRequest{})),
+					Responses: map[string]*Response{
+						"201": dataResponse("The created book", book),
+						"400": errorResponse("Malformed body"),
+						"409": errorResponse("Duplicate ISBN or author book limit reached"),
+						"413": errorResponse("Body too large"),
+						"422": errorResponse("Invalid fields"),
+					},
+				},
+				Options: optionsOperation("booksOptions", reg.ref(models.ResourceOptions{})),
+			},
+			"/api/v1/books/bulk": {
+				Post: &Operation{
+					Summary:     "Create books in bulk",
+					Description: "Creates up to 1000 books in one transaction, or none if any is invalid.",
+					OperationID: "createBooksBulk",
+					Tags:        []string{"books"},
+					RequestBody: jsonBody(&Schema{Type: "array", Items: reg.ref(models.CreateBookRequest{})}),
+					Responses: map[string]*Response{
+						"201": dataResponse("The created books", &Schema{Type: "array", Items: book}),
+						"400": errorResponse("Malformed body"),
+						"409": errorResponse("Duplicate ISBN or author book limit reached"),
+						"422": errorResponse("An invalid book, or too many books"),
+					},
+				},
+			},
+			"/api/v1/books/featured": {
+				Get: &Operation{
+					Summary:     "List featured books",
+					OperationID: "listFeaturedBooks",
+					Tags:        []string{"books"},
+					Responses: map[string]*Response{
+						"200": dataResponse("Every featured book", &Schema{Type: "array", Items: book}),
+					},
+				},
+			},
+			"/api/v1/books/import-template.csv": {
+				Get: &Operation{
+					Summary:     "Download the CSV import template",
+					OperationID: "getImportTemplate",
+					Tags:        []string{"import and export"},
+					Responses: map[string]*Response{
+						"200": {Description: "A CSV header row", Content: map[string]*MediaType{"text/csv": {Schema: &Schema{Type: "string"}}}},
+					},
+				},
+			},
+			"/api/v1/books/import": {
+				Post: &Operation{
+					Summary:     "Import books from a file",
+					Description: "Creates a book for every valid row of a CSV or JSON file. Invalid rows are skipped and reported.",
+					OperationID: "importBooks",
+					Tags:        []string{"import and export"},
+					Parameters: []Parameter{
+						queryParam("dry_run", "Only validate the rows", &Schema{Type: "boolean"}),
+						queryParam("mode", "Whether rows matching a stored book replace it (upsert) or are conflicts (insert, the default)", enumSchema("insert", "upsert")),
+						queryParam("key", "What matches a row to a stored book in upsert mode (default isbn)", enumSchema("isbn", "title_author_year")),
+					},
+					RequestBody: &RequestBody{
+						Required: true,
+						Content: map[string]*MediaType{
+							"multipart/form-data": {Schema: &Schema{
+								Type:       "object",
+								Properties: map[string]*Schema{"file": {Type: "string", Format: "binary"}},
+								Required:   []string{"file"},
+							}},
+						},
+					},
+					Responses: map[string]*Response{
+						"200": dataResponse("What was imported", reg.ref(models.ImportResult{})),
+						"400": errorResponse("No file, a file that can't be read, or an unknown mode or key"),
+						"409": errorResponse("A conflicting book was created during the import"),
+						"413": errorResponse("Upload too large"),
+					},
+				},
+			},
+			"/api/v1/books/export": {
+				Get: &Operation{
+					Summary:     "Export the catalog",
+					OperationID: "exportBooks",
+					Tags:        []string{"import and export"},
+					Parameters: []Parameter{
+						queryParam("format", "File format", enumSchema("csv", "json")),
+					},
+					Responses: map[string]*Response{
+						"200": {
+							Description: "Every book, as a download",
+							Content: map[string]*MediaType{
+								"text/csv":         {Schema: &Schema{Type: "string"}},
+								"application/json": {Schema: &Schema{Type: "array", Items: book}},
+							},
+						},
+						"400": errorResponse("Unknown format"),
+					},
+				},
+				Post: &Operation{
+					Summary:     "Export matching books",
+					Description: "Exports the books matching the filter in the body, in the format it names. Without a body the whole catalog is exported as CSV.",
+					OperationID: "exportMatchingBooks",
+					Tags:        []string{"import and export"},
+					RequestBody: &RequestBody{
+						Content: map[string]*MediaType{"application/json": {Schema: reg.ref(models.ExportBooksRequest{})}},
+					},
+					Responses: map[string]*Response{
+						"200": {
+							Description: "The matching books, as a download",
+							Content: map[string]*MediaType{
+								"text/csv":         {Schema: &Schema{Type: "string"}},
+								"application/json": {Schema: &Schema{Type: "array", Items: book}},
+							},
+						},
+						"400": errorResponse("Unknown format, or an invalid filter"),
+					},
+				},
+			},
+			"/api/v1/books/count": {
+				Get: &Operation{
+					Summary:     "Count books",
+					OperationID: "countBooks",
+					Tags:        []string{"books"},
+					Parameters:  filterParams(),
+					Responses: map[string]*Response{
+						"200": dataResponse("How many books match", reg.ref(models.BookCount{})),
+						"400": errorResponse("Invalid query parameters"),
+					},
+				},
+			},
+			"/api/v1/books/random": {
+				Get: &Operation{
+					Summary:     "Pick a random book",
+					Description: "Only available books are picked unless available is given.",
+					OperationID: "getRandomBook",
+					Tags:        []string{"books"},
+					Parameters:  filterParams(),
+					Responses: map[string]*Response{
+						"200": dataResponse("A random matching book", book),
+						"400": errorResponse("Invalid query parameters"),
+						"404": errorResponse("No book matches"),
+					},
+				},
+			},
+			"/api/v1/books/years": {
+				Get: &Operation{
+					Summary:     "Count books per published year",
+					OperationID: "getYearCounts",
+					Tags:        []string{"reports"},
+					Parameters:  filterParams(),
+					Responses: map[string]*Response{
+						"200": dataResponse("Counts in ascending year order", &Schema{Type: "array", Items: reg.ref(models.YearCount{})}),
+						"400": errorResponse("Invalid query parameters"),
+					},
+				},
+			},
+			"/api/v1/books/matrix": {
+				Get: &Operation{
+					Summary:     "Count books by two dimensions",
+					OperationID: "getBookMatrix",
+					Tags:        []string{"reports"},
+					Parameters: []Parameter{
+						queryParam("rows", "Row dimension", &Schema{Type: "string"}),
+						queryParam("cols", "Column dimension", &Schema{Type: "string"}),
+					},
+					Responses: map[string]*Response{
+						"200": dataResponse("Counts keyed by row then column value", &Schema{
+							Type:                 "object",
+							AdditionalProperties: &Schema{Type: "object", AdditionalProperties: &Schema{Type: "integer"}},
+						}),
+						"400": errorResponse("Unknown dimension"),
+					},
+				},
+			},
+			"/api/v1/books/availability-changes": {
+				Get: &Operation{
+					Summary:     "List books whose availability changed",
+					OperationID: "getAvailabilityChanges",
+					Tags:        []string{"reports"},
+					Parameters: append(pageParams(),
+						Parameter{Name: "since", In: "query", Required: true, Description: "RFC3339 timestamp", Schema: &Schema{Type: "string", Format: "date-time"}},
+					),
+					Responses: map[string]*Response{
+						"200": paginatedResponse("Books changed after since, oldest change first", book),
+						"400": errorResponse("Missing or invalid since"),
+					},
+				},
+			},
+			"/api/v1/books/stale": {
+				Get: &Operation{
+					Summary:     "List books not accessed recently",
+					OperationID: "getStaleBooks",
+					Tags:        []string{"reports"},
+					Parameters: append(pageParams(),
+						Parameter{Name: "before", In: "query", Required: true, Description: "RFC3339 timestamp", Schema: &Schema{Type: "string", Format: "date-time"}},
+					),
+					Responses: map[string]*Response{
+						"200": paginatedResponse("Books last accessed before before, or never", book),
+						"400": errorResponse("Missing or invalid before"),
+					},
+				},
+			},
+			"/api/v1/books/import-batch/{batch}": {
+				Delete: &Operation{
+					Summary:     "Delete an import batch",
+					Description: "Deletes every book created by one import, in a single transaction.",
+					OperationID: "deleteImportBatch",
+					Tags:        []string{"import and export"},
+					Parameters: []Parameter{
+						{Name: "batch", In: "path", Required: true, Schema: &Schema{Type: "string", Format: "uuid"}},
+					},
+					Responses: map[string]*Response{
+						"200": dataResponse("How many books were deleted", reg.ref(models.ImportBatchDeletion{})),
+						"400": errorResponse("Not an import batch ID"),
+						"404": errorResponse("No books were created by the import batch"),
+					},
+				},
+			},
+			"/api/v1/books/{id}": {
+				Get: &Operation{
+					Summary:     "Get a book",
+					OperationID: "getBook",
+					Tags:        []string{"books"},
+					Parameters: []Parameter{
+						idParam(),
+						{Name: "If-None-Match", In: "header", Description: "ETag of a copy the client has", Schema: &Schema{Type: "string"}},
+					},
+					Responses: map[string]*Response{
+						"200": dataResponse("The book, with its ETag header", book),
+						"304": {Description: "The client's copy is current"},
+						"404": errorResponse("Book not found"),
+					},
+				},
+				Put: &Operation{
+					Summary:     "Replace a book",
+					Description: "title, author, published_year and available are required; an omitted isbn or genre is cleared.",
+					OperationID: "replaceBook",
+					Tags:        []string{"books"},
+					Parameters:  []Parameter{idParam(), ifMatchParam()},
+					RequestBody: jsonBody(reg.ref(models.UpdateBookRequest{})),
+					Responses:   writeResponses(book),
+				},
+				Patch: &Operation{
+					Summary:     "Update some of a book's fields",
+					OperationID: "updateBook",
+					Tags:        []string{"books"},
+					Parameters:  []Parameter{idParam(), ifMatchParam()},
+					RequestBody: jsonBody(reg.ref(models.UpdateBookRequest{})),
+					Responses:   writeResponses(book),
+				},
+				Delete: &Operation{
+					Summary:     "Delete a book",
+					OperationID: "deleteBook",
+					Tags:        []string{"books"},
+					Parameters:  []Parameter{idParam()},
+					Responses: map[string]*Response{
+						"200": messageResponse("The book was deleted"),
+						"404": errorResponse("Book not found"),
+					},
+				},
+				Options: optionsOperation("bookOptions", reg.ref(models.ResourceOptions{})),
+			},
+			"/api/v1/books/{id}/editions": {
+				Get: &Operation{
+					Summary:     "Get a book and its other editions",
+					OperationID: "getBookEditions",
+					Tags:        []string{"books"},
+					Parameters:  []Parameter{idParam()},
+					Responses: map[string]*Response{
+						"200": dataResponse("The book and its editions", reg.ref(models.BookEditions{})),
+						"404": errorResponse("Book not found"),
+					},
+				},
+			},
+			"/api/v1/books/{id}/feature": {
+				Post: &Operation{
+					Summary:     "Feature a book",
+					OperationID: "featureBook",
+					Tags:        []string{"books"},
+					Parameters:  []Parameter{idParam()},
+					Responses: map[string]*Response{
+						"200": dataResponse("The featured book", book),
+						"404": errorResponse("Book not found"),
+						"409": errorResponse("Featured book limit reached"),
+					},
+				},
+			},
+			"/api/v1/books/{id}/unfeature": {
+				Post: &Operation{
+					Summary:     "Stop featuring a book",
+					OperationID: "unfeatureBook",
+					Tags:        []string{"books"},
+					Parameters:  []Parameter{idParam()},
+					Responses: map[string]*Response{
+						"200": dataResponse("The book", book),
+						"404": errorResponse("Book not found"),
+					},
+				},
+			},
+			"/api/v1/books/{id}/clone": {
+				Post: &Operation{
+					Summary:     "Copy a book",
+					OperationID: "cloneBook",
+					Tags:        []string{"books"},
+					Parameters:  []Parameter{idParam()},
+					RequestBody: &RequestBody{Content: map[string]*MediaType{
+						"application/json": {Schema: reg.ref(models.UpdateBookRequest{})},
+					}},
+					Responses: map[string]*Response{
+						"201": dataResponse("The new book", book),
+						"404": errorResponse("Book not found"),
+						"422": errorResponse("Invalid fields"),
+					},
+				},
+			},
+			"/api/v1/books/{id}/preview-update": {
+				Post: &Operation{
+					Summary:     "Preview an update",
+					OperationID: "previewUpdate",
+					Tags:        []string{"books"},
+					Parameters:  []Parameter{idParam()},
+					RequestBody: jsonBody(reg.ref(models.UpdateBookRequest{})),
+					Responses: map[string]*Response{
+						"200": dataResponse("The fields that would change", reg.ref(models.UpdatePreview{})),
+						"404": errorResponse("Book not found"),
+						"422": errorResponse("Invalid fields"),
+					},
+				},
+			},
+			"/api/v1/admin/validate-all": {
+				Get: adminOperation(&Operation{
+					Summary:     "Validate every stored book",
+					OperationID: "validateAll",
+					Responses: map[string]*Response{
+						"200": dataResponse("Books breaking the validation rules", reg.ref(models.ValidationReport{})),
+					},
+				}),
+			},
+			"/api/v1/admin/health-report": {
+				Get: adminOperation(&Operation{
+					Summary:     "Report catalog data quality",
+					OperationID: "healthReport",
+					Responses: map[string]*Response{
+						"200": dataResponse("The report", reg.ref(models.CatalogHealthReport{})),
+					},
+				}),
+			},
+			"/api/v1/admin/snapshot": {
+				Post: adminOperation(&Operation{
+					Summary:     "Snapshot every book",
+					OperationID: "createSnapshot",
+					RequestBody: jsonBody(reg.ref(models.CreateSnapshotRequest{})),
+					Responses: map[string]*Response{
+						"201": dataResponse("The snapshot", reg.ref(models.Snapshot{})),
+						"409": errorResponse("Snapshot name taken"),
+						"422": errorResponse("Invalid snapshot name"),
+					},
+				}),
+			},
+			"/api/v1/admin/snapshot/{name}/restore": {
+				Post: adminOperation(&Operation{
+					Summary:     "Restore a snapshot",
+					OperationID: "restoreSnapshot",
+					Parameters: []Parameter{
+						{Name: "name", In: "path", Required: true, Schema: &Schema{Type: "string"}},
+					},
+					Responses: map[string]*Response{
+						"200": dataResponse("How many books were restored", &Schema{
+							Type:       "object",
+							Properties: map[string]*Schema{"restored": {Type: "integer"}},
+						}),
+						"404": errorResponse("Snapshot not found"),
+					},
+				}),
+			},
+			"/api/v1/admin/explain": {
+				Get: adminOperation(&Operation{
+					Summary:     "Explain a search query",
+					Description: "Only served when DEBUG_ENDPOINTS is set.",
+					OperationID: "explainSearch",
+					Parameters: []Parameter{
+						{Name: "q", In: "query", Required: true, Description: "Search to explain", Schema: &Schema{Type: "string"}},
+					},
+					Responses: map[string]*Response{
+						"200": dataResponse("The database's query plan", &Schema{}),
+						"400": errorResponse("Missing q"),
+					},
+				}),
+			},
+			"/api/v1/admin/diagnostics/queries": {
+				Get: adminOperation(&Operation{
+					Summary:     "Show the plans of the standard queries",
+					Description: "Only served when DEBUG_ENDPOINTS is set.",
+					OperationID: "diagnoseQueries",
+					Responses: map[string]*Response{
+						"200": dataResponse("A plan per query", &Schema{Type: "array", Items: reg.ref(models.QueryDiagnostic{})}),
+					},
+				}),
+			},
+		},
+		Components: Components{
+			SecuritySchemes: map[string]*SecurityScheme{
+				"adminKey": {Type: "apiKey", Name: "X-Admin-Key", In: "header"},
+			},
+		},
+	}
+
+	// Referenced by name rather than through a model, or only described:
+	// registered so they still appear under components
+	reg.ref(models.Pagination{})
+	reg.ref(models.SearchCount{})
+
+	// Taken after the paths so every model they reference is registered
+	doc.Components.Schemas = reg.schemas
+	doc.Components.Schemas["Error"] = &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"success": {Type: "boolean"},
+			"error":   {Type: "string", Description: "Message in the language the request prefers"},
+			"code":    {Type: "string", Description: "Stable error code to match on"},
+			"fields":  {Type: "object", Description: "Invalid fields and what is wrong with each", AdditionalProperties: &Schema{Type: "string"}},
+		},
+		Required: []string{"success", "error", "code"},
+	}
+
+	return doc
+}
+
+// jsonBody is a required JSON request body
+func jsonBody(schema *Schema) *RequestBody {
+	return &RequestBody{
+		Required: true,
+		Content:  map[string]*MediaType{"application/json": {Schema: schema}},
+	}
+}
+
+// jsonResponse is a JSON response sent without the success envelope
+func jsonResponse(description string, schema *Schema) *Response {
+	return &Response{
+		Description: description,
+		Content:     map[string]*MediaType{"application/json": {Schema: schema}},
+	}
+}
+
+// dataResponse is a successful response carrying data in the envelope
+func dataResponse(description string, data *Schema) *Response {
+	return jsonResponse(description, &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"success": {Type: "boolean"},
+			"data":    data,
+			"message": {Type: "string"},
+		},
+		Required: []string{"success", "data"},
+	})
+}
+
+// messageResponse is a successful response carrying only a message
+func messageResponse(description string) *Response {
+	return jsonResponse(description, &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"success": {Type: "boolean"},
+			"message": {Type: "string"},
+		},
+		Required: []string{"success"},
+	})
+}
+
+// paginatedResponse is a page of items with its pagination block
+func paginatedResponse(description string, item *Schema) *Response {
+	return jsonResponse(description, &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"success":    {Type: "boolean"},
+			"data":       {Type: "array", Items: item},
+			"pagination": {Ref: "#/components/schemas/Pagination"},
+		},
+		Required: []string{"success", "data", "pagination"},
+	})
+}
+
+// errorResponse is an error response
+func errorResponse(description string) *Response {
+	return jsonResponse(description, &Schema{Ref: "#/components/schemas/Error"})
+}
+
+// writeResponses are the responses of the operations changing a book
+func writeResponses(book *Schema) map[string]*Response {
+	return map[string]*Response{
+		"200": dataResponse("The updated book, with its new ETag header", book),
+		"204": {Description: "Updated; sent instead of the book with Prefer: return=minimal"},
+		"400": errorResponse("Malformed body or missing fields"),
+		"404": errorResponse("Book not found"),
+		"409": errorResponse("Duplicate ISBN"),
+		"412": errorResponse("The book changed since the If-Match ETag was read"),
+		"422": errorResponse("Invalid fields"),
+	}
+}
+
+// optionsOperation describes an OPTIONS request on a book resource
+func optionsOperation(id string, options *Schema) *Operation {
+	return &Operation{
+		Summary:     "Describe the resource",
+		OperationID: id,
+		Tags:        []string{"books"},
+		Responses: map[string]*Response{
+			"200": dataResponse("Supported methods and content types", options),
+		},
+	}
+}
+
+// adminOperation marks an operation as an admin one, requiring the admin
+// key
+func adminOperation(op *Operation) *Operation {
+	op.Tags = []string{"admin"}
+	op.Security = []map[string][]string{{"adminKey": {}}}
+	op.Responses["401"] = errorResponse("Missing or wrong admin key")
+	op.Responses["403"] = errorResponse("No admin key is configured")
+	return op
+}
+
+func idParam() Parameter {
+	return Parameter{Name: "id", In: "path", Required: true, Schema: &Schema{Type: "integer"}}
+}
+
+func ifMatchParam() Parameter {
+	return Parameter{
+		Name:        "If-Match",
+		In:          "header",
+		Description: "Only write if the book still has this ETag",
+		Schema:      &Schema{Type: "string"},
+	}
+}
+
+func queryParam(name, description string, schema *Schema) Parameter {
+	return Parameter{Name: name, In: "query", Description: description, Schema: schema}
+}
+
+func enumSchema(values ...string) *Schema {
+	return &Schema{Type: "string", Enum: values}
+}
+
+// pageParams are the offset pagination parameters
+func pageParams() []Parameter {
+	return []Parameter{
+		queryParam("page", "Page number, from 1", &Schema{Type: "integer"}),
+		queryParam("limit", "Books per page, up to MAX_PAGE_LIMIT", &Schema{Type: "integer"}),
+	}
+}
+
+// filterParams are the search and filter parameters shared by the book
+// list endpoints
+func filterParams() []Parameter {
+	return []Parameter{
+		queryParam("q", "Search title and author", &Schema{Type: "string"}),
+		queryParam("title", "Only books whose title contains this", &Schema{Type: "string"}),
+		queryParam("author", "Only books whose author contains this", &Schema{Type: "string"}),
+		queryParam("genre", "Only books of this genre", &Schema{Type: "string"}),
+		queryParam("available", "Only books with this availability", &Schema{Type: "boolean"}),
+		queryParam("year_min", "Earliest published year", &Schema{Type: "integer"}),
+		queryParam("year_max", "Latest published year", &Schema{Type: "integer"}),
+		queryParam("id_min", "Smallest book ID", &Schema{Type: "integer"}),
+		queryParam("id_max", "Largest book ID", &Schema{Type: "integer"}),
+		queryParam("created_since", "Only books created at or after this time", &Schema{Type: "string", Format: "date-time"}),
+		queryParam("updated_since", "Only books updated at or after this time", &Schema{Type: "string", Format: "date-time"}),
+		queryParam("import_batch", "Only books created by the import with this batch ID", &Schema{Type: "string", Format: "uuid"}),
+		queryParam("filter", "Filter expression", &Schema{Type: "string"}),
+	}
+}
@@ -0,0 +1,131 @@
+package spec
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schemaRegistry generates component schemas from Go types, registering
+// each named struct once and referring to it by name
+type schemaRegistry struct {
+	schemas map[string]*Schema
+}
+
+func newSchemaRegistry() *schemaRegistry {
+	return &schemaRegistry{schemas: make(map[string]*Schema)}
+}
+
+// ref returns a reference to the component schema of v's type, generating
+// it first if needed
+func (reg *schemaRegistry) ref(v interface{}) *Schema {
+	return reg.schemaOf(reflect.TypeOf(v))
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// schemaOf returns the schema of a type. Pointers are nullable, named
+// structs become references to component schemas and interface{} allows
+// any value.
+func (reg *schemaRegistry) schemaOf(t reflect.Type) *Schema {
+	if t.Kind() == reflect.Pointer {
+		s := reg.schemaOf(t.Elem())
+		if s.Ref != "" {
+			// Siblings of $ref are ignored in OpenAPI 3.0, so a nullable
+			// reference is left as a plain one
+			return s
+		}
+		s.Nullable = true
+		return s
+	}
+
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t.Kind() == reflect.Struct && t.Name() != "":
+		if _, ok := reg.schemas[t.Name()]; !ok {
+			// Registered before its fields so self-references terminate
+			reg.schemas[t.Name()] = &Schema{}
+			*reg.schemas[t.Name()] = *reg.structSchema(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + t.Name()}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: reg.schemaOf(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: reg.schemaOf(t.Elem())}
+	case reflect.Struct:
+		return reg.structSchema(t)
+	}
+	// interface{} and anything else: any value
+	return &Schema{}
+}
+
+// structSchema describes a struct's JSON fields. Fields whose validate tag
+// starts with required are required, and min and max rules become length
+// or range limits.
+func (reg *schemaRegistry) structSchema(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		prop := reg.schemaOf(field.Type)
+		rules := strings.Split(field.Tag.Get("validate"), ",")
+		if rules[0] == "required" {
+			s.Required = append(s.Required, name)
+		}
+		applyLimits(prop, rules)
+		s.Properties[name] = prop
+	}
+
+	return s
+}
+
+// applyLimits adds the min and max validate rules to a string or number
+// schema
+func applyLimits(s *Schema, rules []string) {
+	for _, rule := range rules {
+		key, value, ok := strings.Cut(rule, "=")
+		if !ok || (key != "min" && key != "max") {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case s.Type == "string" && key == "min":
+			s.MinLength = &n
+		case s.Type == "string" && key == "max":
+			s.MaxLength = &n
+		case s.Type == "integer" && key == "min":
+			f := float64(n)
+			s.Minimum = &f
+		case s.Type == "integer" && key == "max":
+			f := float64(n)
+			s.Maximum = &f
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package spec
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// served fetches the document from Handler as generic JSON
+func served(t *testing.T) map[string]interface{} {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/openapi.json", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("document is not valid JSON: %v", err)
+	}
+	return doc
+}
+
+func TestHandlerServesDocument(t *testing.T) {
+	doc := served(t)
+
+	if version, _ := doc["openapi"].(string); !strings.HasPrefix(version, "3.0.") {
+		t.Errorf("openapi = %v, want 3.0.x", doc["openapi"])
+	}
+
+	paths, _ := doc["paths"].(map[string]interface{})
+	for _, path := range []string{"/api/v1/books", "/api/v1/books/{id}"} {
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			t.Errorf("no %s path", path)
+			continue
+		}
+		if _, ok := item["get"]; !ok {
+			t.Errorf("%s has no get operation", path)
+		}
+	}
+
+	schemas, _ := doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+	book, _ := schemas["Book"].(map[string]interface{})
+	properties, _ := book["properties"].(map[string]interface{})
+	for _, field := range []string{"id", "title", "author", "published_year", "available", "isbn", "genre"} {
+		if _, ok := properties[field]; !ok {
+			t.Errorf("Book schema lacks %s", field)
+		}
+	}
+}
+
+// refs collects every $ref in a JSON value
+func refs(v interface{}, found map[string]bool) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if ref, ok := value.(string); ok && key == "$ref" {
+				found[ref] = true
+			}
+			refs(value, found)
+		}
+	case []interface{}:
+		for _, value := range v {
+			refs(value, found)
+		}
+	}
+}
+
+func TestDocumentReferencesResolve(t *testing.T) {
+	doc := served(t)
+	schemas, _ := doc["components"].(map[string]interface{})["schemas"].(map[string]interface{})
+
+	found := make(map[string]bool)
+	refs(doc, found)
+	if len(found) == 0 {
+		t.Fatal("document has no schema references")
+	}
+	for ref := range found {
+		name, ok := strings.CutPrefix(ref, "#/components/schemas/")
+		if !ok || schemas[name] == nil {
+			t.Errorf("reference %s doesn't resolve", ref)
+		}
+	}
+}
+
+func TestDocsHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	DocsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/docs", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if !strings.Contains(rec.Body.String(), "/openapi.json") {
+		t.Error("docs page doesn't load /openapi.json")
+	}
+}